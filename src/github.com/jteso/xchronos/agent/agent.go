@@ -1,24 +1,32 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"strconv"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
 	"github.com/jteso/xchronos/task"
-
-	"github.com/coreos/go-etcd/etcd"
 )
 
 const (
 	SCHEDULER_ELECTION_KEY = "/xchronos/var/scheduler/election"
-	EXECUTORS_DIR          = "/xchronos/etc/executors"
-	JOBS_DIR               = "/xchronos/etc/jobs"
+	EXECUTORS_DIR          = scheduler.EXECUTORS_DIR
+	JOBS_DIR               = job.JOBS_DIR
+	OFFERS_DIR             = scheduler.OFFERS_DIR
 )
 
 var (
+	// Release of the agent, advertised to the leader. Set at build time, i.e.
+	// -ldflags "-X github.com/jteso/xchronos/agent.VERSION=1.0.0"
+	VERSION = "dev"
+
 	SCHEDULER_LEADER_TTL uint64        = 10 // max time running without leader
 	EXECUTOR_TTL         uint64        = 10 // max time running without a particular executor
 	HEARTBEAT            time.Duration = 5
@@ -27,15 +35,18 @@ var (
 type Agent struct {
 	// agent's id
 	ID string
+	// Advertised as executor, checked against the constraints of the jobs. Set before Run
+	Labels map[string]string
+	// Capacity slots, taken by the runs as their jobs tell (see job.Slots). Unlimited if
+	// 0. Set before Run
+	Capacity int
 	// Agent's state
 	state string
 	// Last error reported by the agent, or agent's task
 	lastError error
 
-	// Used to communicate to etcd cluster
-	etcdClient *etcd.Client
-	// See all the etcd nodes available in the cluster
-	etcdNodes []string
+	// Used to coordinate with the rest of agents (etcd, consul...)
+	store store.JobStore
 
 	// Manager of the all tasks running on the background by an agent
 	taskManager []*task.Task
@@ -44,24 +55,38 @@ type Agent struct {
 	// Signal back to ui, indicating when all registered tasks have stopped
 	haltedC chan struct{}
 
-	// receiving job offers channel pending to be executed
-	jobC chan *etcd.Response
 	// stop watching for jobs
 	jobStopC chan bool
+	// runs being executed, and the capacity slots they take. They do not depend on the
+	// state of the agent, so they are only cancelled once it stops (see stopTasks)
+	runs       sync.WaitGroup
+	usage      int64
+	runsCtx    context.Context
+	cancelRuns context.CancelFunc
+	// advertised as executor, so the leader tells a restart from a heartbeat
+	startedAt time.Time
+	hostname  string
 
 	// Debugging flag
 	verbose bool
 }
 
-// etcdNotes = strings.Split(os.Getenv("ETCD_NOTES"), ",")
-func New(id string, etcdNodes []string, verbose bool) *Agent {
+// New creates an agent coordinated through the given job store. The store is owned by
+// the caller, and may be shared by a number of agents.
+func New(id string, jobStore store.JobStore, verbose bool) *Agent {
+	hostname, _ := os.Hostname()
+	runsCtx, cancelRuns := context.WithCancel(context.Background())
 	return &Agent{
 		ID:          id,
 		state:       "INIT",
-		etcdNodes:   etcdNodes,
+		store:       jobStore,
 		verbose:     verbose,
 		haltTaskC:   make(chan struct{}),
 		taskManager: []*task.Task{},
+		runsCtx:     runsCtx,
+		cancelRuns:  cancelRuns,
+		startedAt:   time.Now().UTC(),
+		hostname:    hostname,
 	}
 }
 
@@ -80,14 +105,12 @@ func (a *Agent) Run() error {
 // - false, err: error
 func (a *Agent) runForLeader() (bool, error) {
 	// Put value if prevExist=false
-	_, err := a.etcdClient.Create(SCHEDULER_ELECTION_KEY, a.ID, SCHEDULER_LEADER_TTL)
+	_, err := a.store.Create(SCHEDULER_ELECTION_KEY, a.ID, SCHEDULER_LEADER_TTL)
 
 	if err != nil {
-		if etcdError, ok := err.(*etcd.EtcdError); ok {
-			// key already exists
-			if etcdError.ErrorCode == 105 {
-				return false, nil
-			}
+		// key already exists
+		if store.IsNodeExist(err) {
+			return a.reclaimLeadership()
 		}
 
 		return false, err
@@ -95,14 +118,17 @@ func (a *Agent) runForLeader() (bool, error) {
 	return true, nil
 }
 
-func (a *Agent) connectEtcdCluster() error {
-	a.etcdClient = etcd.NewClient(a.etcdNodes)
-	return nil
-}
-
-func (a *Agent) disconnectEtcdCluster() error {
-	a.etcdClient.Close()
-	return nil
+// reclaimLeadership keeps the leadership if the election key still holds this agent's id,
+// i.e. the agent has been restarted before its leader TTL ran out (standalone mode)
+func (a *Agent) reclaimLeadership() (bool, error) {
+	_, err := a.store.CompareAndSwap(SCHEDULER_ELECTION_KEY, a.ID, SCHEDULER_LEADER_TTL, a.ID, 0)
+	if err != nil {
+		if store.IsTestFailed(err) || store.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 func (a *Agent) changeState(newState string) {
@@ -114,7 +140,7 @@ func (a *Agent) advertiseAndRenewLeaderRoleT() *task.Task {
 	key := SCHEDULER_ELECTION_KEY
 	t := task.New("leaderRenewal", func() error {
 		a.log("Renewing my leader role...")
-		_, err := a.etcdClient.Set(key, a.ID, SCHEDULER_LEADER_TTL)
+		_, err := a.store.Set(key, a.ID, SCHEDULER_LEADER_TTL)
 		return err
 	})
 	t.RunEvery(time.Second * HEARTBEAT)
@@ -123,13 +149,14 @@ func (a *Agent) advertiseAndRenewLeaderRoleT() *task.Task {
 }
 
 // takeExecutorRole function will make the agent to offer itself to execute jobs been offered.
-// this offering is been done by writing periodically (HEARTBEAT) into the etcd dir /executors
+// this offering is been done by writing periodically (HEARTBEAT) its metadata into the etcd
+// dir /executors
 // this function will returned via chan any error is encountered, and this agent can be stop been
 // offered as an executor by stopping the agents executorTicker.
 func (a *Agent) advertiseAndRenewExecutorRoleT() *task.Task {
 	t := task.New("executorRenewal", func() error {
 		a.log("Renewing my executor role...")
-		_, err := a.etcdClient.Set(EXECUTORS_DIR+"/"+a.ID, "up", EXECUTOR_TTL)
+		_, err := a.advertise()
 		return err
 	})
 	t.RunEvery(time.Second * HEARTBEAT)
@@ -137,52 +164,122 @@ func (a *Agent) advertiseAndRenewExecutorRoleT() *task.Task {
 	return t
 }
 
-func (a *Agent) publishJobOffersT() *task.Task {
-	jobId := 0
-	t := task.New("jobOffersPublisher", func() error {
-		key := JOBS_DIR + "/agent_1/" + strconv.Itoa(jobId)
-		_, err := a.etcdClient.Set(key, "pending", 0)
-		jobId++
-		return err
+// advertise writes the metadata of the agent as executor under EXECUTORS_DIR
+func (a *Agent) advertise() (*store.Response, error) {
+	value, err := scheduler.EncodeMetadata(a.metadata())
+	if err != nil {
+		return nil, err
+	}
+	return a.store.Set(EXECUTORS_DIR+"/"+a.ID, value, EXECUTOR_TTL)
+}
+
+// metadata returns what the agent advertises as executor
+func (a *Agent) metadata() *scheduler.Metadata {
+	return &scheduler.Metadata{
+		StartedAt: a.startedAt,
+		Hostname:  a.hostname,
+		Version:   VERSION,
+		Capacity:  a.Capacity,
+		Usage:     int(atomic.LoadInt64(&a.usage)),
+		Labels:    a.Labels,
+	}
+}
+
+// runSchedulerT fires the jobs as they are due, publishing their offers. Misfired jobs
+// are dealt with first, see `scheduler.CheckMisfires`
+func (a *Agent) runSchedulerT() *task.Task {
+	stopC := make(chan bool, 1)
+	done := make(chan struct{})
+	t := task.New("scheduler", func() error {
+		defer close(done)
+		return scheduler.New(a.store, a.logf).Run(stopC)
+	})
+	// returns once the scheduler has stopped, so a deposed leader fires nothing else
+	t.OnStopFn(func() {
+		stopC <- true
+		<-done
 	})
-	t.RunEvery(time.Second * 1)
+	t.RunOnce()
 	a.registerTask(t)
 	return t
 }
 
+// watchForJobOffersT claims and executes the runs offered to this agent. Runs still
+// being executed when the task stops carry on, i.e. across a leader change.
 func (a *Agent) watchForJobOffersT() *task.Task {
+	// the one of this task, the field is replaced by the next one
+	jobStopC := make(chan bool, 1)
+	a.jobStopC = jobStopC
 	t := task.New("jobOffersWatcher", func() error {
-		key := fmt.Sprintf("%s/%s", JOBS_DIR, "agent_1")
-
-		a.jobC = make(chan *etcd.Response, 1)
-		a.jobStopC = make(chan bool, 1)
-		a.etcdClient.Watch(key, 0, true, a.jobC, a.jobStopC)
 		for {
-			r, ok := <-a.jobC
-			if !ok {
-				a.log("jobC has been closed")
-				break
+			err := a.watchForJobOffers(jobStopC)
+			if store.ErrorCode(err) != store.ErrCodeIndexCleared {
+				return err
 			}
-			// Job Received
-			a.logf("Job received: %s", r.Node.Key)
+			a.logf("Listing the offers again: %s", err.Error())
 		}
-		return nil
 	})
 	t.OnStopFn(func() {
-		a.jobStopC <- true
+		jobStopC <- true
 	})
 	t.RunOnce()
 	a.registerTask(t)
 	return t
 }
 
-func (a *Agent) watchForNewLeaderElectionT() *task.Task {
-	receiverC := make(chan *etcd.Response, 1)
+func (a *Agent) watchForJobOffers(stop chan bool) error {
+	// offers are placed on every executor's own queue
+	key := fmt.Sprintf("%s/%s", OFFERS_DIR, a.ID)
+
+	// the offers made up to the index advertised at are listed, the ones made since are
+	// watched. Both may see the same offer, claiming it twice is harmless.
+	r, err := a.advertise()
+	if err != nil {
+		return err
+	}
+	pending, err := a.store.List(key, true)
+	if err != nil && !store.IsKeyNotFound(err) {
+		return err
+	}
+	jobC := make(chan *store.Response, 1)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- a.store.Watch(key, r.Node.ModifiedIndex+1, true, jobC, stop)
+	}()
+	for _, n := range pending {
+		a.receiveOffer(a.runsCtx, n)
+	}
+
+	for {
+		r, ok := <-jobC
+		if !ok {
+			a.log("jobC has been closed")
+			break
+		}
+		if r.Action == store.ActionCreate {
+			a.receiveOffer(a.runsCtx, r.Node)
+		}
+	}
+	if err := <-watchErr; err != store.ErrWatchStoppedByUser {
+		return err
+	}
+	return nil
+}
+
+// watchForNewLeaderElectionT returns once a new leader has to be elected, or has been:
+// the election key expires, is deleted or holds the id of another agent than the one
+// holding it when the task started, or than leader if given. Renewals of the current
+// leader are ignored.
+func (a *Agent) watchForNewLeaderElectionT(leader string) *task.Task {
 	watchLeaderStopC := make(chan bool, 1)
 	t := task.New("watchLeaderElection", func() error {
-		a.etcdClient.Watch(SCHEDULER_ELECTION_KEY, 0, true, receiverC, watchLeaderStopC)
-		<-receiverC
-		return nil
+		for {
+			err := a.watchForNewLeaderElection(leader, watchLeaderStopC)
+			if store.ErrorCode(err) != store.ErrCodeIndexCleared {
+				return err
+			}
+			a.logf("Reading the leader again: %s", err.Error())
+		}
 	})
 
 	t.OnStopFn(func() {
@@ -193,6 +290,44 @@ func (a *Agent) watchForNewLeaderElectionT() *task.Task {
 	return t
 }
 
+func (a *Agent) watchForNewLeaderElection(leader string, stop chan bool) error {
+	n, err := a.store.Get(SCHEDULER_ELECTION_KEY, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			// no leader already
+			return nil
+		}
+		return err
+	}
+	holder := n.Value
+	if leader != "" && holder != leader {
+		// deposed already
+		return nil
+	}
+
+	receiverC := make(chan *store.Response, 1)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- a.store.Watch(SCHEDULER_ELECTION_KEY, n.ModifiedIndex+1, false, receiverC, stop)
+	}()
+	for r := range receiverC {
+		switch r.Action {
+		case store.ActionDelete, store.ActionExpire, store.ActionCompareAndDelete:
+		default:
+			if r.Node != nil && r.Node.Value == holder {
+				continue
+			}
+		}
+		stop <- true
+		for range receiverC {
+		}
+	}
+	if err := <-watchErr; err != store.ErrWatchStoppedByUser {
+		return err
+	}
+	return nil
+}
+
 func (a *Agent) log(message string) {
 	if a.verbose {
 		log.Printf("[%s] %s\n", a.ID, message)
@@ -222,6 +357,24 @@ func (a *Agent) registerTask(newTask *task.Task) {
 	a.taskManager = append(a.taskManager, newTask)
 }
 
+// stopStateTasks stops the tasks started by a state being left for another one, and
+// unregisters them
+func (a *Agent) stopStateTasks(tasks ...*task.Task) {
+	stopped := map[*task.Task]bool{}
+	for _, t := range tasks {
+		a.logf("Task: %s stopping...", t.Id)
+		t.Stop()
+		stopped[t] = true
+	}
+	running := []*task.Task{}
+	for _, t := range a.taskManager {
+		if !stopped[t] {
+			running = append(running, t)
+		}
+	}
+	a.taskManager = running
+}
+
 func (a *Agent) listenUICancelTask() *task.Task {
 	return a.taskManager[0]
 }
@@ -250,6 +403,9 @@ func (a *Agent) stopTasks() {
 
 	a.logf("Waiting for %d tasks to stop...", len(a.taskManager))
 	done.Wait()
+	// the runs being executed are left for the leader to re-offer once this agent is gone
+	a.cancelRuns()
+	a.runs.Wait()
 
 	a.taskManager = a.taskManager[:0]
 	a.logf("Sending signal to halt...")
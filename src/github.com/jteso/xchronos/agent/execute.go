@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jteso/xchronos/executor"
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
+)
+
+// receiveOffer claims the run offered and acknowledges the offer, executing the run
+// in the background
+func (a *Agent) receiveOffer(ctx context.Context, n *store.Node) {
+	if n == nil || n.Dir {
+		return
+	}
+	o, err := scheduler.DecodeOffer(n)
+	if err != nil {
+		a.logf("Ignoring job offer %s: %s", n.Key, err.Error())
+		return
+	}
+
+	r, err := run.Claim(a.store, o.RunID, a.ID, o.Attempt)
+	// the offer is done with either way
+	if _, err := a.store.Delete(n.Key, false); err != nil && !store.IsKeyNotFound(err) {
+		a.logf("Unable to acknowledge job offer %s: %s", n.Key, err.Error())
+	}
+	if err != nil {
+		a.logf("Job offer %s rejected: %s", o.RunID, err.Error())
+		return
+	}
+	a.logf("Job received: %s (run %s, attempt %d)", o.JobID, r.ID, r.Attempt)
+
+	slots := int64(r.TakenSlots())
+	atomic.AddInt64(&a.usage, slots)
+	a.runs.Add(1)
+	go func() {
+		defer a.runs.Done()
+		defer atomic.AddInt64(&a.usage, -slots)
+		a.execute(ctx, r)
+	}()
+}
+
+// execute runs a claimed run, recording its outcome. Runs cancelled are left as they
+// are, the leader re-offers them once this agent is gone.
+func (a *Agent) execute(ctx context.Context, r *run.Run) {
+	var exec executor.Executor
+	j, err := job.Get(a.store, r.JobID)
+	if err == nil {
+		exec, err = executor.Get(j.Executor.Type)
+	}
+	if err != nil {
+		a.record(r, r.Finish(run.RUN_FAILED, err, time.Now().UTC()))
+		return
+	}
+
+	if err := r.Transition(run.RUN_RUNNING, time.Now().UTC()); err != nil {
+		a.logf("Run %s: %s", r.ID, err.Error())
+		return
+	}
+	if err := run.Update(a.store, r); err != nil {
+		a.logf("Run %s not started: %s", r.ID, err.Error())
+		return
+	}
+
+	err = exec.Execute(ctx, j, r)
+	if ctx.Err() != nil {
+		a.logf("Run %s cancelled", r.ID)
+		return
+	}
+	now := time.Now().UTC()
+	switch err {
+	case nil:
+		a.record(r, r.Finish(run.RUN_SUCCEEDED, nil, now))
+	case executor.ErrTimedOut:
+		a.record(r, r.Fail(job.ERROR_CLASS_TIMED_OUT, err, &j.Retry, now))
+	default:
+		a.record(r, r.Fail(job.ERROR_CLASS_FAILED, err, &j.Retry, now))
+	}
+}
+
+// record stores the outcome of a run, unless it could not be worked out
+func (a *Agent) record(r *run.Run, err error) {
+	if err != nil {
+		a.logf("Run %s: %s", r.ID, err.Error())
+		return
+	}
+	if err := run.Update(a.store, r); err != nil {
+		// i.e. failed by the leader in the meantime
+		a.logf("Outcome of run %s not recorded: %s", r.ID, err.Error())
+		return
+	}
+	a.logf("Run %s %s", r.ID, r.Status)
+}
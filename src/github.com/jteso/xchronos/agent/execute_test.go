@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/executor"
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
+)
+
+// fakeExecutor returns the outcome set for each job, counting the runs
+type fakeExecutor struct {
+	outcomes map[string]error
+	runs     chan string
+}
+
+func (e *fakeExecutor) Execute(ctx context.Context, j *job.Job, r *run.Run) error {
+	e.runs <- r.ID
+	if j.ID == "slow" {
+		select {
+		case <-slow:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return e.outcomes[j.ID]
+}
+
+// runs of the job "slow" take until it is closed
+var slow chan struct{}
+
+var fake = &fakeExecutor{
+	outcomes: map[string]error{
+		"failing":  errors.New("exit status 1"),
+		"too_long": executor.ErrTimedOut,
+		"flaky":    errors.New("exit status 75"),
+	},
+	runs: make(chan string, 16),
+}
+
+// retry policies of the jobs offered
+var retries = map[string]job.RetryPolicy{
+	"flaky": {MaxAttempts: 2, TimeBetweenAttempts: time.Minute},
+}
+
+func init() {
+	executor.Register("fake", fake)
+}
+
+// offer creates a job and offers its run to the agent, returning the offer node
+func offer(t *testing.T, s store.JobStore, jobID string, executor string) *store.Node {
+	j := job.New(jobID)
+	j.Executor = job.ExecutorSpec{Type: "fake"}
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_SIMPLE}
+	j.Retry = retries[jobID]
+	if err := job.Create(s, j); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	r := run.New(jobID, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), executor)
+	run.Create(s, r)
+	o := scheduler.NewOffer(r)
+	scheduler.PublishOffer(s, o)
+	n, err := s.Get(scheduler.OfferKey(o.Executor, o.RunID), false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return n
+}
+
+func TestReceiveOffer(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	a := New("agent_1", s, false)
+
+	for jobID, expected := range map[string]string{
+		"report":   run.RUN_SUCCEEDED,
+		"failing":  run.RUN_FAILED,
+		"too_long": run.RUN_TIMED_OUT,
+		"flaky":    run.RUN_RETRYING,
+	} {
+		n := offer(t, s, jobID, a.ID)
+		a.receiveOffer(context.Background(), n)
+		a.runs.Wait()
+		<-fake.runs
+
+		if _, err := s.Get(n.Key, false); !store.IsKeyNotFound(err) {
+			t.Errorf("Expected offer of job [%s] to be acknowledged. Observed: %v", jobID, err)
+		}
+		r, _ := run.Get(s, store.Base(n.Key))
+		if r.Status != expected || r.StartedAt.IsZero() || (r.FinishedAt.IsZero() && r.RetryAt.IsZero()) {
+			t.Errorf("Expected run of job [%s] to be %s. Observed: %+v", jobID, expected, r)
+		}
+	}
+	if usage := a.metadata().Usage; usage != 0 {
+		t.Errorf("Expected [%d] capacity slots taken once runs finished. Observed [%d]", 0, usage)
+	}
+}
+
+func TestReceiveOfferOnce(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	a := New("agent_1", s, false)
+
+	n := offer(t, s, "report", a.ID)
+	a.receiveOffer(context.Background(), n)
+	a.receiveOffer(context.Background(), n)
+	a.runs.Wait()
+
+	if len(fake.runs) != 1 {
+		t.Errorf("Expected [%d] run. Observed [%d] runs", 1, len(fake.runs))
+	}
+	<-fake.runs
+
+	// offered to somebody else
+	n = offer(t, s, "backup", "agent_2")
+	a.receiveOffer(context.Background(), n)
+	a.runs.Wait()
+	if len(fake.runs) != 0 {
+		t.Errorf("Expected run offered to agent_2 not to be executed by agent_1")
+	}
+	if r, _ := run.Get(s, run.ID("backup", time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))); r.Status != run.RUN_OFFERED {
+		t.Errorf("Expected run to stay offered. Observed: %+v", r)
+	}
+}
+
+func TestExecuteAcrossLeaderChange(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	s.Set(SCHEDULER_ELECTION_KEY, "agent_2", SCHEDULER_LEADER_TTL)
+	a := New("agent_1", s, false)
+	slow = make(chan struct{})
+
+	next := make(chan handleStateFn, 1)
+	go func() {
+		next <- supporterStateFn(a)
+	}()
+	n := offer(t, s, "slow", a.ID)
+	<-fake.runs
+
+	// agent_2 is gone, the offers are not watched while electing a new leader
+	s.Delete(SCHEDULER_ELECTION_KEY, false)
+	if state := <-next; !sameStateFn(state, candidateStateFn) {
+		t.Fatalf("Expected agent_1 to run for leader")
+	}
+	close(slow)
+	a.runs.Wait()
+	if r, _ := run.Get(s, store.Base(n.Key)); r.Status != run.RUN_SUCCEEDED {
+		t.Errorf("Expected run to carry on across a leader change. Observed: %+v", r)
+	}
+}
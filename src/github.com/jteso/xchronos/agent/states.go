@@ -10,7 +10,6 @@ type handleStateFn func(*Agent) handleStateFn
 
 func startStateFn(agent *Agent) handleStateFn {
 	agent.changeState("STARTING_STATE")
-	agent.connectEtcdCluster()
 
 	return candidateStateFn
 }
@@ -35,27 +34,28 @@ func leaderStateFn(agent *Agent) handleStateFn {
 	agent.changeState("LEADER_STATE")
 
 	leaderTask := agent.advertiseAndRenewLeaderRoleT()
-	//TODO: agent.SetupScheduler()
-	jobPublisherTask := agent.publishJobOffersT()
+	schedulerTask := agent.runSchedulerT()
 
 	executorTask := agent.advertiseAndRenewExecutorRoleT()
 	jobExecutorTask := agent.watchForJobOffersT()
-	watchNewLeaderTask := agent.watchForNewLeaderElectionT()
-
-	for {
-		select {
-		case err := <-task.FirstError(
-			agent.listenUICancelTask(), //ErrUserCanceled
-			leaderTask,
-			jobPublisherTask,
-			executorTask,
-			jobExecutorTask):
-
-			agent.lastError = err
-			return errorStateFn
-		case <-watchNewLeaderTask.ErrorChan():
-			return candidateStateFn
-		}
+	watchNewLeaderTask := agent.watchForNewLeaderElectionT(agent.ID)
+
+	select {
+	case err := <-agent.listenUICancelTask().ErrorChan(): //ErrUserCanceled
+		agent.lastError = err
+		return errorStateFn
+	case err := <-task.FirstError(
+		leaderTask,
+		schedulerTask,
+		executorTask,
+		jobExecutorTask):
+
+		agent.lastError = err
+		return errorStateFn
+	case <-watchNewLeaderTask.ErrorChan():
+		// deposed, or a new leader has to be elected: nothing keeps scheduling
+		agent.stopStateTasks(schedulerTask, leaderTask, executorTask, jobExecutorTask, watchNewLeaderTask)
+		return candidateStateFn
 	}
 }
 
@@ -64,21 +64,21 @@ func supporterStateFn(agent *Agent) handleStateFn {
 
 	executorTask := agent.advertiseAndRenewExecutorRoleT()
 	jobExecutorTask := agent.watchForJobOffersT()
-	watchNewLeaderTask := agent.watchForNewLeaderElectionT()
+	watchNewLeaderTask := agent.watchForNewLeaderElectionT("")
 
-	for {
-		select {
-		case err := <-task.FirstError(
-			agent.listenUICancelTask(), //ErrUserCanceled
-			executorTask,
-			jobExecutorTask):
-
-			agent.lastError = err
-			return errorStateFn
-		case <-watchNewLeaderTask.ErrorChan():
-			return candidateStateFn
+	select {
+	case err := <-agent.listenUICancelTask().ErrorChan(): //ErrUserCanceled
+		agent.lastError = err
+		return errorStateFn
+	case err := <-task.FirstError(
+		executorTask,
+		jobExecutorTask):
 
-		}
+		agent.lastError = err
+		return errorStateFn
+	case <-watchNewLeaderTask.ErrorChan():
+		agent.stopStateTasks(executorTask, jobExecutorTask, watchNewLeaderTask)
+		return candidateStateFn
 	}
 }
 
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/store"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func sameStateFn(a, b handleStateFn) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+func TestCandidateState(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := store.NewMemoryStoreWithClock(clock.Now)
+	defer s.Close()
+
+	a1 := New("agent_1", s, false)
+	a2 := New("agent_2", s, false)
+
+	if next := candidateStateFn(a1); !sameStateFn(next, leaderStateFn) {
+		t.Errorf("Expected agent_1 to become leader")
+	}
+	if next := candidateStateFn(a2); !sameStateFn(next, supporterStateFn) {
+		t.Errorf("Expected agent_2 to become supporter")
+	}
+
+	// agent_1 stops renewing its leadership
+	clock.Advance(time.Duration(SCHEDULER_LEADER_TTL) * time.Second)
+	if next := candidateStateFn(a2); !sameStateFn(next, leaderStateFn) {
+		t.Errorf("Expected agent_2 to take over the leadership")
+	}
+	if n, _ := s.Get(SCHEDULER_ELECTION_KEY, false); n.Value != "agent_2" {
+		t.Errorf("Expected leader [%s]. Observed [%s]", "agent_2", n.Value)
+	}
+}
+
+func TestCandidateStateError(t *testing.T) {
+	s := store.NewMemoryStore()
+	s.Set(SCHEDULER_ELECTION_KEY+"/corrupted", "", 0)
+	defer s.Close()
+
+	a := New("agent_1", s, false)
+	if next := candidateStateFn(a); !sameStateFn(next, errorStateFn) {
+		t.Errorf("Expected agent_1 to fail running for leader")
+	}
+	if store.ErrorCode(a.lastError) != store.ErrCodeNotFile {
+		t.Errorf("Expected error code [%d]. Observed: %v", store.ErrCodeNotFile, a.lastError)
+	}
+}
+
+func TestWatchForNewLeaderElection(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	s.Set(SCHEDULER_ELECTION_KEY, "agent_1", SCHEDULER_LEADER_TTL)
+
+	for _, leader := range []string{"agent_1", ""} {
+		a := New("agent_2", s, false)
+		w := a.watchForNewLeaderElectionT(leader)
+		// renewals of the leader
+		s.Set(SCHEDULER_ELECTION_KEY, "agent_1", SCHEDULER_LEADER_TTL)
+		s.CompareAndSwap(SCHEDULER_ELECTION_KEY, "agent_1", SCHEDULER_LEADER_TTL, "agent_1", 0)
+		select {
+		case err := <-w.ErrorChan():
+			t.Fatalf("Expected renewals of the leader to be ignored. Observed: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		s.Delete(SCHEDULER_ELECTION_KEY, false)
+		select {
+		case err := <-w.ErrorChan():
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected the election key deleted to be noticed")
+		}
+		a.stopStateTasks(w)
+		if len(a.taskManager) != 1 {
+			t.Errorf("Expected [%d] tasks registered. Observed [%d]", 1, len(a.taskManager))
+		}
+		s.Set(SCHEDULER_ELECTION_KEY, "agent_1", SCHEDULER_LEADER_TTL)
+	}
+
+	// deposed before watching
+	a := New("agent_2", s, false)
+	w := a.watchForNewLeaderElectionT("agent_2")
+	select {
+	case <-w.ErrorChan():
+	case <-time.After(time.Second):
+		t.Errorf("Expected agent not holding the election key to be deposed")
+	}
+	a.stopStateTasks(w)
+}
@@ -0,0 +1,160 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+var (
+	// Shell running the command lines
+	COMMAND_SHELL = "/bin/sh"
+	// Bytes of stdout and stderr kept, the last ones
+	COMMAND_OUTPUT_LIMIT = 64 << 10
+	// Time a command has to exit after being asked to (SIGTERM), before it is killed. Also
+	// the time the processes it leaves behind may hold its output once it exits
+	COMMAND_KILL_GRACE_PERIOD = 10 * time.Second
+)
+
+func init() {
+	Register(job.EXECUTOR_COMMAND, Command{})
+}
+
+// Command runs the command line of a job in its own process group, so the processes it
+// starts are terminated along with it
+type Command struct{}
+
+func (c Command) Execute(ctx context.Context, j *job.Job, r *run.Run) error {
+	spec := j.Executor
+	cmd := exec.Command(COMMAND_SHELL, "-c", spec.Command)
+	cmd.Dir = spec.Dir
+	cmd.Env = append(os.Environ(), jobEnv(j, r)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if spec.User != "" {
+		cred, err := credential(spec.User)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+	stdout, stderr := NewRingBuffer(COMMAND_OUTPUT_LIMIT), NewRingBuffer(COMMAND_OUTPUT_LIMIT)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.WaitDelay = COMMAND_KILL_GRACE_PERIOD
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if spec.Timeout > 0 {
+		timer := time.NewTimer(spec.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-timeout:
+		timedOut = true
+		err = terminate(cmd, done)
+	case <-ctx.Done():
+		err = terminate(cmd, done)
+	}
+
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// exited, the processes left behind holding its output
+		err = nil
+	}
+
+	r.Duration = time.Since(start)
+	r.Stdout, r.Stderr = stdout.String(), stderr.String()
+	r.ExitCode = exitCode(cmd.ProcessState)
+	switch {
+	case timedOut:
+		return ErrTimedOut
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+	return err
+}
+
+// jobEnv returns the environment of a run of a job
+func jobEnv(j *job.Job, r *run.Run) []string {
+	env := append([]string{},
+		"XCHRONOS_JOB_ID="+j.ID,
+		"XCHRONOS_RUN_ID="+r.ID,
+		"XCHRONOS_ATTEMPT="+strconv.Itoa(r.Attempt),
+	)
+	names := []string{}
+	for name := range j.Executor.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+j.Executor.Env[name])
+	}
+	return env
+}
+
+// credential returns the credential of a user, given by name or uid
+func credential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("Unknown user [%s]", name)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// terminate asks the process group of a command to exit, killing it after
+// COMMAND_KILL_GRACE_PERIOD
+func terminate(cmd *exec.Cmd, done chan error) error {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	timer := time.NewTimer(COMMAND_KILL_GRACE_PERIOD)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		// the rest of the group may be ignoring it
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return err
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return <-done
+	}
+}
+
+// exitCode returns the exit code of a process, 128 + the signal number if it was killed
+func exitCode(ps *os.ProcessState) int {
+	if ps == nil {
+		return 0
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
@@ -0,0 +1,149 @@
+package executor_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/executor"
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+func newCommandJob(command string) *job.Job {
+	j := job.New("report")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_COMMAND, Command: command}
+	return j
+}
+
+func execute(t *testing.T, j *job.Job) (*run.Run, error) {
+	e, err := executor.Get(j.Executor.Type)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	r := run.New(j.ID, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), "agent_1")
+	return r, e.Execute(context.Background(), j, r)
+}
+
+func TestCommand(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "xchronos")
+	defer os.RemoveAll(dir)
+	j := newCommandJob(`echo "$GREETING from $(pwd), run $XCHRONOS_RUN_ID"; echo oops >&2`)
+	j.Executor.Env = map[string]string{"GREETING": "hello"}
+	j.Executor.Dir = dir
+
+	r, err := execute(t, j)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if expected := "hello from " + dir + ", run " + r.ID + "\n"; r.Stdout != expected {
+		t.Errorf("Expected stdout [%s]. Observed [%s]", expected, r.Stdout)
+	}
+	if r.Stderr != "oops\n" || r.ExitCode != 0 || r.Duration <= 0 {
+		t.Errorf("Expected stderr, exit code and duration to be recorded. Observed: %+v", r)
+	}
+}
+
+func TestCommandFailed(t *testing.T) {
+	r, err := execute(t, newCommandJob("echo failing >&2; exit 3"))
+	if err == nil || err.Error() != "exit status 3" {
+		t.Errorf("Expected [%s]. Observed: %v", "exit status 3", err)
+	}
+	if r.ExitCode != 3 || r.Stderr != "failing\n" {
+		t.Errorf("Expected exit code [%d]. Observed: %+v", 3, r)
+	}
+
+	j := newCommandJob("true")
+	j.Executor.Dir = "/nonexistent"
+	if _, err := execute(t, j); err == nil {
+		t.Errorf("Expected command not to start in a missing directory")
+	}
+}
+
+func TestCommandOutputLimit(t *testing.T) {
+	defer func(limit int) { executor.COMMAND_OUTPUT_LIMIT = limit }(executor.COMMAND_OUTPUT_LIMIT)
+	executor.COMMAND_OUTPUT_LIMIT = 4
+
+	r, _ := execute(t, newCommandJob("printf 0123456789"))
+	if r.Stdout != "6789" {
+		t.Errorf("Expected last [%d] bytes of output. Observed [%s]", 4, r.Stdout)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	defer func(grace time.Duration) { executor.COMMAND_KILL_GRACE_PERIOD = grace }(executor.COMMAND_KILL_GRACE_PERIOD)
+	executor.COMMAND_KILL_GRACE_PERIOD = 200 * time.Millisecond
+
+	cases := map[string]int{
+		// exits on SIGTERM
+		"echo started; sleep 10": 128 + 15,
+		// ignores it, along with the process it started
+		"trap '' TERM; echo started; sleep 10 & wait; sleep 10": 128 + 9,
+	}
+	for command, expected := range cases {
+		j := newCommandJob(command)
+		j.Executor.Timeout = 100 * time.Millisecond
+
+		start := time.Now()
+		r, err := execute(t, j)
+		if err != executor.ErrTimedOut {
+			t.Errorf("Expected [%v]. Observed: %v", executor.ErrTimedOut, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected process group to be terminated. Observed [%s] running", elapsed)
+		}
+		if r.ExitCode != expected || r.Stdout != "started\n" {
+			t.Errorf("Expected exit code [%d] for %q. Observed: %+v", expected, command, r)
+		}
+	}
+}
+
+func TestCommandLeavingProcessesBehind(t *testing.T) {
+	defer func(grace time.Duration) { executor.COMMAND_KILL_GRACE_PERIOD = grace }(executor.COMMAND_KILL_GRACE_PERIOD)
+	executor.COMMAND_KILL_GRACE_PERIOD = 200 * time.Millisecond
+
+	start := time.Now()
+	r, err := execute(t, newCommandJob("sleep 3 & echo started"))
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected run to finish along with the command. Observed [%s] running", elapsed)
+	}
+	if r.ExitCode != 0 || r.Stdout != "started\n" {
+		t.Errorf("Expected exit code [%d]. Observed: %+v", 0, r)
+	}
+}
+
+func TestCommandCancelled(t *testing.T) {
+	e, _ := executor.Get(job.EXECUTOR_COMMAND)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	r := run.New("report", time.Now(), "agent_1")
+	if err := e.Execute(ctx, newCommandJob("sleep 10"), r); err != context.Canceled {
+		t.Errorf("Expected [%v]. Observed: %v", context.Canceled, err)
+	}
+}
+
+func TestCommandUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can run commands as another user")
+	}
+	j := newCommandJob("id -u")
+	j.Executor.User = "nobody"
+	r, err := execute(t, j)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if strings.TrimSpace(r.Stdout) == "0" {
+		t.Errorf("Expected command to run as [%s]. Observed uid [%s]", "nobody", r.Stdout)
+	}
+
+	j.Executor.User = "nobody-at-all"
+	if _, err := execute(t, j); err == nil {
+		t.Errorf("Expected unknown user to be rejected")
+	}
+}
@@ -0,0 +1,328 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+// Docker Engine the docker jobs are run by, unless DOCKER_HOST is set
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+var (
+	// Version of the Docker Engine API spoken
+	DOCKER_API_VERSION = "1.41"
+)
+
+func init() {
+	Register(job.EXECUTOR_DOCKER, NewDocker(""))
+}
+
+// Docker runs the jobs in containers, talking to the Docker Engine API: it pulls the
+// image, creates and starts the container, follows its logs until it exits, and
+// removes it.
+type Docker struct {
+	// engine talked to, the one set by DOCKER_HOST if empty
+	host string
+	// set up on the first run, see connect
+	once   sync.Once
+	client *http.Client
+	// base url of the API, i.e. http://127.0.0.1:2375/v1.41
+	url string
+}
+
+// NewDocker returns an executor talking to the Docker Engine at host, i.e.
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2375. If host is empty, the one set
+// by DOCKER_HOST when the first job runs is used, the local engine by default.
+func NewDocker(host string) *Docker {
+	return &Docker{host: host}
+}
+
+// connect sets up the client of the engine, once
+func (d *Docker) connect() {
+	d.once.Do(func() {
+		host := d.host
+		if host == "" {
+			host = os.Getenv("DOCKER_HOST")
+		}
+		if host == "" {
+			host = defaultDockerHost
+		}
+		d.client, d.url = dockerClient(host)
+	})
+}
+
+func dockerClient(host string) (*http.Client, string) {
+	transport := &http.Transport{}
+	base := host
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		base = "http://docker"
+	case strings.HasPrefix(host, "tcp://"):
+		base = "http://" + strings.TrimPrefix(host, "tcp://")
+	}
+	return &http.Client{Transport: transport}, strings.TrimSuffix(base, "/") + "/v" + DOCKER_API_VERSION
+}
+
+// containerConfig is the body of a container creation
+type containerConfig struct {
+	Image      string
+	Cmd        []string          `json:",omitempty"`
+	Env        []string          `json:",omitempty"`
+	WorkingDir string            `json:",omitempty"`
+	User       string            `json:",omitempty"`
+	Labels     map[string]string `json:",omitempty"`
+	HostConfig hostConfig
+}
+
+type hostConfig struct {
+	Mounts   []mount `json:",omitempty"`
+	Memory   int64   `json:",omitempty"`
+	NanoCpus int64   `json:",omitempty"`
+}
+
+type mount struct {
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+func (d *Docker) Execute(ctx context.Context, j *job.Job, r *run.Run) error {
+	d.connect()
+	spec := j.Executor
+	if err := d.pull(ctx, spec.Image); err != nil {
+		return err
+	}
+	id, err := d.create(ctx, containerName(r), d.config(j, r))
+	if err != nil {
+		return err
+	}
+	defer d.remove(id)
+
+	start := time.Now()
+	if err := d.do(ctx, "POST", "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return err
+	}
+	stdout, stderr := NewRingBuffer(COMMAND_OUTPUT_LIMIT), NewRingBuffer(COMMAND_OUTPUT_LIMIT)
+	logsCtx, cancelLogs := context.WithCancel(context.Background())
+	defer cancelLogs()
+	logsDone := make(chan error, 1)
+	go func() {
+		logsDone <- d.logs(logsCtx, id, stdout, stderr)
+	}()
+
+	waitCtx, cancel := ctx, func() {}
+	if spec.Timeout > 0 {
+		waitCtx, cancel = context.WithTimeout(ctx, spec.Timeout)
+	}
+	code, err := d.wait(waitCtx, id)
+	cancel()
+	stopped := waitCtx.Err() != nil
+	if stopped {
+		// SIGTERM, then SIGKILL after the grace period
+		d.do(context.Background(), "POST", "/containers/"+id+"/stop",
+			url.Values{"t": {strconv.Itoa(int(COMMAND_KILL_GRACE_PERIOD / time.Second))}}, nil, nil)
+		code, err = d.wait(context.Background(), id)
+	}
+	r.Duration = time.Since(start)
+	// the output may be held a bit longer, as commands do (see Command)
+	grace := time.NewTimer(COMMAND_KILL_GRACE_PERIOD)
+	select {
+	case <-logsDone:
+	case <-grace.C:
+		cancelLogs()
+		<-logsDone
+	case <-ctx.Done():
+		cancelLogs()
+		<-logsDone
+	}
+	grace.Stop()
+	r.Stdout, r.Stderr = stdout.String(), stderr.String()
+	if err != nil {
+		return err
+	}
+
+	r.ExitCode = code
+	switch {
+	case stopped && ctx.Err() != nil:
+		return ctx.Err()
+	case stopped:
+		return ErrTimedOut
+	case code != 0:
+		return fmt.Errorf("exit status %d", code)
+	}
+	return nil
+}
+
+func containerName(r *run.Run) string {
+	return fmt.Sprintf("xchronos-%s-%d", r.ID, r.Attempt)
+}
+
+func (d *Docker) config(j *job.Job, r *run.Run) *containerConfig {
+	spec := j.Executor
+	c := &containerConfig{
+		Image:      spec.Image,
+		Cmd:        spec.Args,
+		WorkingDir: spec.Dir,
+		User:       spec.User,
+		Labels: map[string]string{
+			"xchronos.job": j.ID,
+			"xchronos.run": r.ID,
+		},
+		HostConfig: hostConfig{
+			Memory:   spec.Memory,
+			NanoCpus: int64(spec.CPUs * 1e9),
+		},
+	}
+	for name, value := range j.Labels {
+		c.Labels[name] = value
+	}
+	// the environment of the agent stays out of the container
+	c.Env = jobEnv(j, r)
+	for _, m := range spec.Mounts {
+		c.HostConfig.Mounts = append(c.HostConfig.Mounts, mount{Type: "bind", Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly})
+	}
+	return c
+}
+
+// pull pulls an image, failing if any of the progress messages streamed reports an error
+func (d *Docker) pull(ctx context.Context, image string) error {
+	name, tag := image, "latest"
+	if i := strings.Index(image, "@"); i >= 0 {
+		// by digest
+		name, tag = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		name, tag = image[:i], image[i+1:]
+	}
+
+	var progress struct {
+		Error string `json:"error"`
+	}
+	return d.do(ctx, "POST", "/images/create", url.Values{"fromImage": {name}, "tag": {tag}}, nil, func(body io.Reader) error {
+		for dec := json.NewDecoder(body); ; {
+			if err := dec.Decode(&progress); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if progress.Error != "" {
+				return fmt.Errorf("Unable to pull %s: %s", image, progress.Error)
+			}
+		}
+	})
+}
+
+func (d *Docker) create(ctx context.Context, name string, c *containerConfig) (string, error) {
+	var created struct {
+		Id string
+	}
+	err := d.do(ctx, "POST", "/containers/create", url.Values{"name": {name}}, c, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&created)
+	})
+	return created.Id, err
+}
+
+// wait waits for a container to exit, returning its exit code
+func (d *Docker) wait(ctx context.Context, id string) (int, error) {
+	var exited struct {
+		StatusCode int
+		Error      *struct {
+			Message string
+		}
+	}
+	err := d.do(ctx, "POST", "/containers/"+id+"/wait", nil, nil, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&exited)
+	})
+	if err == nil && exited.Error != nil && exited.Error.Message != "" {
+		err = fmt.Errorf("Container %s: %s", id, exited.Error.Message)
+	}
+	return exited.StatusCode, err
+}
+
+// logs follows the output of a container until it exits. It is multiplexed as frames
+// of an 8 bytes header (stream, 0, 0, 0, size) followed by the data.
+func (d *Docker) logs(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+	query := url.Values{"follow": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+	return d.do(ctx, "GET", "/containers/"+id+"/logs", query, nil, func(body io.Reader) error {
+		header := make([]byte, 8)
+		for reader := bufio.NewReader(body); ; {
+			if _, err := io.ReadFull(reader, header); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			w := stdout
+			if header[0] == 2 {
+				w = stderr
+			}
+			if _, err := io.CopyN(w, reader, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (d *Docker) remove(id string) error {
+	return d.do(context.Background(), "DELETE", "/containers/"+id, url.Values{"force": {"1"}, "v": {"1"}}, nil, nil)
+}
+
+// do sends a request to the API, handing the body of a successful response over to
+// read, if any
+func (d *Docker) do(ctx context.Context, method string, path string, query url.Values, in interface{}, read func(io.Reader) error) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := d.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		var failure struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("Docker %s %s: %s (%d)", method, path, failure.Message, resp.StatusCode)
+	}
+	if read != nil {
+		return read(resp.Body)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package executor_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/executor"
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+// fakeEngine stands in for the Docker Engine API endpoints used by the docker executor
+type fakeEngine struct {
+	mu sync.Mutex
+	// fromImage:tag of the images pulled
+	pulled []string
+	// error reported while pulling
+	pullError string
+	// name and config of the container created
+	name   string
+	config map[string]interface{}
+	// the container runs until stopped, otherwise it exits right away
+	blocks bool
+	// the logs are followed past the exit of the container
+	holdsLogs bool
+	// engine the fake listens at
+	host     string
+	exited   chan struct{}
+	exitCode int
+	stdout   string
+	stderr   string
+	calls    []string
+}
+
+func newFakeEngine(t *testing.T) (*fakeEngine, *executor.Docker) {
+	e := &fakeEngine{exited: make(chan struct{})}
+	prefix := "/v" + executor.DOCKER_API_VERSION
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"/images/create", func(w http.ResponseWriter, req *http.Request) {
+		e.record("pull")
+		e.mu.Lock()
+		e.pulled = append(e.pulled, req.URL.Query().Get("fromImage")+":"+req.URL.Query().Get("tag"))
+		e.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"status": "Pulling fs layer"})
+		if e.pullError != "" {
+			json.NewEncoder(w).Encode(map[string]string{"error": e.pullError})
+		}
+	})
+	mux.HandleFunc(prefix+"/containers/create", func(w http.ResponseWriter, req *http.Request) {
+		e.record("create")
+		e.mu.Lock()
+		e.name = req.URL.Query().Get("name")
+		json.NewDecoder(req.Body).Decode(&e.config)
+		e.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": "c0ffee"})
+	})
+	mux.HandleFunc(prefix+"/containers/c0ffee/start", func(w http.ResponseWriter, req *http.Request) {
+		e.record("start")
+		if !e.blocks {
+			e.exit(e.exitCode)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(prefix+"/containers/c0ffee/logs", func(w http.ResponseWriter, req *http.Request) {
+		for stream, data := range map[byte]string{1: e.stdout, 2: e.stderr} {
+			header := make([]byte, 8)
+			header[0] = stream
+			binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+			w.Write(append(header, data...))
+		}
+		w.(http.Flusher).Flush()
+		<-e.exited
+		if e.holdsLogs {
+			<-req.Context().Done()
+		}
+	})
+	mux.HandleFunc(prefix+"/containers/c0ffee/wait", func(w http.ResponseWriter, req *http.Request) {
+		e.record("wait")
+		select {
+		case <-e.exited:
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]int{"StatusCode": e.exitCode})
+		case <-req.Context().Done():
+		}
+	})
+	mux.HandleFunc(prefix+"/containers/c0ffee/stop", func(w http.ResponseWriter, req *http.Request) {
+		e.record("stop?t=" + req.URL.Query().Get("t"))
+		e.exit(128 + 15)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(prefix+"/containers/c0ffee", func(w http.ResponseWriter, req *http.Request) {
+		e.record("remove")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	dir, _ := os.MkdirTemp("", "xchronos")
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = l
+	server.Start()
+	t.Cleanup(func() {
+		e.exit(0)
+		server.Close()
+		os.RemoveAll(dir)
+	})
+	e.host = "unix://" + socket
+	return e, executor.NewDocker(e.host)
+}
+
+func (e *fakeEngine) record(call string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls = append(e.calls, call)
+}
+
+func (e *fakeEngine) exit(code int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.exited:
+	default:
+		e.exitCode = code
+		close(e.exited)
+	}
+}
+
+func newDockerJob() *job.Job {
+	j := job.New("apache")
+	j.Executor = job.ExecutorSpec{
+		Type:   job.EXECUTOR_DOCKER,
+		Image:  "coreos/apache:2.4",
+		Args:   []string{"/usr/sbin/apache2ctl", "-D", "FOREGROUND"},
+		Env:    map[string]string{"GREETING": "hello"},
+		Mounts: []job.Mount{{Source: "/srv/www", Target: "/var/www", ReadOnly: true}},
+		Memory: 64 << 20,
+		CPUs:   0.5,
+	}
+	j.Labels = map[string]string{"team": "web"}
+	return j
+}
+
+func TestDocker(t *testing.T) {
+	engine, d := newFakeEngine(t)
+	engine.stdout, engine.stderr = "serving\n", "warning\n"
+
+	r := run.New("apache", time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), "agent_1")
+	if err := d.Execute(context.Background(), newDockerJob(), r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if expected := []string{"coreos/apache:2.4"}; !reflect.DeepEqual(engine.pulled, expected) {
+		t.Errorf("Expected %v to be pulled. Observed %v", expected, engine.pulled)
+	}
+	if expected := []string{"pull", "create", "start", "wait", "remove"}; !reflect.DeepEqual(engine.calls, expected) {
+		t.Errorf("Expected calls %v. Observed %v", expected, engine.calls)
+	}
+	if expected := "xchronos-" + r.ID + "-1"; engine.name != expected {
+		t.Errorf("Expected container [%s]. Observed [%s]", expected, engine.name)
+	}
+
+	var config struct {
+		Image      string
+		Cmd        []string
+		Env        []string
+		Labels     map[string]string
+		HostConfig struct {
+			Mounts   []map[string]interface{}
+			Memory   int64
+			NanoCpus int64
+		}
+	}
+	b, _ := json.Marshal(engine.config)
+	json.Unmarshal(b, &config)
+	if config.Image != "coreos/apache:2.4" || len(config.Cmd) != 3 {
+		t.Errorf("Expected image and command to be set. Observed: %+v", config)
+	}
+	if expected := []string{"XCHRONOS_JOB_ID=apache", "XCHRONOS_RUN_ID=" + r.ID, "XCHRONOS_ATTEMPT=1", "GREETING=hello"}; !reflect.DeepEqual(config.Env, expected) {
+		t.Errorf("Expected env %v. Observed %v", expected, config.Env)
+	}
+	if config.Labels["team"] != "web" || config.Labels["xchronos.run"] != r.ID {
+		t.Errorf("Expected container to be labelled. Observed %v", config.Labels)
+	}
+	if len(config.HostConfig.Mounts) != 1 || config.HostConfig.Mounts[0]["Target"] != "/var/www" || config.HostConfig.Mounts[0]["ReadOnly"] != true {
+		t.Errorf("Expected /srv/www to be mounted. Observed %v", config.HostConfig.Mounts)
+	}
+	if config.HostConfig.Memory != 64<<20 || config.HostConfig.NanoCpus != 5e8 {
+		t.Errorf("Expected resources to be limited. Observed: %+v", config.HostConfig)
+	}
+
+	if r.Stdout != "serving\n" || r.Stderr != "warning\n" || r.ExitCode != 0 {
+		t.Errorf("Expected output to be captured. Observed: %+v", r)
+	}
+}
+
+func TestDockerFailed(t *testing.T) {
+	engine, d := newFakeEngine(t)
+	engine.exitCode = 2
+
+	r := run.New("apache", time.Now(), "agent_1")
+	if err := d.Execute(context.Background(), newDockerJob(), r); err == nil || err.Error() != "exit status 2" {
+		t.Errorf("Expected [%s]. Observed: %v", "exit status 2", err)
+	}
+	if r.ExitCode != 2 || engine.calls[len(engine.calls)-1] != "remove" {
+		t.Errorf("Expected exit code [%d] and container removed. Observed: %+v %v", 2, r, engine.calls)
+	}
+}
+
+func TestDockerPullFailed(t *testing.T) {
+	engine, d := newFakeEngine(t)
+	engine.pullError = "manifest unknown"
+
+	err := d.Execute(context.Background(), newDockerJob(), run.New("apache", time.Now(), "agent_1"))
+	if err == nil {
+		t.Fatalf("Expected pull to fail")
+	}
+	if expected := []string{"pull"}; !reflect.DeepEqual(engine.calls, expected) {
+		t.Errorf("Expected calls %v. Observed %v", expected, engine.calls)
+	}
+}
+
+func TestDockerTimeout(t *testing.T) {
+	defer func(grace time.Duration) { executor.COMMAND_KILL_GRACE_PERIOD = grace }(executor.COMMAND_KILL_GRACE_PERIOD)
+	executor.COMMAND_KILL_GRACE_PERIOD = 5 * time.Second
+	engine, d := newFakeEngine(t)
+	engine.blocks = true
+	j := newDockerJob()
+	j.Executor.Timeout = 100 * time.Millisecond
+
+	r := run.New("apache", time.Now(), "agent_1")
+	if err := d.Execute(context.Background(), j, r); err != executor.ErrTimedOut {
+		t.Errorf("Expected [%v]. Observed: %v", executor.ErrTimedOut, err)
+	}
+	if expected := []string{"pull", "create", "start", "wait", "stop?t=5", "wait", "remove"}; !reflect.DeepEqual(engine.calls, expected) {
+		t.Errorf("Expected calls %v. Observed %v", expected, engine.calls)
+	}
+	if r.ExitCode != 128+15 {
+		t.Errorf("Expected exit code [%d]. Observed [%d]", 128+15, r.ExitCode)
+	}
+}
+
+func TestDockerHostFromEnvironment(t *testing.T) {
+	engine, _ := newFakeEngine(t)
+	t.Setenv("DOCKER_HOST", engine.host)
+
+	// read as the first job runs
+	d := executor.NewDocker("")
+	if err := d.Execute(context.Background(), newDockerJob(), run.New("apache", time.Now(), "agent_1")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(engine.pulled) != 1 {
+		t.Errorf("Expected engine at [%s] to run the job. Observed calls %v", engine.host, engine.calls)
+	}
+}
+
+func TestDockerLogsHeld(t *testing.T) {
+	defer func(grace time.Duration) { executor.COMMAND_KILL_GRACE_PERIOD = grace }(executor.COMMAND_KILL_GRACE_PERIOD)
+	executor.COMMAND_KILL_GRACE_PERIOD = 200 * time.Millisecond
+	engine, d := newFakeEngine(t)
+	engine.holdsLogs = true
+	engine.stdout = "started\n"
+
+	start := time.Now()
+	r := run.New("apache", time.Now(), "agent_1")
+	if err := d.Execute(context.Background(), newDockerJob(), r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected run to finish along with the container. Observed [%s] running", elapsed)
+	}
+	if r.Stdout != "started\n" {
+		t.Errorf("Expected stdout [%s]. Observed [%s]", "started\n", r.Stdout)
+	}
+
+	// cancelled runs do not wait for the output
+	executor.COMMAND_KILL_GRACE_PERIOD = time.Minute
+	engine, d = newFakeEngine(t)
+	engine.blocks = true
+	engine.holdsLogs = true
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start = time.Now()
+	if err := d.Execute(ctx, newDockerJob(), run.New("apache", time.Now(), "agent_1")); err != context.Canceled {
+		t.Errorf("Expected [%v]. Observed: %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected cancelled run to finish. Observed [%s] running", elapsed)
+	}
+}
@@ -0,0 +1,69 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+var (
+	// Returned by executors when a run takes longer than allowed
+	ErrTimedOut = errors.New("Run timed out")
+
+	executorsMu sync.RWMutex
+	executors   = map[string]Executor{}
+)
+
+func init() {
+	job.ExecutorTypes = Registered
+}
+
+// Executor runs the jobs of a given type (see job.ExecutorSpec)
+type Executor interface {
+	// Execute runs a job, recording its outcome in the run (i.e. exit code). It returns
+	// an error if the run failed, ErrTimedOut if it took too long, and should give up as
+	// soon as ctx is done.
+	Execute(ctx context.Context, j *job.Job, r *run.Run) error
+}
+
+// Register makes an executor available to the jobs of the given type. It panics if
+// the type is already taken.
+func Register(jobType string, e Executor) {
+	executorsMu.Lock()
+	defer executorsMu.Unlock()
+	if e == nil {
+		panic("executor: Register executor is nil")
+	}
+	if _, found := executors[jobType]; found {
+		panic("executor: Register called twice for " + jobType)
+	}
+	executors[jobType] = e
+}
+
+// Get returns the executor of the jobs of the given type
+func Get(jobType string) (Executor, error) {
+	executorsMu.RLock()
+	defer executorsMu.RUnlock()
+	e, found := executors[jobType]
+	if !found {
+		return nil, fmt.Errorf("No executor for jobs of type [%s]", jobType)
+	}
+	return e, nil
+}
+
+// Registered returns the job types there is an executor for, sorted
+func Registered() []string {
+	executorsMu.RLock()
+	defer executorsMu.RUnlock()
+	types := []string{}
+	for t := range executors {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
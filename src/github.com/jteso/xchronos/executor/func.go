@@ -0,0 +1,117 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+// Handler runs a job within the application embedding the agent, given the payload of
+// the job. It should give up as soon as ctx is done, see RunFromContext for the run.
+type Handler func(ctx context.Context, payload []byte) error
+
+type runKey struct{}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]Handler{}
+)
+
+func init() {
+	Register(job.EXECUTOR_FUNC, Func{})
+}
+
+// Handle makes a function available to the jobs under the given name. It is meant to be
+// called from the init function of the application embedding the agent, and panics if
+// the name is already taken.
+func Handle(name string, h Handler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if h == nil {
+		panic("executor: Handle handler is nil")
+	}
+	if _, found := handlers[name]; found {
+		panic("executor: Handle called twice for " + name)
+	}
+	handlers[name] = h
+}
+
+// Handlers returns the names of the registered functions, sorted
+func Handlers() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	names := []string{}
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RunFromContext returns the run a handler has been called for
+func RunFromContext(ctx context.Context) (*run.Run, bool) {
+	r, ok := ctx.Value(runKey{}).(*run.Run)
+	return r, ok
+}
+
+// Func calls the function registered for a job. A panicking function fails the run,
+// its stack trace recorded as stderr. Functions not giving up when timed out or
+// cancelled are left running.
+type Func struct{}
+
+func (f Func) Execute(ctx context.Context, j *job.Job, r *run.Run) error {
+	spec := j.Executor
+	handlersMu.RLock()
+	h, found := handlers[spec.Handler]
+	handlersMu.RUnlock()
+	if !found {
+		return fmt.Errorf("Unknown handler [%s], registered: %v", spec.Handler, Handlers())
+	}
+
+	callCtx, cancel := ctx, func() {}
+	if spec.Timeout > 0 {
+		callCtx, cancel = context.WithTimeout(ctx, spec.Timeout)
+	}
+	defer cancel()
+	// the run is not touched by the handler, so it can be updated once timed out
+	callCtx = context.WithValue(callCtx, runKey{}, copyRun(r))
+
+	start := time.Now()
+	done := make(chan error, 1)
+	var stack []byte
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				stack = debug.Stack()
+				done <- fmt.Errorf("Handler %s panicked: %v", spec.Handler, p)
+			}
+		}()
+		done <- h(callCtx, spec.Payload)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+		r.Stderr = string(stack)
+	case <-callCtx.Done():
+	}
+	r.Duration = time.Since(start)
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case callCtx.Err() == context.DeadlineExceeded:
+		return ErrTimedOut
+	}
+	return err
+}
+
+func copyRun(r *run.Run) *run.Run {
+	c := *r
+	return &c
+}
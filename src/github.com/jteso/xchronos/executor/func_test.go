@@ -0,0 +1,79 @@
+package executor_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/executor"
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+func init() {
+	executor.Handle("echo", func(ctx context.Context, payload []byte) error {
+		r, _ := executor.RunFromContext(ctx)
+		if string(payload) != r.JobID {
+			return errors.New("Unexpected payload " + string(payload))
+		}
+		return nil
+	})
+	executor.Handle("panic", func(ctx context.Context, payload []byte) error {
+		panic("out of coffee")
+	})
+	executor.Handle("sleep", func(ctx context.Context, payload []byte) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+}
+
+func newFuncJob(handler, payload string) *job.Job {
+	j := job.New("report")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_FUNC, Handler: handler, Payload: []byte(payload)}
+	return j
+}
+
+func TestFunc(t *testing.T) {
+	r := run.New("report", time.Now(), "agent_1")
+	if err := (executor.Func{}).Execute(context.Background(), newFuncJob("echo", "report"), r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := (executor.Func{}).Execute(context.Background(), newFuncJob("echo", "invoice"), r); err == nil || err.Error() != "Unexpected payload invoice" {
+		t.Errorf("Expected [%s]. Observed: %v", "Unexpected payload invoice", err)
+	}
+	if names := executor.Handlers(); len(names) < 3 || names[0] != "echo" {
+		t.Errorf("Expected handlers to be registered. Observed %v", names)
+	}
+}
+
+func TestFuncPanicked(t *testing.T) {
+	r := run.New("report", time.Now(), "agent_1")
+	err := (executor.Func{}).Execute(context.Background(), newFuncJob("panic", ""), r)
+	if err == nil || err.Error() != "Handler panic panicked: out of coffee" {
+		t.Errorf("Expected [%s]. Observed: %v", "Handler panic panicked: out of coffee", err)
+	}
+	if !strings.Contains(r.Stderr, "func_test.go") {
+		t.Errorf("Expected stack trace to be recorded. Observed [%s]", r.Stderr)
+	}
+}
+
+func TestFuncTimeout(t *testing.T) {
+	j := newFuncJob("sleep", "")
+	j.Executor.Timeout = 50 * time.Millisecond
+	r := run.New("report", time.Now(), "agent_1")
+	if err := (executor.Func{}).Execute(context.Background(), j, r); err != executor.ErrTimedOut {
+		t.Errorf("Expected [%v]. Observed: %v", executor.ErrTimedOut, err)
+	}
+	if r.Duration < j.Executor.Timeout {
+		t.Errorf("Expected duration of at least [%s]. Observed [%s]", j.Executor.Timeout, r.Duration)
+	}
+}
+
+func TestFuncUnknownHandler(t *testing.T) {
+	r := run.New("report", time.Now(), "agent_1")
+	if err := (executor.Func{}).Execute(context.Background(), newFuncJob("missing", ""), r); err == nil {
+		t.Errorf("Expected unknown handler to fail the run")
+	}
+}
@@ -0,0 +1,133 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+var (
+	// Bytes of the response body read, and recorded with the run
+	HTTP_BODY_LIMIT = 64 << 10
+)
+
+func init() {
+	Register(job.EXECUTOR_HTTP, HTTP{})
+}
+
+// HTTP calls the endpoint of a job, recording the response with the run. Runs fail
+// unless the response status is one of the successful ones, and its body matches.
+type HTTP struct{}
+
+// bodyData is given to the body template of the jobs
+type bodyData struct {
+	Job *job.Job
+	Run *run.Run
+	Env map[string]string
+}
+
+func (h HTTP) Execute(ctx context.Context, j *job.Job, r *run.Run) error {
+	spec := j.Executor
+	client, err := httpClient(spec.TLS)
+	if err != nil {
+		return err
+	}
+	defer client.CloseIdleConnections()
+	var body bytes.Buffer
+	t, err := template.New("body").Parse(spec.Body)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(&body, &bodyData{Job: j, Run: r, Env: spec.Env}); err != nil {
+		return err
+	}
+
+	reqCtx, cancel := ctx, func() {}
+	if spec.Timeout > 0 {
+		reqCtx, cancel = context.WithTimeout(ctx, spec.Timeout)
+	}
+	defer cancel()
+	method := spec.Method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequestWithContext(reqCtx, method, spec.URL, &body)
+	if err != nil {
+		return err
+	}
+	for name, value := range spec.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("X-Xchronos-Job-Id", j.ID)
+	req.Header.Set("X-Xchronos-Run-Id", r.ID)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err == nil {
+		var data []byte
+		data, err = io.ReadAll(io.LimitReader(resp.Body, int64(HTTP_BODY_LIMIT)))
+		resp.Body.Close()
+		r.Response = &run.Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(data)}
+	}
+	r.Duration = time.Since(start)
+	if err != nil {
+		// the request or the read of the response may have been cut short
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(reqCtx.Err(), context.DeadlineExceeded):
+			return ErrTimedOut
+		}
+		return err
+	}
+
+	if !spec.SuccessStatusOK(r.Response.StatusCode) {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	if spec.SuccessMatch != "" {
+		if matched, err := regexp.MatchString(spec.SuccessMatch, r.Response.Body); err != nil || !matched {
+			return fmt.Errorf("Response does not match [%s]", spec.SuccessMatch)
+		}
+	}
+	return nil
+}
+
+// httpClient returns a client trusting the endpoints as told
+func httpClient(options job.TLSOptions) (*http.Client, error) {
+	config := &tls.Config{
+		ServerName:         options.ServerName,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
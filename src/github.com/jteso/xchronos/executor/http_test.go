@@ -0,0 +1,156 @@
+package executor_test
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/executor"
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+)
+
+func newHTTPJob(url string) *job.Job {
+	j := job.New("report")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_HTTP, URL: url}
+	return j
+}
+
+func TestHTTP(t *testing.T) {
+	var received *http.Request
+	var receivedBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		received, receivedBody = req, string(b)
+		w.Header().Set("X-Report", "42")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, `{"status":"queued"}`)
+	}))
+	defer server.Close()
+
+	j := newHTTPJob(server.URL + "/generate")
+	j.Executor.Method = "POST"
+	j.Executor.Headers = map[string]string{"Content-Type": "application/json"}
+	j.Executor.Env = map[string]string{"FORMAT": "pdf"}
+	j.Executor.Body = `{"run":"{{.Run.ID}}","attempt":{{.Run.Attempt}},"format":"{{.Env.FORMAT}}"}`
+	j.Executor.SuccessMatch = `"queued"`
+
+	r, err := execute(t, j)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if received.Method != "POST" || received.URL.Path != "/generate" || received.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected request to be configured. Observed: %s %s %v", received.Method, received.URL, received.Header)
+	}
+	if expected := `{"run":"` + r.ID + `","attempt":1,"format":"pdf"}`; receivedBody != expected {
+		t.Errorf("Expected body [%s]. Observed [%s]", expected, receivedBody)
+	}
+	if r.Response == nil || r.Response.StatusCode != 202 || r.Response.Header["X-Report"][0] != "42" || r.Response.Body != `{"status":"queued"}` {
+		t.Errorf("Expected response to be recorded. Observed: %+v", r.Response)
+	}
+}
+
+func TestHTTPFailed(t *testing.T) {
+	status, body := http.StatusOK, "ok"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		status        int
+		body          string
+		successStatus []string
+		successMatch  string
+		ok            bool
+	}{
+		{500, "boom", nil, "", false},
+		{302, "moved", nil, "", false},
+		{302, "moved", []string{"300-399"}, "", true},
+		{200, `{"errors":1}`, nil, `"errors":0`, false},
+	}
+	for _, c := range cases {
+		status, body = c.status, c.body
+		j := newHTTPJob(server.URL)
+		j.Executor.SuccessStatus = c.successStatus
+		j.Executor.SuccessMatch = c.successMatch
+		r, err := execute(t, j)
+		if (err == nil) != c.ok {
+			t.Errorf("Expected success [%t] for %d %s. Observed: %v", c.ok, c.status, c.body, err)
+		}
+		if r.Response == nil || r.Response.Body != c.body {
+			t.Errorf("Expected response to be recorded. Observed: %+v", r.Response)
+		}
+	}
+}
+
+func TestHTTPBodyLimit(t *testing.T) {
+	defer func(limit int) { executor.HTTP_BODY_LIMIT = limit }(executor.HTTP_BODY_LIMIT)
+	executor.HTTP_BODY_LIMIT = 4
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "0123456789")
+	}))
+	defer server.Close()
+
+	r, _ := execute(t, newHTTPJob(server.URL))
+	if r.Response.Body != "0123" {
+		t.Errorf("Expected first [%d] bytes of the body. Observed [%s]", 4, r.Response.Body)
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	j := newHTTPJob(server.URL)
+	j.Executor.Timeout = 50 * time.Millisecond
+	if _, err := execute(t, j); err != executor.ErrTimedOut {
+		t.Errorf("Expected [%v]. Observed: %v", executor.ErrTimedOut, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	e, _ := executor.Get(job.EXECUTOR_HTTP)
+	if err := e.Execute(ctx, newHTTPJob(server.URL), run.New("report", time.Now(), "agent_1")); err != context.Canceled {
+		t.Errorf("Expected [%v]. Observed: %v", context.Canceled, err)
+	}
+}
+
+func TestHTTPTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	j := newHTTPJob(server.URL)
+	if _, err := execute(t, j); err == nil {
+		t.Errorf("Expected the certificate of the test server not to be trusted")
+	}
+
+	dir, _ := os.MkdirTemp("", "xchronos")
+	defer os.RemoveAll(dir)
+	j.Executor.TLS.CAFile = filepath.Join(dir, "ca.pem")
+	os.WriteFile(j.Executor.TLS.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	if _, err := execute(t, j); err != nil {
+		t.Errorf("Expected the CA file to be trusted. Observed: %v", err)
+	}
+
+	j.Executor.TLS = job.TLSOptions{InsecureSkipVerify: true}
+	if _, err := execute(t, j); err != nil {
+		t.Errorf("Expected the certificate not to be verified. Observed: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package executor
+
+import (
+	"sync"
+)
+
+// RingBuffer is a writer keeping the last bytes written only, so the output of a job
+// is captured without bounds on what it writes
+type RingBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+	// position of the oldest byte, once the buffer is full
+	start int
+	// bytes written overall
+	written int64
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{size: size, buf: make([]byte, 0, size)}
+}
+
+func (b *RingBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	b.written += int64(n)
+	if n >= b.size {
+		b.buf = append(b.buf[:0], p[n-b.size:]...)
+		b.start = 0
+		return n, nil
+	}
+	if room := b.size - len(b.buf); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.buf = append(b.buf, p[:room]...)
+		p = p[room:]
+	}
+	for len(p) > 0 {
+		copied := copy(b.buf[b.start:], p)
+		p = p[copied:]
+		b.start = (b.start + copied) % b.size
+	}
+	return n, nil
+}
+
+// Bytes returns the bytes kept, oldest first
+func (b *RingBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]byte, 0, len(b.buf))
+	out = append(out, b.buf[b.start:]...)
+	return append(out, b.buf[:b.start]...)
+}
+
+func (b *RingBuffer) String() string {
+	return string(b.Bytes())
+}
+
+// Dropped returns the number of bytes written but not kept
+func (b *RingBuffer) Dropped() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.written - int64(len(b.buf))
+}
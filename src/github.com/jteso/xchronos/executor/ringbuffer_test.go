@@ -0,0 +1,32 @@
+package executor_test
+
+import (
+	"testing"
+
+	"github.com/jteso/xchronos/executor"
+)
+
+func TestRingBuffer(t *testing.T) {
+	cases := []struct {
+		writes   []string
+		expected string
+		dropped  int64
+	}{
+		{[]string{"abc"}, "abc", 0},
+		{[]string{"abc", "de"}, "abcde", 0},
+		{[]string{"abc", "def", "g"}, "cdefg", 2},
+		{[]string{"abcdefgh"}, "defgh", 3},
+		{[]string{"ab", "cd", "ef", "gh", "ij", "k"}, "ghijk", 6},
+	}
+	for _, c := range cases {
+		b := executor.NewRingBuffer(5)
+		for _, w := range c.writes {
+			if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("Expected [%d] bytes written. Observed [%d]: %v", len(w), n, err)
+			}
+		}
+		if b.String() != c.expected || b.Dropped() != c.dropped {
+			t.Errorf("Expected [%s] (%d dropped) after %q. Observed [%s] (%d dropped)", c.expected, c.dropped, c.writes, b.String(), b.Dropped())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package job
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Formats a job can be encoded with
+const (
+	FORMAT_JSON    = "json"
+	FORMAT_MSGPACK = "msgpack"
+)
+
+var (
+	// Format used to write the jobs into the job store
+	ENCODING_FORMAT = FORMAT_JSON
+
+	ErrUnknownFormat = errors.New("Unknown encoding format")
+
+	jsonHandle    = new(codec.JsonHandle)
+	msgpackHandle = new(codec.MsgpackHandle)
+
+	// job store values are strings, so binary formats are base64 encoded behind a prefix
+	msgpackPrefix = FORMAT_MSGPACK + ":"
+
+	// upgrades a job written with an older schema version to the next one, by version
+	migrations = map[int]func(*Job){
+		// definitions written before the schema got versioned
+		0: func(j *Job) {},
+	}
+)
+
+// Encode serializes a job with the given format
+func Encode(j *Job, format string) (string, error) {
+	switch format {
+	case FORMAT_JSON:
+		var b []byte
+		err := codec.NewEncoderBytes(&b, jsonHandle).Encode(j)
+		return string(b), err
+	case FORMAT_MSGPACK:
+		var b []byte
+		err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(j)
+		return msgpackPrefix + base64.StdEncoding.EncodeToString(b), err
+	}
+	return "", ErrUnknownFormat
+}
+
+// Decode deserializes a job encoded with any of the supported formats, migrating
+// it to the current schema version if needed
+func Decode(value string) (*Job, error) {
+	j := &Job{}
+	if strings.HasPrefix(value, msgpackPrefix) {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, msgpackPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if err := codec.NewDecoderBytes(b, msgpackHandle).Decode(j); err != nil {
+			return nil, err
+		}
+	} else if err := codec.NewDecoderBytes([]byte(value), jsonHandle).Decode(j); err != nil {
+		return nil, err
+	}
+
+	if err := migrate(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func migrate(j *Job) error {
+	if j.SchemaVersion > SCHEMA_VERSION {
+		return fmt.Errorf("Job [%s] written with schema version %d, newer than the supported %d", j.ID, j.SchemaVersion, SCHEMA_VERSION)
+	}
+	for j.SchemaVersion < SCHEMA_VERSION {
+		migrations[j.SchemaVersion](j)
+		j.SchemaVersion++
+	}
+	return nil
+}
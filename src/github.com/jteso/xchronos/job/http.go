@@ -0,0 +1,72 @@
+package job
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var (
+	// http methods are tokens (RFC 7230)
+	validMethod = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+)
+
+// SuccessStatusOK tells whether a response status code is a successful one (http)
+func (e *ExecutorSpec) SuccessStatusOK(code int) bool {
+	if len(e.SuccessStatus) == 0 {
+		return code >= 200 && code <= 299
+	}
+	for _, r := range e.SuccessStatus {
+		if from, to, err := parseStatusRange(r); err == nil && code >= from && code <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStatusRange parses a status code, i.e. 200, or range of them, i.e. 200-299
+func parseStatusRange(r string) (int, int, error) {
+	bounds := strings.SplitN(r, "-", 2)
+	from, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	to := from
+	if len(bounds) == 2 {
+		if to, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return 0, 0, err
+		}
+	}
+	if from < 100 || to > 599 || from > to {
+		return 0, 0, fmt.Errorf("out of range")
+	}
+	return from, to, nil
+}
+
+func (e *ExecutorSpec) validateHTTP() error {
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalid("executor.url", "[%s] must be an absolute http(s) url", e.URL)
+	}
+	if e.Method != "" && !validMethod.MatchString(e.Method) {
+		return invalid("executor.method", "invalid method [%s]", e.Method)
+	}
+	if _, err := template.New("body").Parse(e.Body); err != nil {
+		return invalid("executor.body", "%s", err.Error())
+	}
+	for _, r := range e.SuccessStatus {
+		if _, _, err := parseStatusRange(r); err != nil {
+			return invalid("executor.successStatus", "[%s] must be a status code or range of them, i.e. 200-299", r)
+		}
+	}
+	if _, err := regexp.Compile(e.SuccessMatch); err != nil {
+		return invalid("executor.successMatch", "%s", err.Error())
+	}
+	if (e.TLS.CertFile == "") != (e.TLS.KeyFile == "") {
+		return invalid("executor.tls", "certFile and keyFile go together")
+	}
+	return nil
+}
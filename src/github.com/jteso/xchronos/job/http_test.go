@@ -0,0 +1,29 @@
+package job_test
+
+import (
+	"testing"
+
+	"github.com/jteso/xchronos/job"
+)
+
+func TestSuccessStatusOK(t *testing.T) {
+	cases := []struct {
+		successStatus []string
+		code          int
+		expected      bool
+	}{
+		{nil, 200, true},
+		{nil, 204, true},
+		{nil, 302, false},
+		{nil, 500, false},
+		{[]string{"200", "300-399"}, 200, true},
+		{[]string{"200", "300-399"}, 201, false},
+		{[]string{"200", "300-399"}, 304, true},
+	}
+	for _, c := range cases {
+		spec := &job.ExecutorSpec{Type: job.EXECUTOR_HTTP, SuccessStatus: c.successStatus}
+		if ok := spec.SuccessStatusOK(c.code); ok != c.expected {
+			t.Errorf("Expected [%t] for %d with %v. Observed [%t]", c.expected, c.code, c.successStatus, ok)
+		}
+	}
+}
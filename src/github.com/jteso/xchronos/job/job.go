@@ -0,0 +1,483 @@
+package job
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Version of the job definition schema written by this release. Bump it whenever
+	// a change in the Job struct needs existing definitions to be migrated (see `migrate`).
+	SCHEMA_VERSION = 1
+)
+
+// Misfire instructions, applied when a job could not be fired on time (i.e. no leader was
+// around). See README.md
+const (
+	MISFIRE_INSTRUCTION_FIRE_NOW                                  = "MISFIRE_INSTRUCTION_FIRE_NOW"
+	MISFIRE_INSTRUCTION_IGNORE_MISFIRE_POLICY                     = "MISFIRE_INSTRUCTION_IGNORE_MISFIRE_POLICY"
+	MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_EXISTING_COUNT       = "MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_EXISTING_COUNT"
+	MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT      = "MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT"
+	MISFIRE_INSTRUCTION_RESCHEDULE_NOW_WITH_EXISTING_REPEAT_COUNT = "MISFIRE_INSTRUCTION_RESCHEDULE_NOW_WITH_EXISTING_REPEAT_COUNT"
+)
+
+// Trigger types
+const (
+	TRIGGER_SIMPLE  = "simple"
+	TRIGGER_CRON    = "cron"
+	TRIGGER_ISO8601 = "iso8601"
+	// Registered by the application embedding the agent, see trigger.Register
+	TRIGGER_CUSTOM = "custom"
+)
+
+// Executor types
+const (
+	EXECUTOR_COMMAND = "command"
+	// container run by the Docker Engine of the agent
+	EXECUTOR_DOCKER = "docker"
+	// request to an http endpoint
+	EXECUTOR_HTTP = "http"
+	// Go function registered by the application embedding the agent, see executor.Handle
+	EXECUTOR_FUNC = "func"
+)
+
+// Placement strategies, choosing the executor every run of a job is offered to
+const (
+	PLACEMENT_ROUND_ROBIN  = "round-robin"
+	PLACEMENT_LEAST_LOADED = "least-loaded"
+	PLACEMENT_RANDOM       = "random"
+	// same executor for every run, as long as it is alive
+	PLACEMENT_STICKY = "sticky"
+)
+
+// Constraint operators, telling which executors may run a job
+const (
+	// the label of the executor has the value
+	CONSTRAINT_EQUALS     = "equals"
+	CONSTRAINT_NOT_EQUALS = "not-equals"
+	// the label of the executor has any of the values
+	CONSTRAINT_IN = "in"
+	// the executor has the label, whatever its value
+	CONSTRAINT_EXISTS = "exists"
+	// the executor is not running any of the jobs given as values
+	CONSTRAINT_ANTI_AFFINITY = "anti-affinity"
+)
+
+// Success policies, telling when a fire run by several executors succeeds (see Availability)
+const (
+	// every run succeeds
+	SUCCESS_ALL = "all"
+	// one run succeeds
+	SUCCESS_ANY = "any"
+	// most runs succeed
+	SUCCESS_QUORUM = "quorum"
+)
+
+// Shortage policies, telling what to do when fewer executors than the availability of a
+// job are alive
+const (
+	// fire once enough executors are alive
+	SHORTAGE_WAIT = "wait"
+	// run on every executor alive
+	SHORTAGE_DEGRADED = "degraded"
+	// fail the fire
+	SHORTAGE_FAIL = "fail"
+)
+
+var (
+	// job ids are used as keys of the job store
+	validId = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+	misfirePolicies = map[string]bool{
+		MISFIRE_INSTRUCTION_FIRE_NOW:                                  true,
+		MISFIRE_INSTRUCTION_IGNORE_MISFIRE_POLICY:                     true,
+		MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_EXISTING_COUNT:       true,
+		MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT:      true,
+		MISFIRE_INSTRUCTION_RESCHEDULE_NOW_WITH_EXISTING_REPEAT_COUNT: true,
+	}
+
+	placements = map[string]bool{
+		PLACEMENT_ROUND_ROBIN:  true,
+		PLACEMENT_LEAST_LOADED: true,
+		PLACEMENT_RANDOM:       true,
+		PLACEMENT_STICKY:       true,
+	}
+
+	successPolicies = map[string]bool{
+		SUCCESS_ALL:    true,
+		SUCCESS_ANY:    true,
+		SUCCESS_QUORUM: true,
+	}
+
+	shortagePolicies = map[string]bool{
+		SHORTAGE_WAIT:     true,
+		SHORTAGE_DEGRADED: true,
+		SHORTAGE_FAIL:     true,
+	}
+)
+
+var (
+	// CheckTrigger, when set, is called by Validate to check the trigger can actually be
+	// built (i.e. the cron expression parses). It is set by the trigger package, which
+	// this one can not depend on.
+	CheckTrigger func(spec TriggerSpec) error
+	// ExecutorTypes, when set, returns the executor types Validate accepts instead of the
+	// built-in ones, i.e. the ones registered with the executor package.
+	ExecutorTypes func() []string
+)
+
+// Job is the definition of a job, stored under JOBS_DIR/<job_id>
+type Job struct {
+	// Version of the schema the job was written with
+	SchemaVersion int `codec:"schemaVersion"`
+
+	ID   string `codec:"id"`
+	Name string `codec:"name"`
+
+	// What to run
+	Executor ExecutorSpec `codec:"executor"`
+	// When to run it
+	Trigger TriggerSpec `codec:"trigger"`
+	// What to do when it fails
+	Retry RetryPolicy `codec:"retry"`
+	// What to do when it could not be fired on time, one of MISFIRE_INSTRUCTION_*
+	MisfirePolicy string `codec:"misfirePolicy,omitempty"`
+	// Number of distinct executors running every fire of the job
+	Availability int `codec:"availability"`
+	// When a fire succeeds, one of SUCCESS_*. All of its runs if empty
+	SuccessPolicy string `codec:"successPolicy,omitempty"`
+	// What to do when fewer executors than Availability are alive, one of SHORTAGE_*.
+	// Run degraded if empty
+	ShortagePolicy string `codec:"shortagePolicy,omitempty"`
+	// How executors are chosen, one of PLACEMENT_*. The scheduler default if empty
+	Placement string `codec:"placement,omitempty"`
+	// Executors allowed to run the job, all of them if empty
+	Constraints []Constraint `codec:"constraints,omitempty"`
+	// Capacity slots of the executor taken by every run, 1 if 0
+	Slots int `codec:"slots,omitempty"`
+	// Runs waiting for free capacity are offered highest priority first
+	Priority int `codec:"priority,omitempty"`
+	// How many of its finished runs are kept, and for how long (see run.History)
+	History HistoryPolicy `codec:"history,omitempty"`
+
+	Owner   string            `codec:"owner,omitempty"`
+	Labels  map[string]string `codec:"labels,omitempty"`
+	Enabled bool              `codec:"enabled"`
+
+	CreatedAt time.Time `codec:"createdAt"`
+	UpdatedAt time.Time `codec:"updatedAt"`
+
+	// store index the job was read at, used to detect concurrent updates
+	index uint64
+}
+
+// HistoryPolicy is the retention of the finished runs of a job, enforced by the leader
+// from time to time. Zero values mean the defaults (see run.HISTORY_MAX_RUNS and
+// run.HISTORY_MAX_AGE)
+type HistoryPolicy struct {
+	// Max number of runs kept, the latest ones
+	MaxRuns int `codec:"maxRuns,omitempty"`
+	// Max time runs are kept since they finished
+	MaxAge time.Duration `codec:"maxAge,omitempty"`
+}
+
+type ExecutorSpec struct {
+	// Type of executor, i.e. EXECUTOR_COMMAND
+	Type string `codec:"type"`
+	// Command line to run, by /bin/sh (command)
+	Command string `codec:"command,omitempty"`
+	// Extra environment variables, available to the body template (http)
+	Env map[string]string `codec:"env,omitempty"`
+	// Working directory, the agent's (command) or image's (docker) one if empty
+	Dir string `codec:"dir,omitempty"`
+	// User to run as, by name or uid. The agent's (command) or image's (docker) one if empty
+	User string `codec:"user,omitempty"`
+	// Max time running, none if 0. Timed out runs are terminated
+	Timeout time.Duration `codec:"timeout,omitempty"`
+
+	// Image to run, pulled before every run, i.e. coreos/apache:latest (docker)
+	Image string `codec:"image,omitempty"`
+	// Command of the container, the image's one if empty (docker)
+	Args []string `codec:"args,omitempty"`
+	// Host paths mounted in the container (docker)
+	Mounts []Mount `codec:"mounts,omitempty"`
+	// Memory limit in bytes, none if 0 (docker)
+	Memory int64 `codec:"memory,omitempty"`
+	// CPU limit in number of CPUs, i.e. 0.5, none if 0 (docker)
+	CPUs float64 `codec:"cpus,omitempty"`
+
+	// Method of the request, GET if empty (http)
+	Method string `codec:"method,omitempty"`
+	// Endpoint called (http)
+	URL string `codec:"url,omitempty"`
+	// Headers of the request (http)
+	Headers map[string]string `codec:"headers,omitempty"`
+	// Body of the request, a text/template given the job, run and env (http)
+	Body string `codec:"body,omitempty"`
+	// How https endpoints are trusted (http)
+	TLS TLSOptions `codec:"tls,omitempty"`
+	// Status codes of the successful responses, i.e. 200, 200-299. 2xx if empty (http)
+	SuccessStatus []string `codec:"successStatus,omitempty"`
+	// Regular expression the body of the successful responses matches, if any (http)
+	SuccessMatch string `codec:"successMatch,omitempty"`
+
+	// Name the function was registered with (func)
+	Handler string `codec:"handler,omitempty"`
+	// Opaque payload handed over to the function (func)
+	Payload []byte `codec:"payload,omitempty"`
+}
+
+// TLSOptions tells how https endpoints are trusted, files are read on the executors
+type TLSOptions struct {
+	// CA certificates trusted, the system ones if empty
+	CAFile string `codec:"caFile,omitempty"`
+	// Client certificate and key, if the endpoint asks for one
+	CertFile string `codec:"certFile,omitempty"`
+	KeyFile  string `codec:"keyFile,omitempty"`
+	// Name checked against the certificate of the endpoint, its host if empty
+	ServerName         string `codec:"serverName,omitempty"`
+	InsecureSkipVerify bool   `codec:"insecureSkipVerify,omitempty"`
+}
+
+// Mount is a host path mounted in a container
+type Mount struct {
+	Source   string `codec:"source"`
+	Target   string `codec:"target"`
+	ReadOnly bool   `codec:"readOnly,omitempty"`
+}
+
+// Constraint is a condition executors meet to run a job, i.e. region equals us-east-1
+type Constraint struct {
+	// Label of the executors checked, none for anti-affinity
+	Label string `codec:"label,omitempty"`
+	// One of CONSTRAINT_*
+	Operator string `codec:"operator"`
+	// Values the label is compared to, or ids of the jobs avoided (anti-affinity)
+	Values []string `codec:"values,omitempty"`
+}
+
+func (c Constraint) String() string {
+	if c.Operator == CONSTRAINT_ANTI_AFFINITY {
+		return fmt.Sprintf("%s %v", c.Operator, c.Values)
+	}
+	return fmt.Sprintf("%s %s %v", c.Label, c.Operator, c.Values)
+}
+
+func (c Constraint) validate() error {
+	values := -1
+	switch c.Operator {
+	case CONSTRAINT_EQUALS, CONSTRAINT_NOT_EQUALS:
+		values = 1
+	case CONSTRAINT_EXISTS:
+		values = 0
+	case CONSTRAINT_IN, CONSTRAINT_ANTI_AFFINITY:
+		if len(c.Values) == 0 {
+			return invalid("constraints", "[%s] needs values", c)
+		}
+	default:
+		return invalid("constraints", "unknown operator [%s]", c.Operator)
+	}
+	if values >= 0 && len(c.Values) != values {
+		return invalid("constraints", "[%s] needs %d values, got %d", c, values, len(c.Values))
+	}
+	if (c.Label == "") != (c.Operator == CONSTRAINT_ANTI_AFFINITY) {
+		return invalid("constraints", "[%s] needs a label, but anti-affinity ones", c)
+	}
+	return nil
+}
+
+type TriggerSpec struct {
+	// Type of trigger, one of TRIGGER_*
+	Type string `codec:"type"`
+	// Delay between the job being scheduled and its first fire
+	StartDelay time.Duration `codec:"startDelay,omitempty"`
+	// Time between consecutive fires (simple)
+	RepeatInterval time.Duration `codec:"repeatInterval,omitempty"`
+	// Number of fires after the first one: 0 for one-shot jobs, -1 to repeat forever (simple)
+	RepeatCount int `codec:"repeatCount,omitempty"`
+	// Cron expression (cron)
+	CronExpression string `codec:"cronExpression,omitempty"`
+	// ISO 8601 repeating interval, i.e. R5/2016-01-01T00:00:00Z/PT1H30M (iso8601)
+	Schedule string `codec:"schedule,omitempty"`
+	// IANA time zone, i.e. Europe/Madrid, the cron expression or the calendar units of the
+	// schedule are evaluated in. UTC by default (cron, iso8601)
+	TimeZone string `codec:"timeZone,omitempty"`
+	// Name the trigger was registered with (custom)
+	Name string `codec:"name,omitempty"`
+	// Opaque params, decoded by the registered trigger (custom)
+	Params []byte `codec:"params,omitempty"`
+}
+
+// ValidationError reports an invalid job definition
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid job %s: %s", e.Field, e.Message)
+}
+
+func invalid(field string, format string, v ...interface{}) error {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, v...)}
+}
+
+// New returns a job with the default settings: enabled, run by one executor and
+// with no retries
+func New(id string) *Job {
+	return &Job{
+		SchemaVersion: SCHEMA_VERSION,
+		ID:            id,
+		Name:          id,
+		Availability:  1,
+		Enabled:       true,
+		MisfirePolicy: MISFIRE_INSTRUCTION_FIRE_NOW,
+	}
+}
+
+// RunSlots returns the capacity slots taken by every run of the job
+func (j *Job) RunSlots() int {
+	if j.Slots < 1 {
+		return 1
+	}
+	return j.Slots
+}
+
+// Validate checks the job definition is complete and consistent
+func (j *Job) Validate() error {
+	if !validId.MatchString(j.ID) {
+		return invalid("id", "[%s] must be made of letters, digits, '_', '.' or '-'", j.ID)
+	}
+	if j.Name == "" {
+		return invalid("name", "is required")
+	}
+	if j.Availability < 1 {
+		return invalid("availability", "must be at least 1, got %d", j.Availability)
+	}
+	if j.SuccessPolicy != "" && !successPolicies[j.SuccessPolicy] {
+		return invalid("successPolicy", "unknown policy [%s]", j.SuccessPolicy)
+	}
+	if j.ShortagePolicy != "" && !shortagePolicies[j.ShortagePolicy] {
+		return invalid("shortagePolicy", "unknown policy [%s]", j.ShortagePolicy)
+	}
+	if j.MisfirePolicy != "" && !misfirePolicies[j.MisfirePolicy] {
+		return invalid("misfirePolicy", "unknown policy [%s]", j.MisfirePolicy)
+	}
+	if j.Placement != "" && !placements[j.Placement] {
+		return invalid("placement", "unknown placement [%s]", j.Placement)
+	}
+	if j.Slots < 0 {
+		return invalid("slots", "can not be negative")
+	}
+	if j.History.MaxRuns < 0 {
+		return invalid("history.maxRuns", "can not be negative")
+	}
+	if j.History.MaxAge < 0 {
+		return invalid("history.maxAge", "can not be negative")
+	}
+	for _, c := range j.Constraints {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+	if err := j.Executor.validate(); err != nil {
+		return err
+	}
+	if err := j.Trigger.validate(); err != nil {
+		return err
+	}
+	if CheckTrigger != nil {
+		if err := CheckTrigger(j.Trigger); err != nil {
+			return err
+		}
+	}
+	return j.Retry.validate()
+}
+
+func (e *ExecutorSpec) validate() error {
+	switch e.Type {
+	case "":
+		return invalid("executor.type", "is required")
+	case EXECUTOR_COMMAND:
+		if e.Command == "" {
+			return invalid("executor.command", "is required")
+		}
+	case EXECUTOR_DOCKER:
+		if e.Image == "" {
+			return invalid("executor.image", "is required")
+		}
+	case EXECUTOR_HTTP:
+		if err := e.validateHTTP(); err != nil {
+			return err
+		}
+	case EXECUTOR_FUNC:
+		if e.Handler == "" {
+			return invalid("executor.handler", "is required")
+		}
+	default:
+		types := []string{EXECUTOR_COMMAND, EXECUTOR_DOCKER, EXECUTOR_FUNC, EXECUTOR_HTTP}
+		if ExecutorTypes != nil {
+			types = ExecutorTypes()
+		}
+		known := false
+		for _, t := range types {
+			known = known || t == e.Type
+		}
+		if !known {
+			return invalid("executor.type", "unknown executor [%s], must be one of %s", e.Type, strings.Join(types, ", "))
+		}
+	}
+	for _, m := range e.Mounts {
+		if !path.IsAbs(m.Source) || !path.IsAbs(m.Target) {
+			return invalid("executor.mounts", "[%s:%s] must be absolute paths", m.Source, m.Target)
+		}
+	}
+	if e.Memory < 0 {
+		return invalid("executor.memory", "can not be negative")
+	}
+	if e.CPUs < 0 {
+		return invalid("executor.cpus", "can not be negative")
+	}
+	if e.Timeout < 0 {
+		return invalid("executor.timeout", "can not be negative")
+	}
+	return nil
+}
+
+func (t *TriggerSpec) validate() error {
+	if t.StartDelay < 0 {
+		return invalid("trigger.startDelay", "can not be negative")
+	}
+	if _, err := time.LoadLocation(t.TimeZone); err != nil {
+		return invalid("trigger.timeZone", "unknown time zone [%s]", t.TimeZone)
+	}
+	switch t.Type {
+	case TRIGGER_SIMPLE:
+		if t.RepeatCount < -1 {
+			return invalid("trigger.repeatCount", "must be -1 (forever), 0 (one-shot) or positive, got %d", t.RepeatCount)
+		}
+		if t.RepeatCount != 0 && t.RepeatInterval <= 0 {
+			return invalid("trigger.repeatInterval", "must be positive for repeating jobs")
+		}
+	case TRIGGER_CRON:
+		if t.CronExpression == "" {
+			return invalid("trigger.cronExpression", "is required")
+		}
+	case TRIGGER_ISO8601:
+		if t.Schedule == "" {
+			return invalid("trigger.schedule", "is required")
+		}
+	case TRIGGER_CUSTOM:
+		if t.Name == "" {
+			return invalid("trigger.name", "is required")
+		}
+	case "":
+		return invalid("trigger.type", "is required")
+	default:
+		return invalid("trigger.type", "unknown trigger [%s]", t.Type)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package job_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+)
+
+func newBackupJob() *job.Job {
+	j := job.New("backup")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_COMMAND, Command: "/usr/bin/backup.sh", Dir: "/var/backups", Timeout: time.Hour}
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_SIMPLE, StartDelay: 10 * time.Second, RepeatInterval: 2 * time.Second, RepeatCount: -1}
+	j.Retry = job.RetryPolicy{
+		MaxAttempts:            3,
+		TimeBetweenAttempts:    10 * time.Second,
+		Backoff:                job.BACKOFF_EXPONENTIAL,
+		MaxTimeBetweenAttempts: time.Minute,
+		Jitter:                 0.1,
+		RetryOn:                []string{job.ERROR_CLASS_FAILED, job.ERROR_CLASS_EXECUTOR_LOST},
+		RetryableExitCodes:     []int{75},
+	}
+	j.History = job.HistoryPolicy{MaxRuns: 50, MaxAge: 7 * 24 * time.Hour}
+	j.Labels = map[string]string{"team": "ops"}
+	return j
+}
+
+// toHTTP turns a job into a valid http one
+func toHTTP(j *job.Job) {
+	j.Executor.Type = job.EXECUTOR_HTTP
+	j.Executor.URL = "https://reports.internal/generate"
+}
+
+func TestValidate(t *testing.T) {
+	cases := map[string]func(*job.Job){
+		"id":                           func(j *job.Job) { j.ID = "../etc" },
+		"name":                         func(j *job.Job) { j.Name = "" },
+		"availability":                 func(j *job.Job) { j.Availability = 0 },
+		"successPolicy":                func(j *job.Job) { j.SuccessPolicy = "most" },
+		"shortagePolicy":               func(j *job.Job) { j.ShortagePolicy = "panic" },
+		"misfirePolicy":                func(j *job.Job) { j.MisfirePolicy = "MISFIRE_INSTRUCTION_PANIC" },
+		"placement":                    func(j *job.Job) { j.Placement = "anywhere" },
+		"constraints":                  func(j *job.Job) { j.Constraints = []job.Constraint{{Label: "region", Operator: job.CONSTRAINT_EQUALS}} },
+		"slots":                        func(j *job.Job) { j.Slots = -1 },
+		"executor.type":                func(j *job.Job) { j.Executor.Type = "" },
+		"executor.command":             func(j *job.Job) { j.Executor.Command = "" },
+		"executor.timeout":             func(j *job.Job) { j.Executor.Timeout = -time.Second },
+		"executor.image":               func(j *job.Job) { j.Executor.Type = job.EXECUTOR_DOCKER },
+		"executor.mounts":              func(j *job.Job) { j.Executor.Mounts = []job.Mount{{Source: "data", Target: "/data"}} },
+		"executor.memory":              func(j *job.Job) { j.Executor.Memory = -1 },
+		"executor.cpus":                func(j *job.Job) { j.Executor.CPUs = -1 },
+		"executor.url":                 func(j *job.Job) { j.Executor.Type = job.EXECUTOR_HTTP },
+		"executor.method":              func(j *job.Job) { toHTTP(j); j.Executor.Method = "GET /" },
+		"executor.body":                func(j *job.Job) { toHTTP(j); j.Executor.Body = "{{.Run.ID" },
+		"executor.successStatus":       func(j *job.Job) { toHTTP(j); j.Executor.SuccessStatus = []string{"2xx"} },
+		"executor.successMatch":        func(j *job.Job) { toHTTP(j); j.Executor.SuccessMatch = "(" },
+		"executor.tls":                 func(j *job.Job) { toHTTP(j); j.Executor.TLS.CertFile = "/etc/xchronos/client.pem" },
+		"executor.handler":             func(j *job.Job) { j.Executor.Type = job.EXECUTOR_FUNC },
+		"trigger.type":                 func(j *job.Job) { j.Trigger.Type = "sometimes" },
+		"trigger.repeatCount":          func(j *job.Job) { j.Trigger.RepeatCount = -2 },
+		"trigger.repeatInterval":       func(j *job.Job) { j.Trigger.RepeatInterval = 0 },
+		"trigger.cronExpression":       func(j *job.Job) { j.Trigger.Type = job.TRIGGER_CRON },
+		"trigger.schedule":             func(j *job.Job) { j.Trigger.Type = job.TRIGGER_ISO8601 },
+		"trigger.name":                 func(j *job.Job) { j.Trigger.Type = job.TRIGGER_CUSTOM },
+		"trigger.timeZone":             func(j *job.Job) { j.Trigger.TimeZone = "Mars/Olympus_Mons" },
+		"retry.maxAttempts":            func(j *job.Job) { j.Retry.MaxAttempts = -1 },
+		"retry.backoff":                func(j *job.Job) { j.Retry.Backoff = "fibonacci" },
+		"retry.maxTimeBetweenAttempts": func(j *job.Job) { j.Retry.MaxTimeBetweenAttempts = -time.Second },
+		"retry.jitter":                 func(j *job.Job) { j.Retry.Jitter = 1.5 },
+		"retry.retryOn":                func(j *job.Job) { j.Retry.RetryOn = []string{"oom"} },
+		"retry.retryableExitCodes":     func(j *job.Job) { j.Retry.RetryableExitCodes = []int{0} },
+		"history.maxRuns":              func(j *job.Job) { j.History.MaxRuns = -1 },
+		"history.maxAge":               func(j *job.Job) { j.History.MaxAge = -time.Hour },
+	}
+
+	if err := newBackupJob().Validate(); err != nil {
+		t.Fatalf("Expected job to be valid. Observed: %s", err.Error())
+	}
+	for field, corrupt := range cases {
+		j := newBackupJob()
+		corrupt(j)
+		err := j.Validate()
+		if verr, ok := err.(*job.ValidationError); !ok || verr.Field != field {
+			t.Errorf("Expected invalid [%s]. Observed: %v", field, err)
+		}
+	}
+
+	j := newBackupJob()
+	j.Executor.Type = "ssh"
+	err := j.Validate()
+	if verr, ok := err.(*job.ValidationError); !ok || verr.Field != "executor.type" || !strings.Contains(verr.Message, "command, docker, func, http") {
+		t.Errorf("Expected unknown [%s] executor listing the ones accepted. Observed: %v", "ssh", err)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	j := newBackupJob()
+	j.CreatedAt = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	j.UpdatedAt = j.CreatedAt
+
+	for _, format := range []string{job.FORMAT_JSON, job.FORMAT_MSGPACK} {
+		value, err := job.Encode(j, format)
+		if err != nil {
+			t.Fatalf("Unexpected error encoding %s: %s", format, err.Error())
+		}
+		decoded, err := job.Decode(value)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %s: %s", format, err.Error())
+		}
+		if !reflect.DeepEqual(j, decoded) {
+			t.Errorf("Expected [%+v]. Observed [%+v]", j, decoded)
+		}
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	j, err := job.Decode(`{"id":"legacy","name":"legacy","enabled":true}`)
+	if err != nil {
+		t.Fatalf("Expected unversioned job to be migrated. Observed: %s", err.Error())
+	}
+	if j.SchemaVersion != job.SCHEMA_VERSION {
+		t.Errorf("Expected schema version [%d]. Observed [%d]", job.SCHEMA_VERSION, j.SchemaVersion)
+	}
+
+	if _, err := job.Decode(`{"schemaVersion":99,"id":"future"}`); err == nil || !strings.Contains(err.Error(), "99") {
+		t.Errorf("Expected newer schema to be rejected. Observed: %v", err)
+	}
+}
+
+func TestCRUD(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	if err := job.Create(s, newBackupJob()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := job.Create(s, newBackupJob()); err != job.ErrJobExists {
+		t.Errorf("Expected [%v]. Observed [%v]", job.ErrJobExists, err)
+	}
+
+	j1, _ := job.Get(s, "backup")
+	j2, _ := job.Get(s, "backup")
+	j1.Enabled = false
+	if err := job.Update(s, j1); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	j2.Owner = "ops"
+	if err := job.Update(s, j2); err != job.ErrJobModified {
+		t.Errorf("Expected [%v]. Observed [%v]", job.ErrJobModified, err)
+	}
+
+	jobs, _ := job.List(s)
+	if len(jobs) != 1 || jobs[0].Enabled {
+		t.Errorf("Expected a single disabled job. Observed: %+v", jobs)
+	}
+
+	if err := job.Delete(s, "backup"); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, err := job.Get(s, "backup"); err != job.ErrJobNotFound {
+		t.Errorf("Expected [%v]. Observed [%v]", job.ErrJobNotFound, err)
+	}
+}
+
+func TestListSkipsUndecodableJobs(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	job.Create(s, newBackupJob())
+	s.Set(job.Key("corrupt"), "{not a job", 0)
+
+	jobs, err := job.List(s)
+	invalid, ok := err.(*job.ListError)
+	if !ok || len(invalid.Errors) != 1 || invalid.Errors[job.Key("corrupt")] == nil {
+		t.Errorf("Expected corrupt job to be reported. Observed [%v]", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "backup" {
+		t.Errorf("Expected the other jobs to be listed. Observed: %+v", jobs)
+	}
+}
@@ -0,0 +1,146 @@
+package job
+
+import (
+	"time"
+)
+
+// Backoff strategies, telling how the time between attempts grows
+const (
+	BACKOFF_FIXED       = "fixed"
+	BACKOFF_LINEAR      = "linear"
+	BACKOFF_EXPONENTIAL = "exponential"
+)
+
+// Error classes, telling why an attempt failed
+const (
+	// the job failed, i.e. non-zero exit code
+	ERROR_CLASS_FAILED    = "failed"
+	ERROR_CLASS_TIMED_OUT = "timed_out"
+	// the executor running the job went away
+	ERROR_CLASS_EXECUTOR_LOST = "executor_lost"
+)
+
+var (
+	backoffs = map[string]bool{
+		BACKOFF_FIXED:       true,
+		BACKOFF_LINEAR:      true,
+		BACKOFF_EXPONENTIAL: true,
+	}
+
+	errorClasses = map[string]bool{
+		ERROR_CLASS_FAILED:        true,
+		ERROR_CLASS_TIMED_OUT:     true,
+		ERROR_CLASS_EXECUTOR_LOST: true,
+	}
+)
+
+type RetryPolicy struct {
+	// Max number of runs per fire, including the first one. 0 or 1 means no retries
+	MaxAttempts int `codec:"maxAttempts,omitempty"`
+	// Time to wait before running a failed job again, the base of the backoff
+	TimeBetweenAttempts time.Duration `codec:"timeBetweenAttempts,omitempty"`
+	// How the time between attempts grows, one of BACKOFF_*. Fixed if empty
+	Backoff string `codec:"backoff,omitempty"`
+	// Upper bound of the time between attempts, none if 0
+	MaxTimeBetweenAttempts time.Duration `codec:"maxTimeBetweenAttempts,omitempty"`
+	// Fraction of the time between attempts taken off at random, from 0 to 1, so the
+	// runs failing together are not retried together
+	Jitter float64 `codec:"jitter,omitempty"`
+	// Error classes retried, one of ERROR_CLASS_*. All of them if empty
+	RetryOn []string `codec:"retryOn,omitempty"`
+	// Exit codes of the failed attempts retried. All of them if empty
+	RetryableExitCodes []int `codec:"retryableExitCodes,omitempty"`
+}
+
+// Attempts returns the max number of runs per fire
+func (r *RetryPolicy) Attempts() int {
+	if r.MaxAttempts < 1 {
+		return 1
+	}
+	return r.MaxAttempts
+}
+
+// Retryable tells whether an attempt failed for the given reason, one of ERROR_CLASS_*,
+// can be retried. exitCode is only checked for failed attempts that exited.
+func (r *RetryPolicy) Retryable(class string, exitCode int) bool {
+	if len(r.RetryOn) > 0 && !contains(r.RetryOn, class) {
+		return false
+	}
+	if class != ERROR_CLASS_FAILED || exitCode == 0 || len(r.RetryableExitCodes) == 0 {
+		return true
+	}
+	for _, code := range r.RetryableExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the time to wait after the given attempt (from 1) failed. random, from 0
+// to 1, tells how much of the jitter is taken off.
+func (r *RetryPolicy) Delay(attempt int, random float64) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := r.TimeBetweenAttempts
+	switch r.Backoff {
+	case BACKOFF_LINEAR:
+		d = r.grow(d, int64(attempt))
+	case BACKOFF_EXPONENTIAL:
+		for i := 1; i < attempt && (r.MaxTimeBetweenAttempts == 0 || d < r.MaxTimeBetweenAttempts); i++ {
+			d = r.grow(d, 2)
+		}
+	}
+	if r.MaxTimeBetweenAttempts > 0 && d > r.MaxTimeBetweenAttempts {
+		d = r.MaxTimeBetweenAttempts
+	}
+	return d - time.Duration(float64(d)*r.Jitter*random)
+}
+
+// grow multiplies d by n, saturating rather than overflowing
+func (r *RetryPolicy) grow(d time.Duration, n int64) time.Duration {
+	const max = time.Duration(1<<63 - 1)
+	if d > 0 && n > int64(max/d) {
+		return max
+	}
+	return d * time.Duration(n)
+}
+
+func (r *RetryPolicy) validate() error {
+	if r.MaxAttempts < 0 {
+		return invalid("retry.maxAttempts", "can not be negative")
+	}
+	if r.TimeBetweenAttempts < 0 {
+		return invalid("retry.timeBetweenAttempts", "can not be negative")
+	}
+	if r.Backoff != "" && !backoffs[r.Backoff] {
+		return invalid("retry.backoff", "unknown backoff [%s]", r.Backoff)
+	}
+	if r.MaxTimeBetweenAttempts < 0 {
+		return invalid("retry.maxTimeBetweenAttempts", "can not be negative")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return invalid("retry.jitter", "must be between 0 and 1, got %g", r.Jitter)
+	}
+	for _, class := range r.RetryOn {
+		if !errorClasses[class] {
+			return invalid("retry.retryOn", "unknown error class [%s]", class)
+		}
+	}
+	for _, code := range r.RetryableExitCodes {
+		if code < 1 || code > 255 {
+			return invalid("retry.retryableExitCodes", "[%d] is not a failed exit code", code)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package job_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+func TestDelay(t *testing.T) {
+	cases := []struct {
+		backoff  string
+		expected []time.Duration
+	}{
+		{job.BACKOFF_FIXED, []time.Duration{10 * time.Second, 10 * time.Second, 10 * time.Second, 10 * time.Second}},
+		{job.BACKOFF_LINEAR, []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 40 * time.Second}},
+		{job.BACKOFF_EXPONENTIAL, []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 45 * time.Second}},
+	}
+	for _, c := range cases {
+		r := job.RetryPolicy{TimeBetweenAttempts: 10 * time.Second, Backoff: c.backoff, MaxTimeBetweenAttempts: 45 * time.Second}
+		for i, expected := range c.expected {
+			if d := r.Delay(i+1, 0.5); d != expected {
+				t.Errorf("Expected [%s] after attempt %d (%s). Observed [%s]", expected, i+1, c.backoff, d)
+			}
+		}
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+	r := job.RetryPolicy{TimeBetweenAttempts: 10 * time.Second, Jitter: 0.2}
+	for random, expected := range map[float64]time.Duration{0: 10 * time.Second, 0.5: 9 * time.Second, 1: 8 * time.Second} {
+		if d := r.Delay(1, random); d != expected {
+			t.Errorf("Expected [%s] with random %g. Observed [%s]", expected, random, d)
+		}
+	}
+}
+
+func TestDelayOverflow(t *testing.T) {
+	r := job.RetryPolicy{TimeBetweenAttempts: time.Hour, Backoff: job.BACKOFF_EXPONENTIAL}
+	if d := r.Delay(100, 0); d <= 0 {
+		t.Errorf("Expected delay not to overflow. Observed [%s]", d)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	r := job.RetryPolicy{
+		RetryOn:            []string{job.ERROR_CLASS_FAILED, job.ERROR_CLASS_EXECUTOR_LOST},
+		RetryableExitCodes: []int{75},
+	}
+	cases := []struct {
+		class    string
+		exitCode int
+		expected bool
+	}{
+		{job.ERROR_CLASS_FAILED, 75, true},
+		{job.ERROR_CLASS_FAILED, 1, false},
+		// failed without exiting, i.e. could not be started
+		{job.ERROR_CLASS_FAILED, 0, true},
+		{job.ERROR_CLASS_EXECUTOR_LOST, 0, true},
+		{job.ERROR_CLASS_TIMED_OUT, 0, false},
+	}
+	for _, c := range cases {
+		if retryable := r.Retryable(c.class, c.exitCode); retryable != c.expected {
+			t.Errorf("Expected retryable [%t] for %s with exit code %d. Observed [%t]", c.expected, c.class, c.exitCode, retryable)
+		}
+	}
+
+	if !(&job.RetryPolicy{}).Retryable(job.ERROR_CLASS_TIMED_OUT, 0) {
+		t.Errorf("Expected every error to be retryable by default")
+	}
+}
@@ -0,0 +1,162 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jteso/xchronos/store"
+)
+
+const (
+	JOBS_DIR = "/xchronos/etc/jobs"
+)
+
+var (
+	ErrJobNotFound = errors.New("Job not found")
+	ErrJobExists   = errors.New("Job already exists")
+	ErrJobModified = errors.New("Job has been modified since it was read")
+)
+
+// ListError reports the jobs List could not decode, by key
+type ListError struct {
+	Errors map[string]error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("%d jobs could not be decoded", len(e.Errors))
+}
+
+// Key returns the job store key where a job is stored
+func Key(id string) string {
+	return JOBS_DIR + "/" + id
+}
+
+// Create validates and stores a new job
+func Create(s store.JobStore, j *Job) error {
+	if j.SchemaVersion == 0 {
+		j.SchemaVersion = SCHEMA_VERSION
+	}
+	if err := j.Validate(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	j.CreatedAt = now
+	j.UpdatedAt = now
+	value, err := Encode(j, ENCODING_FORMAT)
+	if err != nil {
+		return err
+	}
+
+	r, err := s.Create(Key(j.ID), value, 0)
+	if err != nil {
+		if store.IsNodeExist(err) {
+			return ErrJobExists
+		}
+		return err
+	}
+	j.index = r.Node.ModifiedIndex
+	return nil
+}
+
+// Get reads a job from the job store
+func Get(s store.JobStore, id string) (*Job, error) {
+	n, err := s.Get(Key(id), false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+	return FromNode(n)
+}
+
+// Update validates and stores a job previously read via Get or List. It fails with
+// ErrJobModified if the job has been changed by somebody else in the meantime.
+func Update(s store.JobStore, j *Job) error {
+	if err := j.Validate(); err != nil {
+		return err
+	}
+	if j.index == 0 {
+		// never read, so there is nothing to compare against
+		return ErrJobModified
+	}
+
+	j.SchemaVersion = SCHEMA_VERSION
+	j.UpdatedAt = time.Now().UTC()
+	value, err := Encode(j, ENCODING_FORMAT)
+	if err != nil {
+		return err
+	}
+
+	r, err := s.CompareAndSwap(Key(j.ID), value, 0, "", j.index)
+	if err != nil {
+		switch {
+		case store.IsKeyNotFound(err):
+			return ErrJobNotFound
+		case store.IsTestFailed(err):
+			return ErrJobModified
+		}
+		return err
+	}
+	j.index = r.Node.ModifiedIndex
+	return nil
+}
+
+// Delete removes a job from the job store
+func Delete(s store.JobStore, id string) error {
+	_, err := s.Delete(Key(id), false)
+	if store.IsKeyNotFound(err) {
+		return ErrJobNotFound
+	}
+	return err
+}
+
+// List returns all the jobs in the job store, sorted by id. Jobs that cannot be decoded
+// are left out, reported by a *ListError returned along with the others.
+func List(s store.JobStore) ([]*Job, error) {
+	nodes, err := s.List(JOBS_DIR, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Job{}, nil
+		}
+		return nil, err
+	}
+
+	jobs := []*Job{}
+	var invalid *ListError
+	for _, n := range nodes {
+		if n.Dir {
+			continue
+		}
+		j, err := FromNode(n)
+		if err != nil {
+			if invalid == nil {
+				invalid = &ListError{Errors: map[string]error{}}
+			}
+			invalid.Errors[n.Key] = err
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if invalid != nil {
+		return jobs, invalid
+	}
+	return jobs, nil
+}
+
+// Index returns the store index the job was read or written at, 0 if it has not been stored yet
+func (j *Job) Index() uint64 {
+	return j.index
+}
+
+// FromNode decodes a job read from the job store, i.e. received via Watch
+func FromNode(n *store.Node) (*Job, error) {
+	j, err := Decode(n.Value)
+	if err != nil {
+		return nil, err
+	}
+	j.index = n.ModifiedIndex
+	return j, nil
+}
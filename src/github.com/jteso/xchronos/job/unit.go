@@ -0,0 +1,397 @@
+package job
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Section of the unit files holding the scheduling of the job
+	UNIT_SECTION = "X-Chronos"
+	// Marker of the required keys, i.e. JobStore=etcd (*)
+	UNIT_REQUIRED_MARKER = "(*)"
+)
+
+var (
+	// Job stores a unit can be submitted to, as in the -job-store flag of the agent
+	unitJobStores = map[string]bool{"etcd": true, "consul": true, "memory": true}
+)
+
+// Unit is a job read from a systemd/fleet unit file with an [X-Chronos] section
+type Unit struct {
+	// Job store the job is meant for
+	JobStore string
+	Job      *Job
+}
+
+// UnitError reports an invalid unit file, at the given line if known
+type UnitError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *UnitError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// unitKey tells how a key of the [X-Chronos] section is read into a job
+type unitKey struct {
+	required bool
+	// field of the job, as reported by Validate
+	field string
+	set   func(u *Unit, value string) error
+}
+
+var unitKeys = map[string]unitKey{
+	"JobStore": {required: true, set: func(u *Unit, value string) error {
+		if !unitJobStores[value] {
+			return fmt.Errorf("unknown job store [%s], one of etcd, consul or memory", value)
+		}
+		u.JobStore = value
+		return nil
+	}},
+	"TriggerStartDelay": {field: "trigger.startDelay", set: func(u *Unit, value string) (err error) {
+		u.Job.Trigger.StartDelay, err = parseMillis(value)
+		return err
+	}},
+	"TriggerRepeatInterval": {field: "trigger.repeatInterval", set: func(u *Unit, value string) (err error) {
+		u.Job.Trigger.RepeatInterval, err = parseMillis(value)
+		return err
+	}},
+	"TriggerRepeatCount": {required: true, field: "trigger.repeatCount", set: func(u *Unit, value string) (err error) {
+		u.Job.Trigger.RepeatCount, err = strconv.Atoi(value)
+		return err
+	}},
+	"TriggerCron": {field: "trigger.cronExpression", set: func(u *Unit, value string) error {
+		u.Job.Trigger.Type = TRIGGER_CRON
+		u.Job.Trigger.CronExpression = value
+		return nil
+	}},
+	"MisfirePolicy": {field: "misfirePolicy", set: func(u *Unit, value string) error {
+		if !misfirePolicies[value] {
+			return fmt.Errorf("unknown policy [%s]", value)
+		}
+		u.Job.MisfirePolicy = value
+		return nil
+	}},
+	"MaxAttempts": {field: "retry.maxAttempts", set: func(u *Unit, value string) (err error) {
+		u.Job.Retry.MaxAttempts, err = strconv.Atoi(value)
+		return err
+	}},
+	// sic, as in the first unit files around
+	"TimeBeetweenAttempts": {field: "retry.timeBetweenAttempts", set: func(u *Unit, value string) (err error) {
+		u.Job.Retry.TimeBetweenAttempts, err = parseMillis(value)
+		return err
+	}},
+	"Availability": {field: "availability", set: func(u *Unit, value string) (err error) {
+		u.Job.Availability, err = strconv.Atoi(value)
+		return err
+	}},
+	"SuccessPolicy": {field: "successPolicy", set: func(u *Unit, value string) error {
+		u.Job.SuccessPolicy = value
+		return nil
+	}},
+	"ShortagePolicy": {field: "shortagePolicy", set: func(u *Unit, value string) error {
+		u.Job.ShortagePolicy = value
+		return nil
+	}},
+}
+
+func init() {
+	unitKeys["TimeBetweenAttempts"] = unitKeys["TimeBeetweenAttempts"]
+}
+
+// unitLine is a key of a unit file, and the line it was found at
+type unitLine struct {
+	line  int
+	key   string
+	value string
+}
+
+// ParseUnit reads a unit file into a job, named after the file (i.e. backup.service is
+// the job backup). The [X-Chronos] section tells when the job runs, the ExecStartPre,
+// ExecStart and ExecStop lines of the [Service] section make up the command it runs, and
+// the [X-Fleet] section where it runs. Other sections and keys are ignored.
+func ParseUnit(name string, r io.Reader) (*Unit, error) {
+	fail := func(line int, format string, v ...interface{}) error {
+		return &UnitError{File: name, Line: line, Message: fmt.Sprintf(format, v...)}
+	}
+	sections, err := readUnit(name, r)
+	if err != nil {
+		return nil, err
+	}
+	chronos, found := sections[UNIT_SECTION]
+	if !found {
+		return nil, fail(0, "no [%s] section", UNIT_SECTION)
+	}
+
+	u := &Unit{Job: New(strings.TrimSuffix(path.Base(name), path.Ext(name)))}
+	u.Job.Trigger.Type = TRIGGER_SIMPLE
+	for _, l := range sections["Unit"] {
+		if l.key == "Description" {
+			u.Job.Name = l.value
+		}
+	}
+	// line every field of the job was read from, to report validation errors
+	lines := map[string]int{}
+	seen := map[string]int{}
+	for _, l := range chronos {
+		k, known := unitKeys[l.key]
+		if !known {
+			return nil, fail(l.line, "unknown key [%s]", l.key)
+		}
+		if first, dup := seen[l.key]; dup {
+			return nil, fail(l.line, "duplicate key [%s], first set at line %d", l.key, first)
+		}
+		seen[l.key] = l.line
+		value := l.value
+		if strings.HasSuffix(value, UNIT_REQUIRED_MARKER) {
+			if !k.required {
+				return nil, fail(l.line, "%s marks required keys only, [%s] is optional", UNIT_REQUIRED_MARKER, l.key)
+			}
+			value = strings.TrimSpace(strings.TrimSuffix(value, UNIT_REQUIRED_MARKER))
+		}
+		if err := k.set(u, value); err != nil {
+			return nil, fail(l.line, "invalid %s: %s", l.key, unitCause(err))
+		}
+		lines[k.field] = l.line
+	}
+	if _, found := seen["JobStore"]; !found {
+		return nil, fail(0, "missing required key [JobStore]")
+	}
+	_, cron := seen["TriggerCron"]
+	_, count := seen["TriggerRepeatCount"]
+	_, interval := seen["TriggerRepeatInterval"]
+	switch {
+	case cron && (count || interval):
+		// cron jobs fire as long as the expression matches, there is nothing to repeat
+		other := "TriggerRepeatCount"
+		if !count {
+			other = "TriggerRepeatInterval"
+		}
+		return nil, fail(seen["TriggerCron"], "TriggerCron replaces TriggerRepeatInterval and TriggerRepeatCount, remove %s set at line %d", other, seen[other])
+	case !cron && !count:
+		return nil, fail(0, "missing required key [TriggerRepeatCount]")
+	}
+
+	if err := u.Job.readFleet(sections["X-Fleet"], lines); err != nil {
+		if ue, ok := err.(*UnitError); ok {
+			ue.File = name
+		}
+		return nil, err
+	}
+	if err := u.Job.Executor.readService(sections["Service"], lines); err != nil {
+		if ue, ok := err.(*UnitError); ok {
+			ue.File = name
+		}
+		return nil, err
+	}
+	if err := u.Job.Validate(); err != nil {
+		if ve, ok := err.(*ValidationError); ok {
+			return nil, fail(lines[ve.Field], "%s", ve.Error())
+		}
+		return nil, fail(0, "%s", err.Error())
+	}
+	return u, nil
+}
+
+// readFleet turns the fleet scheduling keys of a unit into constraints: MachineMetadata
+// into labels the executors have, any of the values given for a label, and Conflicts
+// into anti-affinity with other jobs
+func (j *Job) readFleet(fleet []unitLine, lines map[string]int) error {
+	labels := []string{}
+	values := map[string][]string{}
+	conflicts := []string{}
+	for _, l := range fleet {
+		switch l.key {
+		case "MachineMetadata":
+			for _, pair := range splitQuoted(l.value) {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return &UnitError{Line: l.line, Message: fmt.Sprintf("invalid MachineMetadata: [%s] must be key=value", pair)}
+				}
+				if _, found := values[kv[0]]; !found {
+					labels = append(labels, kv[0])
+				}
+				values[kv[0]] = append(values[kv[0]], kv[1])
+			}
+		case "Conflicts":
+			for _, unit := range splitQuoted(l.value) {
+				if strings.ContainsAny(unit, "*?[") {
+					return &UnitError{Line: l.line, Message: fmt.Sprintf("invalid Conflicts: [%s] globs are not supported", unit)}
+				}
+				conflicts = append(conflicts, strings.TrimSuffix(unit, path.Ext(unit)))
+			}
+		default:
+			continue
+		}
+		lines["constraints"] = l.line
+	}
+	for _, label := range labels {
+		c := Constraint{Label: label, Operator: CONSTRAINT_EQUALS, Values: values[label]}
+		if len(c.Values) > 1 {
+			c.Operator = CONSTRAINT_IN
+		}
+		j.Constraints = append(j.Constraints, c)
+	}
+	if len(conflicts) > 0 {
+		j.Constraints = append(j.Constraints, Constraint{Operator: CONSTRAINT_ANTI_AFFINITY, Values: conflicts})
+	}
+	return nil
+}
+
+// readService makes up the command of a job out of the [Service] section of its unit.
+// ExecStop lines run once ExecStart exits, whether it failed or not.
+func (e *ExecutorSpec) readService(service []unitLine, lines map[string]int) error {
+	e.Type = EXECUTOR_COMMAND
+	var pre, start, stop []string
+	startLine := 0
+	for _, l := range service {
+		switch l.key {
+		case "ExecStartPre":
+			pre = append(pre, execLine(l.value))
+		case "ExecStart":
+			if startLine != 0 {
+				return &UnitError{Line: l.line, Message: fmt.Sprintf("duplicate key [ExecStart], first set at line %d", startLine)}
+			}
+			startLine = l.line
+			start = append(start, execLine(l.value))
+		case "ExecStop":
+			stop = append(stop, execLine(l.value))
+		case "Environment":
+			for _, pair := range splitQuoted(l.value) {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					return &UnitError{Line: l.line, Message: fmt.Sprintf("invalid Environment: [%s] must be NAME=value", pair)}
+				}
+				if e.Env == nil {
+					e.Env = map[string]string{}
+				}
+				e.Env[kv[0]] = kv[1]
+			}
+		case "WorkingDirectory":
+			e.Dir = l.value
+		case "User":
+			e.User = l.value
+		}
+	}
+	if startLine == 0 {
+		return &UnitError{Message: "missing required key [ExecStart] in the [Service] section"}
+	}
+	lines["executor.command"] = startLine
+
+	script := []string{"set -e"}
+	if len(stop) > 0 {
+		script = append(script, "trap '"+strings.Replace(strings.Join(stop, "; "), "'", `'\''`, -1)+"' EXIT")
+	}
+	script = append(script, pre...)
+	e.Command = strings.Join(append(script, start...), "\n")
+	return nil
+}
+
+// execLine returns the shell line of an Exec* key, whose failure is ignored when
+// prefixed with '-'. The other systemd prefixes do not apply.
+func execLine(value string) string {
+	ignoreFailure := false
+	for len(value) > 0 && strings.ContainsRune("-@+!:", rune(value[0])) {
+		ignoreFailure = ignoreFailure || value[0] == '-'
+		value = value[1:]
+	}
+	if ignoreFailure {
+		return value + " || true"
+	}
+	return value
+}
+
+// readUnit reads the keys of a unit file by section, in order. Lines ending with '\'
+// go on in the next one.
+func readUnit(name string, r io.Reader) (map[string][]unitLine, error) {
+	sections := map[string][]unitLine{}
+	section := ""
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line, start := strings.TrimSpace(scanner.Text()), n
+		for strings.HasSuffix(line, `\`) && scanner.Scan() {
+			n++
+			line = strings.TrimSpace(strings.TrimSuffix(line, `\`)) + " " + strings.TrimSpace(scanner.Text())
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, &UnitError{File: name, Line: start, Message: fmt.Sprintf("invalid section header %s", line)}
+			}
+			section = line[1 : len(line)-1]
+			if _, found := sections[section]; !found {
+				sections[section] = nil
+			}
+		default:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, &UnitError{File: name, Line: start, Message: fmt.Sprintf("expected key=value, got [%s]", line)}
+			}
+			if section == "" {
+				return nil, &UnitError{File: name, Line: start, Message: "key outside of any section"}
+			}
+			sections[section] = append(sections[section], unitLine{line: start, key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1])})
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// splitQuoted splits a value into words, as in Environment="A=1" "B=2 3"
+func splitQuoted(value string) []string {
+	words := []string{}
+	var word strings.Builder
+	quote, inWord := rune(0), false
+	for _, c := range value {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// parseMillis parses a number of milliseconds, as in the unit files, or a duration (i.e. 10s)
+func parseMillis(value string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// unitCause strips the details of the strconv errors
+func unitCause(err error) string {
+	if ne, ok := err.(*strconv.NumError); ok {
+		return fmt.Sprintf("[%s] is not a number", ne.Num)
+	}
+	return err.Error()
+}
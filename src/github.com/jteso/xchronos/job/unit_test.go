@@ -0,0 +1,128 @@
+package job_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+const apacheUnit = `[Unit]
+Description=My Apache Frontend
+After=docker.service
+Requires=docker.service
+
+[Service]
+TimeoutStartSec=0
+Environment="GREETING=hello world" PORT=80
+ExecStartPre=-/usr/bin/docker kill apache1
+ExecStartPre=-/usr/bin/docker rm apache1
+ExecStartPre=/usr/bin/docker pull coreos/apache
+ExecStart=/usr/bin/docker run -rm --name apache1 -p 80:80 \
+  coreos/apache /usr/sbin/apache2ctl -D FOREGROUND
+ExecStop=/usr/bin/docker stop apache1
+
+[X-Fleet]
+MachineMetadata="region=us-east-1" "diskType=SSD"
+MachineMetadata=region=us-west-1
+Conflicts=apache2.service
+
+[X-Chronos]
+JobStore=etcd (*)
+
+TriggerStartDelay=10000
+TriggerRepeatInterval=2000
+TriggerRepeatCount=-1 (*)
+
+MisfirePolicy=MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT
+MaxAttempts=3
+TimeBeetweenAttempts=10000
+Availability=2
+`
+
+func TestParseUnit(t *testing.T) {
+	u, err := job.ParseUnit("units/apache.service", strings.NewReader(apacheUnit))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	j := u.Job
+	if u.JobStore != "etcd" || j.ID != "apache" || j.Name != "My Apache Frontend" {
+		t.Errorf("Expected job apache on etcd. Observed: %+v %+v", u, j)
+	}
+	expected := job.TriggerSpec{Type: job.TRIGGER_SIMPLE, StartDelay: 10 * time.Second, RepeatInterval: 2 * time.Second, RepeatCount: -1}
+	if j.Trigger.Type != expected.Type || j.Trigger.StartDelay != expected.StartDelay || j.Trigger.RepeatInterval != expected.RepeatInterval || j.Trigger.RepeatCount != expected.RepeatCount {
+		t.Errorf("Expected trigger %+v. Observed %+v", expected, j.Trigger)
+	}
+	if j.MisfirePolicy != job.MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT || j.Availability != 2 {
+		t.Errorf("Expected misfire policy and availability to be set. Observed: %+v", j)
+	}
+	if j.Retry.MaxAttempts != 3 || j.Retry.TimeBetweenAttempts != 10*time.Second {
+		t.Errorf("Expected [3] attempts [10s] apart. Observed %+v", j.Retry)
+	}
+
+	command := strings.Join([]string{
+		"set -e",
+		"trap '/usr/bin/docker stop apache1' EXIT",
+		"/usr/bin/docker kill apache1 || true",
+		"/usr/bin/docker rm apache1 || true",
+		"/usr/bin/docker pull coreos/apache",
+		"/usr/bin/docker run -rm --name apache1 -p 80:80 coreos/apache /usr/sbin/apache2ctl -D FOREGROUND",
+	}, "\n")
+	if j.Executor.Type != job.EXECUTOR_COMMAND || j.Executor.Command != command {
+		t.Errorf("Expected command [%s]. Observed [%s]", command, j.Executor.Command)
+	}
+	if j.Executor.Env["GREETING"] != "hello world" || j.Executor.Env["PORT"] != "80" {
+		t.Errorf("Expected environment to be set. Observed %v", j.Executor.Env)
+	}
+	constraints := []job.Constraint{
+		{Label: "region", Operator: job.CONSTRAINT_IN, Values: []string{"us-east-1", "us-west-1"}},
+		{Label: "diskType", Operator: job.CONSTRAINT_EQUALS, Values: []string{"SSD"}},
+		{Operator: job.CONSTRAINT_ANTI_AFFINITY, Values: []string{"apache2"}},
+	}
+	if !reflect.DeepEqual(j.Constraints, constraints) {
+		t.Errorf("Expected constraints %v. Observed %v", constraints, j.Constraints)
+	}
+}
+
+func TestParseUnitCron(t *testing.T) {
+	unit := "[Service]\nExecStart=/usr/bin/backup\n[X-Chronos]\nJobStore=consul\nTriggerCron=0 0 3 * * *\n"
+	u, err := job.ParseUnit("backup.service", strings.NewReader(unit))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if u.Job.Trigger.Type != job.TRIGGER_CRON || u.Job.Trigger.CronExpression != "0 0 3 * * *" {
+		t.Errorf("Expected cron trigger. Observed %+v", u.Job.Trigger)
+	}
+}
+
+func TestParseUnitErrors(t *testing.T) {
+	service := "[Service]\nExecStart=/usr/bin/backup\n"
+	tests := map[string]string{
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\nColour=blue\n":                 "backup.service:6: unknown key [Colour]",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\nJobStore=consul\n":             "backup.service:6: duplicate key [JobStore], first set at line 4",
+		service + "[X-Chronos]\nJobStore=zookeeper\nTriggerRepeatCount=0\n":                         "backup.service:4: invalid JobStore: unknown job store [zookeeper], one of etcd, consul or memory",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\nMaxAttempts=3 (*)\n":           "backup.service:6: (*) marks required keys only, [MaxAttempts] is optional",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=many\n":                           "backup.service:5: invalid TriggerRepeatCount: [many] is not a number",
+		service + "[X-Chronos]\nTriggerRepeatCount=0\n":                                             "backup.service: missing required key [JobStore]",
+		service + "[X-Chronos]\nJobStore=etcd\n":                                                    "backup.service: missing required key [TriggerRepeatCount]",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\nTriggerCron=@daily\n":          "backup.service:6: TriggerCron replaces TriggerRepeatInterval and TriggerRepeatCount, remove TriggerRepeatCount set at line 5",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerCron=@daily\nTriggerRepeatInterval=2000\n":    "backup.service:5: TriggerCron replaces TriggerRepeatInterval and TriggerRepeatCount, remove TriggerRepeatInterval set at line 6",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\nAvailability=0\n":              "backup.service:6: Invalid job availability: must be at least 1, got 0",
+		service + "[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=-1\nTriggerRepeatInterval=-5\n":   "backup.service:6: Invalid job trigger.repeatInterval: must be positive for repeating jobs",
+		"[Service]\nExecStart=/a\nExecStart=/b\n[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\n": "backup.service:3: duplicate key [ExecStart], first set at line 2",
+		"[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\n":                                        "backup.service: missing required key [ExecStart] in the [Service] section",
+		service:           "backup.service: no [X-Chronos] section",
+		"JobStore=etcd\n": "backup.service:1: key outside of any section",
+		service + "[X-Fleet]\nConflicts=apache*\n[X-Chronos]\nJobStore=etcd\nTriggerRepeatCount=0\n": "backup.service:4: invalid Conflicts: [apache*] globs are not supported",
+		service + "[X-Chronos\n":            "backup.service:3: invalid section header [X-Chronos",
+		service + "[X-Chronos]\nJobStore\n": "backup.service:4: expected key=value, got [JobStore]",
+	}
+	for unit, expected := range tests {
+		_, err := job.ParseUnit("backup.service", strings.NewReader(unit))
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected [%s]. Observed: %v", expected, err)
+		}
+	}
+}
@@ -4,15 +4,26 @@ import (
 	"flag"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/jteso/xchronos/agent"
+	"github.com/jteso/xchronos/store"
 
 	"fmt"
 	"time"
+	// job time zones do not depend on the tz database of the host
+	_ "time/tzdata"
 )
 
 const (
-	FLAG_ETCD_NODES = "etcd-nodes"
+	FLAG_JOB_STORE   = "job-store"
+	FLAG_ETCD_NODES  = "etcd-nodes"
+	FLAG_CONSUL_ADDR = "consul-addr"
+	FLAG_STANDALONE  = "standalone"
+	FLAG_DATA_DIR    = "data-dir"
+	FLAG_METADATA    = "metadata"
+	FLAG_CAPACITY    = "capacity"
 )
 
 func main() {
@@ -23,25 +34,105 @@ func main() {
 func parseFlags() map[string]string {
 	result := make(map[string]string)
 
+	jobStore := flag.String(FLAG_JOB_STORE, "etcd", "Job store used to coordinate the agents: etcd, consul or memory")
 	etcdNodes := flag.String(FLAG_ETCD_NODES, "", "Comma separated list of etcd nodes")
+	consulAddr := flag.String(FLAG_CONSUL_ADDR, "http://127.0.0.1:8500", "Address of the consul agent")
+	standalone := flag.Bool(FLAG_STANDALONE, false, "Run a single agent persisting its state into -data-dir, no job store cluster needed")
+	dataDir := flag.String(FLAG_DATA_DIR, "xchronos-data", "Directory where the job store is persisted on standalone mode")
+	metadata := flag.String(FLAG_METADATA, "", "Comma separated list of labels of the agents, checked against the job constraints, i.e. region=us-east-1,diskType=SSD")
+	capacity := flag.Int(FLAG_CAPACITY, 0, "Capacity slots of the agents, taken by the runs as their jobs tell. Unlimited if 0")
 	flag.Parse()
 
+	result[FLAG_JOB_STORE] = *jobStore
 	result[FLAG_ETCD_NODES] = *etcdNodes
+	result[FLAG_CONSUL_ADDR] = *consulAddr
+	result[FLAG_STANDALONE] = strconv.FormatBool(*standalone)
+	result[FLAG_DATA_DIR] = *dataDir
+	result[FLAG_METADATA] = *metadata
+	result[FLAG_CAPACITY] = strconv.Itoa(*capacity)
 	return result
 }
 
+// parseMetadata parses labels given as key=value pairs, separated by commas
+func parseMetadata(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid metadata [%s], expected key=value", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+func newJobStore(flags map[string]string) (store.JobStore, error) {
+	if flags[FLAG_STANDALONE] == "true" {
+		fileStore, err := store.NewFileStore(flags[FLAG_DATA_DIR])
+		if err != nil {
+			return nil, err
+		}
+		return fileStore, nil
+	}
+
+	switch flags[FLAG_JOB_STORE] {
+	case "etcd":
+		return store.NewEtcdStore(strings.Split(flags[FLAG_ETCD_NODES], ",")), nil
+	case "consul":
+		return store.NewConsulStore(flags[FLAG_CONSUL_ADDR]), nil
+	case "memory":
+		// only useful to try out the agents running within this process
+		return store.NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("Unknown job store: %s", flags[FLAG_JOB_STORE])
+}
+
 func realMain() int {
 	flags := parseFlags()
+	labels, err := parseMetadata(flags[FLAG_METADATA])
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+
+	jobStore, err := newJobStore(flags)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer jobStore.Close()
 
-	a1 := agent.New("agent_1", []string{flags[FLAG_ETCD_NODES]}, true)
-	a2 := agent.New("agent_2", []string{flags[FLAG_ETCD_NODES]}, true)
+	agentIds := []string{"agent_1", "agent_2"}
+	if flags[FLAG_STANDALONE] == "true" {
+		agentIds = agentIds[:1]
+	}
 
-	go a1.Run()
-	go a2.Run()
+	agents := []*agent.Agent{}
+	for i, id := range agentIds {
+		agentStore := jobStore
+		if i > 0 && flags[FLAG_JOB_STORE] != "memory" {
+			// keys with a TTL are hold by the store writing them (see store.ConsulStore),
+			// so every agent gets its own
+			if agentStore, err = newJobStore(flags); err != nil {
+				fmt.Println(err.Error())
+				return 1
+			}
+			defer agentStore.Close()
+		}
+		a := agent.New(id, agentStore, true)
+		a.Labels = labels
+		a.Capacity, _ = strconv.Atoi(flags[FLAG_CAPACITY])
+		agents = append(agents, a)
+		go a.Run()
+	}
 
 	time.Sleep(10 * time.Second)
-	a1.Stop()
-	a2.Stop()
+	for _, a := range agents {
+		a.Stop()
+	}
 
 	fmt.Println("System halted successfully :)")
 	return 0
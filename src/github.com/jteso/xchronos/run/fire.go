@@ -0,0 +1,240 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	FIRES_DIR = "/xchronos/var/fires"
+)
+
+// Fire statuses
+const (
+	FIRE_RUNNING   = "running"
+	FIRE_SUCCEEDED = "succeeded"
+	FIRE_FAILED    = "failed"
+)
+
+var (
+	ErrFireNotFound = errors.New("Fire not found")
+	ErrFireExists   = errors.New("Fire already exists")
+	ErrFireModified = errors.New("Fire has been modified since it was read")
+)
+
+// Fire groups the runs of a job fired at a given time, one per executor the job is run
+// by (see job.Availability). It is stored under FIRES_DIR/<fire_id>, and settled as the
+// success policy of the job tells once enough of its runs have finished.
+type Fire struct {
+	ID    string `codec:"id"`
+	JobID string `codec:"jobId"`
+	// Time the job was due
+	FireTime time.Time `codec:"fireTime"`
+	// Number of executors asked for by the job
+	Availability int `codec:"availability"`
+	// One of job.SUCCESS_*
+	SuccessPolicy string `codec:"successPolicy"`
+	// Runs of the replicas, fewer than Availability if run degraded
+	Runs []string `codec:"runs"`
+	// One of FIRE_*
+	Status    string `codec:"status"`
+	Succeeded int    `codec:"succeeded"`
+	Failed    int    `codec:"failed"`
+	// Why the fire failed
+	Error string `codec:"error,omitempty"`
+
+	CreatedAt  time.Time `codec:"createdAt"`
+	FinishedAt time.Time `codec:"finishedAt,omitempty"`
+
+	// store index the fire was read at, used to detect concurrent updates
+	index uint64
+}
+
+// NewFire returns the fire of a job at fireTime, run by the given number of replicas
+func NewFire(j *job.Job, fireTime time.Time, replicas int) *Fire {
+	f := &Fire{
+		ID:            ID(j.ID, fireTime),
+		JobID:         j.ID,
+		FireTime:      fireTime,
+		Availability:  j.Availability,
+		SuccessPolicy: j.SuccessPolicy,
+		Runs:          []string{},
+		Status:        FIRE_RUNNING,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if f.SuccessPolicy == "" {
+		f.SuccessPolicy = job.SUCCESS_ALL
+	}
+	for i := 1; i <= replicas; i++ {
+		f.Runs = append(f.Runs, ReplicaID(f.ID, i))
+	}
+	return f
+}
+
+func FireKey(id string) string {
+	return FIRES_DIR + "/" + id
+}
+
+// Active tells whether the fire has not been settled yet
+func (f *Fire) Active() bool {
+	return f.Status == FIRE_RUNNING
+}
+
+// needed returns the number of runs succeeding for the fire to succeed
+func (f *Fire) needed() int {
+	switch f.SuccessPolicy {
+	case job.SUCCESS_ANY:
+		return 1
+	case job.SUCCESS_QUORUM:
+		return len(f.Runs)/2 + 1
+	}
+	return len(f.Runs)
+}
+
+// Settle counts the runs of the fire finished, settling it as soon as its outcome is
+// known: i.e. a single run failing fails a fire needing all of them, while the rest may
+// be running still. It tells whether the fire has just been settled.
+func (f *Fire) Settle(runs []*Run, at time.Time) bool {
+	if !f.Active() {
+		return false
+	}
+	f.Succeeded, f.Failed = 0, 0
+	for _, r := range runs {
+		switch {
+		case r.Status == RUN_SUCCEEDED:
+			f.Succeeded++
+		case !r.Active():
+			f.Failed++
+		}
+	}
+	needed := f.needed()
+	switch {
+	case f.Succeeded >= needed:
+		f.Status = FIRE_SUCCEEDED
+	case f.Failed > len(f.Runs)-needed:
+		f.Status = FIRE_FAILED
+		f.Error = fmt.Sprintf("%d of %d runs failed, %d needed to succeed (%s)", f.Failed, len(f.Runs), needed, f.SuccessPolicy)
+	default:
+		return false
+	}
+	f.FinishedAt = at
+	return true
+}
+
+// Fail settles the fire as failed before running it, i.e. not enough executors alive
+func (f *Fire) Fail(cause error, at time.Time) {
+	f.Status = FIRE_FAILED
+	f.Error = cause.Error()
+	f.FinishedAt = at
+}
+
+// Index returns the store index the fire was read or written at
+func (f *Fire) Index() uint64 {
+	return f.index
+}
+
+// FireFromNode decodes a fire read from the job store
+func FireFromNode(n *store.Node) (*Fire, error) {
+	f := &Fire{}
+	if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(f); err != nil {
+		return nil, err
+	}
+	f.index = n.ModifiedIndex
+	return f, nil
+}
+
+// CreateFire stores a new fire. It fails with ErrFireExists if the job has been fired
+// already.
+func CreateFire(s store.JobStore, f *Fire) error {
+	value, err := encode(f)
+	if err != nil {
+		return err
+	}
+	resp, err := s.Create(FireKey(f.ID), value, 0)
+	if err != nil {
+		if store.IsNodeExist(err) {
+			return ErrFireExists
+		}
+		return err
+	}
+	f.index = resp.Node.ModifiedIndex
+	return nil
+}
+
+func GetFire(s store.JobStore, id string) (*Fire, error) {
+	n, err := s.Get(FireKey(id), false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, ErrFireNotFound
+		}
+		return nil, err
+	}
+	return FireFromNode(n)
+}
+
+// UpdateFire stores a fire previously read or created. It fails with ErrFireModified if
+// somebody else changed it in the meantime.
+func UpdateFire(s store.JobStore, f *Fire) error {
+	value, err := encode(f)
+	if err != nil {
+		return err
+	}
+	resp, err := s.CompareAndSwap(FireKey(f.ID), value, 0, "", f.index)
+	if err != nil {
+		switch {
+		case store.IsKeyNotFound(err):
+			return ErrFireNotFound
+		case store.IsTestFailed(err):
+			return ErrFireModified
+		}
+		return err
+	}
+	f.index = resp.Node.ModifiedIndex
+	return nil
+}
+
+// ListFires returns every fire, sorted by id
+func ListFires(s store.JobStore) ([]*Fire, error) {
+	nodes, err := s.List(FIRES_DIR, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Fire{}, nil
+		}
+		return nil, err
+	}
+	fires := []*Fire{}
+	for _, n := range nodes {
+		if n.Dir {
+			continue
+		}
+		f, err := FireFromNode(n)
+		if err != nil {
+			return nil, err
+		}
+		fires = append(fires, f)
+	}
+	return fires, nil
+}
+
+// FireRuns returns the runs of a fire found in the job store
+func FireRuns(s store.JobStore, f *Fire) ([]*Run, error) {
+	runs := []*Run{}
+	for _, id := range f.Runs {
+		r, err := Get(s, id)
+		switch err {
+		case nil:
+			runs = append(runs, r)
+		case ErrRunNotFound:
+			// not created before a failover, or deleted
+		default:
+			return nil, err
+		}
+	}
+	return runs, nil
+}
@@ -0,0 +1,93 @@
+package run_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+)
+
+// replicas returns the runs of a fire with the given statuses
+func replicas(statuses ...string) []*run.Run {
+	runs := []*run.Run{}
+	for i, status := range statuses {
+		r := run.NewReplica("report", fireTime, "agent_1", i+1, len(statuses))
+		r.Status = status
+		runs = append(runs, r)
+	}
+	return runs
+}
+
+func TestNewFire(t *testing.T) {
+	j := job.New("report")
+	j.Availability = 3
+	f := run.NewFire(j, fireTime, 3)
+	id := run.ID("report", fireTime)
+	if expected := []string{id, id + ".2", id + ".3"}; !reflect.DeepEqual(f.Runs, expected) {
+		t.Errorf("Expected runs %v. Observed %v", expected, f.Runs)
+	}
+	if f.SuccessPolicy != job.SUCCESS_ALL || f.Status != run.FIRE_RUNNING {
+		t.Errorf("Expected running fire needing all of its runs. Observed: %+v", f)
+	}
+	if siblings := run.NewReplica("report", fireTime, "agent_1", 2, 3).Siblings(); !reflect.DeepEqual(siblings, []string{id, id + ".3"}) {
+		t.Errorf("Expected siblings %v. Observed %v", []string{id, id + ".3"}, siblings)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	const (
+		running   = run.RUN_RUNNING
+		succeeded = run.RUN_SUCCEEDED
+		failed    = run.RUN_FAILED
+	)
+	tests := []struct {
+		policy   string
+		runs     []*run.Run
+		expected string
+	}{
+		{job.SUCCESS_ALL, replicas(succeeded, running, succeeded), run.FIRE_RUNNING},
+		{job.SUCCESS_ALL, replicas(succeeded, succeeded, succeeded), run.FIRE_SUCCEEDED},
+		{job.SUCCESS_ALL, replicas(running, failed, running), run.FIRE_FAILED},
+		{job.SUCCESS_ANY, replicas(running, succeeded, running), run.FIRE_SUCCEEDED},
+		{job.SUCCESS_ANY, replicas(failed, failed, running), run.FIRE_RUNNING},
+		{job.SUCCESS_ANY, replicas(failed, run.RUN_TIMED_OUT, failed), run.FIRE_FAILED},
+		{job.SUCCESS_QUORUM, replicas(succeeded, running, running), run.FIRE_RUNNING},
+		{job.SUCCESS_QUORUM, replicas(succeeded, running, succeeded), run.FIRE_SUCCEEDED},
+		{job.SUCCESS_QUORUM, replicas(failed, running, failed), run.FIRE_FAILED},
+	}
+	for _, test := range tests {
+		j := job.New("report")
+		j.Availability = len(test.runs)
+		j.SuccessPolicy = test.policy
+		f := run.NewFire(j, fireTime, len(test.runs))
+		settled := f.Settle(test.runs, time.Now())
+		if f.Status != test.expected || settled != (test.expected != run.FIRE_RUNNING) {
+			t.Errorf("Expected %s fire to be [%s]. Observed [%s]", test.policy, test.expected, f.Status)
+		}
+	}
+}
+
+func TestCreateFireOnce(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	j := job.New("report")
+
+	if err := run.CreateFire(s, run.NewFire(j, fireTime, 1)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := run.CreateFire(s, run.NewFire(j, fireTime, 1)); err != run.ErrFireExists {
+		t.Errorf("Expected the same fire not to be created twice. Observed: %v", err)
+	}
+	f, _ := run.GetFire(s, run.ID("report", fireTime))
+	stale, _ := run.GetFire(s, run.ID("report", fireTime))
+	f.Settle(replicas(run.RUN_SUCCEEDED), time.Now())
+	if err := run.UpdateFire(s, f); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := run.UpdateFire(s, stale); err != run.ErrFireModified {
+		t.Errorf("Expected [%v]. Observed: %v", run.ErrFireModified, err)
+	}
+}
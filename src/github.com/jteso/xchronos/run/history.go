@@ -0,0 +1,354 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	HISTORY_DIR = "/xchronos/var/history"
+)
+
+var (
+	ErrRecordExists = errors.New("Run already recorded")
+
+	// Retention of the jobs not telling theirs (see job.HistoryPolicy)
+	HISTORY_MAX_RUNS = 100
+	HISTORY_MAX_AGE  = 30 * 24 * time.Hour
+	// Max number of bytes of the output of a run kept, the last ones
+	HISTORY_OUTPUT_EXCERPT = 1024
+)
+
+// Record is a finished run, kept in the history of its job under
+// HISTORY_DIR/<job_id>/<run_id> as long as the retention of the job tells
+type Record struct {
+	RunID  string `codec:"runId"`
+	JobID  string `codec:"jobId"`
+	FireID string `codec:"fireId,omitempty"`
+	// Number of the replica, from 1, out of the replicas run for the fire
+	Replica int `codec:"replica,omitempty"`
+	// Time the job was due
+	ScheduledAt time.Time `codec:"scheduledAt"`
+	// Time the job was actually fired
+	FiredAt time.Time `codec:"firedAt,omitempty"`
+	// Last attempt of the run
+	Executor   string    `codec:"executor,omitempty"`
+	Attempt    int       `codec:"attempt"`
+	StartedAt  time.Time `codec:"startedAt,omitempty"`
+	FinishedAt time.Time `codec:"finishedAt"`
+	// One of RUN_*, the run being finished
+	Status   string        `codec:"status"`
+	ExitCode int           `codec:"exitCode,omitempty"`
+	Error    string        `codec:"error,omitempty"`
+	Duration time.Duration `codec:"duration,omitempty"`
+	// Last bytes of output of the run (see HISTORY_OUTPUT_EXCERPT), or of the body of the
+	// response for http jobs
+	Stdout string `codec:"stdout,omitempty"`
+	Stderr string `codec:"stderr,omitempty"`
+
+	// store index the run was recorded at, telling the runs counted in the stats
+	index uint64
+}
+
+// NewRecord returns the record of a finished run
+func NewRecord(r *Run) *Record {
+	rec := &Record{
+		RunID:       r.ID,
+		JobID:       r.JobID,
+		FireID:      r.FireID,
+		Replica:     r.Replica,
+		ScheduledAt: r.FireTime,
+		FiredAt:     r.CreatedAt,
+		Executor:    r.Executor,
+		Attempt:     r.Attempt,
+		StartedAt:   r.StartedAt,
+		FinishedAt:  r.FinishedAt,
+		Status:      r.Status,
+		ExitCode:    r.ExitCode,
+		Error:       r.Error,
+		Duration:    r.Duration,
+		Stdout:      excerpt(r.Stdout),
+		Stderr:      excerpt(r.Stderr),
+	}
+	if r.Response != nil && rec.Stdout == "" {
+		rec.Stdout = excerpt(r.Response.Body)
+	}
+	return rec
+}
+
+// excerpt returns the last HISTORY_OUTPUT_EXCERPT bytes of an output, not splitting
+// any character
+func excerpt(output string) string {
+	if len(output) <= HISTORY_OUTPUT_EXCERPT {
+		return output
+	}
+	start := len(output) - HISTORY_OUTPUT_EXCERPT
+	for start < len(output) && !utf8.RuneStart(output[start]) {
+		start++
+	}
+	return output[start:]
+}
+
+func HistoryKey(jobID string, runID string) string {
+	return HISTORY_DIR + "/" + jobID + "/" + runID
+}
+
+// Archive records a finished run in the history of its job, returning its record. It
+// fails with ErrRecordExists if the run has been recorded already.
+func Archive(s store.JobStore, r *Run) (*Record, error) {
+	if r.Active() {
+		return nil, fmt.Errorf("Run %s can not be recorded while %s", r.ID, r.Status)
+	}
+	rec := NewRecord(r)
+	value, err := encode(rec)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Create(HistoryKey(r.JobID, r.ID), value, 0)
+	if err != nil {
+		if store.IsNodeExist(err) {
+			return nil, ErrRecordExists
+		}
+		return nil, err
+	}
+	rec.index = resp.Node.CreatedIndex
+	return rec, nil
+}
+
+// History returns the runs recorded for a job, sorted by the time they were due
+func History(s store.JobStore, jobID string) ([]*Record, error) {
+	nodes, err := s.List(HISTORY_DIR+"/"+jobID, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Record{}, nil
+		}
+		return nil, err
+	}
+	records := []*Record{}
+	for _, n := range nodes {
+		if n.Dir {
+			continue
+		}
+		rec, err := recordFromNode(n)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, k int) bool {
+		if !records[i].ScheduledAt.Equal(records[k].ScheduledAt) {
+			return records[i].ScheduledAt.Before(records[k].ScheduledAt)
+		}
+		return records[i].RunID < records[k].RunID
+	})
+	return records, nil
+}
+
+func recordFromNode(n *store.Node) (*Record, error) {
+	rec := &Record{}
+	if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(rec); err != nil {
+		return nil, err
+	}
+	rec.index = n.CreatedIndex
+	return rec, nil
+}
+
+// LastRuns returns the last n runs recorded for a job, oldest first
+func LastRuns(s store.JobStore, jobID string, n int) ([]*Record, error) {
+	records, err := History(s, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if n >= 0 && len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return records, nil
+}
+
+// RunsBetween returns the runs recorded for a job that were due from `from` (included)
+// until `to` (excluded)
+func RunsBetween(s store.JobStore, jobID string, from time.Time, to time.Time) ([]*Record, error) {
+	return filterHistory(s, jobID, func(rec *Record) bool {
+		return !rec.ScheduledAt.Before(from) && rec.ScheduledAt.Before(to)
+	})
+}
+
+// RunsByStatus returns the runs recorded for a job that finished with any of the given
+// statuses, i.e. RUN_FAILED and RUN_TIMED_OUT
+func RunsByStatus(s store.JobStore, jobID string, statuses ...string) ([]*Record, error) {
+	return filterHistory(s, jobID, func(rec *Record) bool {
+		for _, status := range statuses {
+			if rec.Status == status {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func filterHistory(s store.JobStore, jobID string, matches func(rec *Record) bool) ([]*Record, error) {
+	records, err := History(s, jobID)
+	if err != nil {
+		return nil, err
+	}
+	matching := []*Record{}
+	for _, rec := range records {
+		if matches(rec) {
+			matching = append(matching, rec)
+		}
+	}
+	return matching, nil
+}
+
+// expired returns the records past a retention policy at the given time: the ones
+// beyond its max number of runs, oldest first, and the ones finished before its max age.
+// records are sorted as History returns them.
+func expired(records []*Record, policy job.HistoryPolicy, now time.Time) []*Record {
+	maxRuns, maxAge := policy.MaxRuns, policy.MaxAge
+	if maxRuns == 0 {
+		maxRuns = HISTORY_MAX_RUNS
+	}
+	if maxAge == 0 {
+		maxAge = HISTORY_MAX_AGE
+	}
+	expired := []*Record{}
+	for i, rec := range records {
+		if i < len(records)-maxRuns || rec.FinishedAt.Before(now.Add(-maxAge)) {
+			expired = append(expired, rec)
+		}
+	}
+	return expired
+}
+
+// Compact deletes the runs recorded past the retention of their jobs, or the default one
+// for the jobs deleted since, and the runs and fires recorded but left behind (see
+// Prune). It returns the number of runs deleted, from the history or RUNS_DIR.
+func Compact(s store.JobStore, now time.Time) (int, error) {
+	deleted, err := pruneRuns(s)
+	if err != nil {
+		return deleted, err
+	}
+	nodes, err := s.List(HISTORY_DIR, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return deleted, nil
+		}
+		return deleted, err
+	}
+	for _, n := range nodes {
+		if !n.Dir {
+			continue
+		}
+		jobID := store.Base(n.Key)
+		policy := job.HistoryPolicy{}
+		switch j, err := job.Get(s, jobID); err {
+		case nil:
+			policy = j.History
+		case job.ErrJobNotFound:
+		default:
+			return deleted, err
+		}
+		records, err := History(s, jobID)
+		if err != nil {
+			return deleted, err
+		}
+		for _, rec := range expired(records, policy, now) {
+			if _, err := s.Delete(HistoryKey(jobID, rec.RunID), false); err != nil && !store.IsKeyNotFound(err) {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Prune deletes a settled fire along with its runs once every one of them has finished
+// and been recorded in the history, so only the ones in flight are kept under RUNS_DIR
+// and FIRES_DIR. It returns the number of runs deleted.
+func Prune(s store.JobStore, f *Fire) (int, error) {
+	if f.Active() {
+		return 0, nil
+	}
+	runs, err := FireRuns(s, f)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range runs {
+		if r.Active() {
+			// settled before every run finished, i.e. SUCCESS_ANY
+			return 0, nil
+		}
+		if recorded, err := recorded(s, r); err != nil || !recorded {
+			return 0, err
+		}
+	}
+	deleted := 0
+	for _, r := range runs {
+		if err := deleteRun(s, r); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if _, err := s.CompareAndDelete(FireKey(f.ID), "", f.index); err != nil {
+		switch {
+		case store.IsKeyNotFound(err):
+		case store.IsTestFailed(err):
+			return deleted, ErrFireModified
+		default:
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// pruneRuns deletes the fires, and runs, recorded but not pruned as they finished, i.e.
+// when the leader failed over meanwhile
+func pruneRuns(s store.JobStore) (int, error) {
+	fires, err := ListFires(s)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, f := range fires {
+		n, err := Prune(s, f)
+		deleted += n
+		if err != nil && err != ErrFireModified && err != ErrRunModified {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// recorded tells whether a run has been recorded in the history of its job
+func recorded(s store.JobStore, r *Run) (bool, error) {
+	if _, err := s.Get(HistoryKey(r.JobID, r.ID), false); err != nil {
+		if store.IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// deleteRun deletes a run as it was read. It fails with ErrRunModified if somebody else
+// changed it in the meantime.
+func deleteRun(s store.JobStore, r *Run) error {
+	if _, err := s.CompareAndDelete(Key(r.ID), "", r.index); err != nil {
+		switch {
+		case store.IsKeyNotFound(err):
+		case store.IsTestFailed(err):
+			return ErrRunModified
+		default:
+			return err
+		}
+	}
+	return nil
+}
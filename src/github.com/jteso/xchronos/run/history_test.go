@@ -0,0 +1,163 @@
+package run_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+)
+
+// archiveRun records a run of a job due at fireTime, finished with status an hour later
+func archiveRun(t *testing.T, s store.JobStore, jobID string, fireTime time.Time, status string) *run.Run {
+	r := run.New(jobID, fireTime, "agent_1")
+	r.Transition(run.RUN_CLAIMED, fireTime)
+	r.Transition(run.RUN_RUNNING, fireTime)
+	r.Finish(status, nil, fireTime.Add(time.Hour))
+	if _, err := run.Archive(s, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return r
+}
+
+func TestArchive(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	r := run.New("report", fireTime, "agent_1")
+	if _, err := run.Archive(s, r); err == nil {
+		t.Errorf("Expected offered run not to be recorded")
+	}
+
+	r.Transition(run.RUN_CLAIMED, fireTime)
+	r.Transition(run.RUN_RUNNING, fireTime)
+	r.ExitCode = 1
+	r.Stdout = strings.Repeat("é", run.HISTORY_OUTPUT_EXCERPT)
+	r.Finish(run.RUN_FAILED, errors.New("exit status 1"), fireTime.Add(time.Minute))
+	if _, err := run.Archive(s, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, err := run.Archive(s, r); err != run.ErrRecordExists {
+		t.Errorf("Expected [%v]. Observed: %v", run.ErrRecordExists, err)
+	}
+
+	records, _ := run.History(s, "report")
+	if len(records) != 1 {
+		t.Fatalf("Expected [%d] runs recorded. Observed [%d]", 1, len(records))
+	}
+	rec := records[0]
+	if rec.RunID != r.ID || !rec.ScheduledAt.Equal(fireTime) || rec.Executor != "agent_1" || rec.Attempt != 1 ||
+		rec.Status != run.RUN_FAILED || rec.ExitCode != 1 || rec.Error != "exit status 1" || !rec.FinishedAt.Equal(r.FinishedAt) {
+		t.Errorf("Expected run to be recorded. Observed: %+v", rec)
+	}
+	if len(rec.Stdout) > run.HISTORY_OUTPUT_EXCERPT || !strings.HasSuffix(r.Stdout, rec.Stdout) || !strings.HasPrefix(rec.Stdout, "é") {
+		t.Errorf("Expected the last [%d] bytes of output to be recorded. Observed [%d] bytes", run.HISTORY_OUTPUT_EXCERPT, len(rec.Stdout))
+	}
+}
+
+func TestHistoryQueries(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	statuses := []string{run.RUN_SUCCEEDED, run.RUN_FAILED, run.RUN_SUCCEEDED, run.RUN_TIMED_OUT, run.RUN_SUCCEEDED}
+	for i, status := range statuses {
+		archiveRun(t, s, "report", fireTime.Add(time.Duration(i)*time.Hour), status)
+	}
+	archiveRun(t, s, "backup", fireTime, run.RUN_FAILED)
+
+	last, _ := run.LastRuns(s, "report", 2)
+	if len(last) != 2 || !last[0].ScheduledAt.Equal(fireTime.Add(3*time.Hour)) || !last[1].ScheduledAt.Equal(fireTime.Add(4*time.Hour)) {
+		t.Errorf("Expected the last [%d] runs, oldest first. Observed: %+v", 2, last)
+	}
+	between, _ := run.RunsBetween(s, "report", fireTime.Add(time.Hour), fireTime.Add(3*time.Hour))
+	if len(between) != 2 || between[0].Status != run.RUN_FAILED || between[1].Status != run.RUN_SUCCEEDED {
+		t.Errorf("Expected [%d] runs due in range. Observed: %+v", 2, between)
+	}
+	failed, _ := run.RunsByStatus(s, "report", run.RUN_FAILED, run.RUN_TIMED_OUT)
+	if len(failed) != 2 || failed[0].Status != run.RUN_FAILED || failed[1].Status != run.RUN_TIMED_OUT {
+		t.Errorf("Expected [%d] runs failed. Observed: %+v", 2, failed)
+	}
+	if none, err := run.LastRuns(s, "cleanup", 10); err != nil || len(none) != 0 {
+		t.Errorf("Expected no run recorded. Observed: %+v %v", none, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	now := fireTime.Add(48 * time.Hour)
+	j := job.New("report")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_COMMAND, Command: "/usr/bin/report.sh"}
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_SIMPLE, RepeatInterval: time.Hour, RepeatCount: -1}
+	j.History = job.HistoryPolicy{MaxRuns: 3, MaxAge: 24 * time.Hour}
+	if err := job.Create(s, j); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	// finished 47, 25, 23, 22, 21 and 20 hours before now
+	for _, due := range []time.Duration{0, 22, 24, 25, 26, 27} {
+		archiveRun(t, s, "report", fireTime.Add(due*time.Hour), run.RUN_SUCCEEDED)
+	}
+	// job deleted since, kept as long as the defaults tell
+	for i := 0; i < run.HISTORY_MAX_RUNS+1; i++ {
+		archiveRun(t, s, "backup", fireTime.Add(time.Duration(i)*time.Minute), run.RUN_SUCCEEDED)
+	}
+
+	deleted, err := run.Compact(s, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if deleted != 4 {
+		t.Errorf("Expected [%d] runs deleted. Observed [%d]", 4, deleted)
+	}
+	if records, _ := run.History(s, "report"); len(records) != 3 || !records[0].ScheduledAt.Equal(fireTime.Add(25*time.Hour)) {
+		t.Errorf("Expected the last [%d] runs kept. Observed: %+v", 3, records)
+	}
+	if records, _ := run.History(s, "backup"); len(records) != run.HISTORY_MAX_RUNS || !records[0].ScheduledAt.Equal(fireTime.Add(time.Minute)) {
+		t.Errorf("Expected the last [%d] runs kept. Observed [%d]", run.HISTORY_MAX_RUNS, len(records))
+	}
+}
+
+func TestCompactPrunesRuns(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	j := job.New("report")
+	j.Availability = 2
+	f := run.NewFire(j, fireTime, 2)
+	run.CreateFire(s, f)
+	runs := []*run.Run{
+		run.NewReplica("report", fireTime, "agent_1", 1, 2),
+		run.NewReplica("report", fireTime, "agent_2", 2, 2),
+	}
+	for _, r := range runs {
+		r.Transition(run.RUN_CLAIMED, fireTime)
+		r.Transition(run.RUN_RUNNING, fireTime)
+		r.Finish(run.RUN_SUCCEEDED, nil, fireTime.Add(time.Minute))
+		if err := run.Create(s, r); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	run.Archive(s, runs[0])
+
+	// not recorded, nor settled, yet
+	if deleted, err := run.Compact(s, fireTime.Add(time.Hour)); err != nil || deleted != 0 {
+		t.Errorf("Expected no run deleted. Observed [%d] %v", deleted, err)
+	}
+
+	run.Archive(s, runs[1])
+	f, _ = run.GetFire(s, f.ID)
+	f.Settle(runs, fireTime.Add(time.Minute))
+	run.UpdateFire(s, f)
+	if deleted, err := run.Compact(s, fireTime.Add(time.Hour)); err != nil || deleted != 2 {
+		t.Errorf("Expected [%d] runs deleted. Observed [%d] %v", 2, deleted, err)
+	}
+	if runs, _ := run.List(s); len(runs) != 0 {
+		t.Errorf("Expected no run left under RUNS_DIR. Observed: %+v", runs)
+	}
+	if fires, _ := run.ListFires(s); len(fires) != 0 {
+		t.Errorf("Expected no fire left under FIRES_DIR. Observed: %+v", fires)
+	}
+	if records, _ := run.History(s, "report"); len(records) != 2 {
+		t.Errorf("Expected [%d] runs recorded. Observed [%d]", 2, len(records))
+	}
+}
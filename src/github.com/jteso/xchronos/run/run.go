@@ -0,0 +1,434 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	RUNS_DIR = "/xchronos/var/runs"
+)
+
+// Run statuses
+const (
+	// waiting for an executor with free capacity
+	RUN_QUEUED = "queued"
+	// waiting in the queue of an executor
+	RUN_OFFERED = "offered"
+	// taken by the executor it was offered to
+	RUN_CLAIMED = "claimed"
+	RUN_RUNNING = "running"
+	// failed, waiting to be offered again
+	RUN_RETRYING = "retrying"
+
+	RUN_SUCCEEDED = "succeeded"
+	RUN_FAILED    = "failed"
+	RUN_TIMED_OUT = "timed_out"
+	// no executor alive meets the constraints of the job
+	RUN_UNSCHEDULABLE = "unschedulable"
+)
+
+var (
+	ErrRunNotFound     = errors.New("Run not found")
+	ErrRunExists       = errors.New("Run already exists")
+	ErrRunModified     = errors.New("Run has been modified since it was read")
+	ErrRunNotClaimable = errors.New("Run is not offered to this executor anymore")
+
+	// allowed transitions
+	transitions = map[string][]string{
+		RUN_QUEUED:   {RUN_OFFERED, RUN_FAILED, RUN_UNSCHEDULABLE},
+		RUN_OFFERED:  {RUN_CLAIMED, RUN_QUEUED, RUN_UNSCHEDULABLE},
+		RUN_CLAIMED:  {RUN_RUNNING, RUN_FAILED, RUN_RETRYING},
+		RUN_RUNNING:  {RUN_SUCCEEDED, RUN_FAILED, RUN_TIMED_OUT, RUN_RETRYING},
+		RUN_RETRYING: {RUN_OFFERED, RUN_QUEUED, RUN_FAILED, RUN_UNSCHEDULABLE},
+	}
+
+	jsonHandle = new(codec.JsonHandle)
+)
+
+// Run is a fire of a job, stored under RUNS_DIR/<run_id>. Every change of status is made
+// with a compare-and-swap, so only one executor gets to claim a run.
+type Run struct {
+	ID    string `codec:"id"`
+	JobID string `codec:"jobId"`
+	// Time the job was due
+	FireTime time.Time `codec:"fireTime"`
+	// Fire the run is part of, along with the runs of the other replicas (see Fire)
+	FireID string `codec:"fireId,omitempty"`
+	// Number of the replica, from 1, out of the replicas run for the fire
+	Replica  int `codec:"replica,omitempty"`
+	Replicas int `codec:"replicas,omitempty"`
+	// One of RUN_*
+	Status string `codec:"status"`
+	// Executor the run is offered to, or claimed by. None while queued
+	Executor string `codec:"executor"`
+	// Capacity slots of the executor taken by the run, 1 if 0 (see job.Slots)
+	Slots int `codec:"slots,omitempty"`
+	// Number of the attempt, from 1
+	Attempt int `codec:"attempt"`
+
+	// Time the job was actually fired, late if the leader was busy or failing over
+	CreatedAt  time.Time `codec:"createdAt,omitempty"`
+	QueuedAt   time.Time `codec:"queuedAt,omitempty"`
+	OfferedAt  time.Time `codec:"offeredAt"`
+	ClaimedAt  time.Time `codec:"claimedAt,omitempty"`
+	StartedAt  time.Time `codec:"startedAt,omitempty"`
+	FinishedAt time.Time `codec:"finishedAt,omitempty"`
+	// Why the run failed
+	Error string `codec:"error,omitempty"`
+	// Exit code of the job, if it exited, 128 + signal number if it was killed
+	ExitCode int `codec:"exitCode,omitempty"`
+	// Time the job took
+	Duration time.Duration `codec:"duration,omitempty"`
+	// Last lines of output of the job (see executor.COMMAND_OUTPUT_LIMIT)
+	Stdout string `codec:"stdout,omitempty"`
+	Stderr string `codec:"stderr,omitempty"`
+	// Response of the endpoint called (http jobs)
+	Response *Response `codec:"response,omitempty"`
+	// Time the next attempt is due (retrying)
+	RetryAt time.Time `codec:"retryAt,omitempty"`
+	// Previous attempts, oldest first
+	Attempts []Attempt `codec:"attempts,omitempty"`
+
+	// store index the run was read at, used to detect concurrent updates
+	index uint64
+}
+
+// Attempt is a failed attempt of a run
+type Attempt struct {
+	Attempt  int    `codec:"attempt"`
+	Executor string `codec:"executor"`
+	// One of job.ERROR_CLASS_*
+	ErrorClass string        `codec:"errorClass"`
+	Error      string        `codec:"error,omitempty"`
+	ExitCode   int           `codec:"exitCode,omitempty"`
+	Duration   time.Duration `codec:"duration,omitempty"`
+	StartedAt  time.Time     `codec:"startedAt,omitempty"`
+	FinishedAt time.Time     `codec:"finishedAt"`
+}
+
+// Response is the response of the endpoint called by an http job
+type Response struct {
+	StatusCode int                 `codec:"statusCode"`
+	Header     map[string][]string `codec:"header,omitempty"`
+	// First bytes of the body (see executor.HTTP_BODY_LIMIT)
+	Body string `codec:"body,omitempty"`
+}
+
+// ID returns the id of the run of a job fired at fireTime, unique so a fire is never
+// run twice (i.e. after a leader failover)
+func ID(jobID string, fireTime time.Time) string {
+	return fmt.Sprintf("%s-%d", jobID, fireTime.UnixNano())
+}
+
+// ReplicaID returns the id of a replica of a fire, the id of the fire itself for the
+// first one, so fires run by a single executor keep a single id
+func ReplicaID(fireID string, replica int) string {
+	if replica <= 1 {
+		return fireID
+	}
+	return fmt.Sprintf("%s.%d", fireID, replica)
+}
+
+// New returns the first attempt of the run of a job fired at fireTime, offered to executor
+func New(jobID string, fireTime time.Time, executor string) *Run {
+	return NewReplica(jobID, fireTime, executor, 1, 1)
+}
+
+// NewReplica returns the first attempt of a replica of the fire of a job at fireTime,
+// offered to executor
+func NewReplica(jobID string, fireTime time.Time, executor string, replica int, replicas int) *Run {
+	fireID := ID(jobID, fireTime)
+	now := time.Now().UTC()
+	return &Run{
+		ID:        ReplicaID(fireID, replica),
+		JobID:     jobID,
+		FireTime:  fireTime,
+		FireID:    fireID,
+		Replica:   replica,
+		Replicas:  replicas,
+		Status:    RUN_OFFERED,
+		Executor:  executor,
+		Attempt:   1,
+		CreatedAt: now,
+		OfferedAt: now,
+	}
+}
+
+// Siblings returns the ids of the runs of the other replicas of the fire
+func (r *Run) Siblings() []string {
+	ids := []string{}
+	for i := 1; i <= r.Replicas; i++ {
+		if i != r.Replica {
+			ids = append(ids, ReplicaID(r.FireID, i))
+		}
+	}
+	return ids
+}
+
+func Key(id string) string {
+	return RUNS_DIR + "/" + id
+}
+
+// Active tells whether the run has not finished yet
+func (r *Run) Active() bool {
+	return r.Status == RUN_QUEUED || r.Status == RUN_OFFERED || r.Status == RUN_CLAIMED || r.Status == RUN_RUNNING || r.Status == RUN_RETRYING
+}
+
+// TakenSlots returns the capacity slots taken by the run
+func (r *Run) TakenSlots() int {
+	if r.Slots < 1 {
+		return 1
+	}
+	return r.Slots
+}
+
+// Transition changes the status of the run, if allowed from the current one
+func (r *Run) Transition(status string, at time.Time) error {
+	allowed := false
+	for _, s := range transitions[r.Status] {
+		allowed = allowed || s == status
+	}
+	if !allowed {
+		return fmt.Errorf("Run %s can not go from %s to %s", r.ID, r.Status, status)
+	}
+
+	r.Status = status
+	switch status {
+	case RUN_QUEUED:
+		r.QueuedAt = at
+	case RUN_CLAIMED:
+		r.ClaimedAt = at
+	case RUN_RUNNING:
+		r.StartedAt = at
+	case RUN_SUCCEEDED, RUN_FAILED, RUN_TIMED_OUT, RUN_UNSCHEDULABLE:
+		r.FinishedAt = at
+		r.RetryAt = time.Time{}
+	}
+	return nil
+}
+
+// Fail records the current attempt failed for the given reason, one of
+// job.ERROR_CLASS_*. The run is retried if the retry policy allows it, it finishes
+// otherwise.
+func (r *Run) Fail(class string, cause error, retry *job.RetryPolicy, at time.Time) error {
+	status := RUN_FAILED
+	if class == job.ERROR_CLASS_TIMED_OUT {
+		status = RUN_TIMED_OUT
+	}
+	if r.Attempt >= retry.Attempts() || !retry.Retryable(class, r.ExitCode) {
+		return r.Finish(status, cause, at)
+	}
+
+	if err := r.Transition(RUN_RETRYING, at); err != nil {
+		return err
+	}
+	a := Attempt{
+		Attempt:    r.Attempt,
+		Executor:   r.Executor,
+		ErrorClass: class,
+		ExitCode:   r.ExitCode,
+		Duration:   r.Duration,
+		StartedAt:  r.StartedAt,
+		FinishedAt: at,
+	}
+	if cause != nil {
+		a.Error = cause.Error()
+		r.Error = a.Error
+	}
+	r.Attempts = append(r.Attempts, a)
+	r.RetryAt = at.Add(retry.Delay(r.Attempt, rand.Float64()))
+	return nil
+}
+
+// Reoffer offers the run to an executor again, as a new attempt
+func (r *Run) Reoffer(executor string, at time.Time) error {
+	if err := r.Transition(RUN_OFFERED, at); err != nil {
+		return err
+	}
+	r.Executor = executor
+	r.OfferedAt = at
+	r.nextAttempt()
+	return nil
+}
+
+// Queue holds the run until an executor has free capacity, as a new attempt if it was
+// retrying
+func (r *Run) Queue(at time.Time) error {
+	retrying := r.Status == RUN_RETRYING
+	if err := r.Transition(RUN_QUEUED, at); err != nil {
+		return err
+	}
+	r.Executor = ""
+	if retrying {
+		r.nextAttempt()
+	}
+	return nil
+}
+
+// Offer offers a queued run to an executor
+func (r *Run) Offer(executor string, at time.Time) error {
+	if err := r.Transition(RUN_OFFERED, at); err != nil {
+		return err
+	}
+	r.Executor = executor
+	r.OfferedAt = at
+	return nil
+}
+
+// nextAttempt starts over the outcome of the run, for its next attempt
+func (r *Run) nextAttempt() {
+	r.Attempt++
+	r.ClaimedAt = time.Time{}
+	r.StartedAt = time.Time{}
+	r.RetryAt = time.Time{}
+	r.Error = ""
+	r.ExitCode = 0
+	r.Duration = 0
+	r.Stdout = ""
+	r.Stderr = ""
+	r.Response = nil
+}
+
+// Move offers the run to another executor, before it has been claimed
+func (r *Run) Move(executor string, at time.Time) error {
+	if r.Status != RUN_OFFERED {
+		return fmt.Errorf("Run %s can not be moved once %s", r.ID, r.Status)
+	}
+	r.Executor = executor
+	r.OfferedAt = at
+	return nil
+}
+
+// Finish records the outcome of a run, failed if cause is given
+func (r *Run) Finish(status string, cause error, at time.Time) error {
+	if err := r.Transition(status, at); err != nil {
+		return err
+	}
+	if cause != nil {
+		r.Error = cause.Error()
+	}
+	return nil
+}
+
+// Index returns the store index the run was read or written at
+func (r *Run) Index() uint64 {
+	return r.index
+}
+
+func encode(v interface{}) (string, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, jsonHandle).Encode(v)
+	return string(b), err
+}
+
+// FromNode decodes a run read from the job store, i.e. received via Watch
+func FromNode(n *store.Node) (*Run, error) {
+	r := &Run{}
+	if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(r); err != nil {
+		return nil, err
+	}
+	r.index = n.ModifiedIndex
+	return r, nil
+}
+
+// Create stores a new run. It fails with ErrRunExists if the fire has been run already.
+func Create(s store.JobStore, r *Run) error {
+	value, err := encode(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.Create(Key(r.ID), value, 0)
+	if err != nil {
+		if store.IsNodeExist(err) {
+			return ErrRunExists
+		}
+		return err
+	}
+	r.index = resp.Node.ModifiedIndex
+	return nil
+}
+
+func Get(s store.JobStore, id string) (*Run, error) {
+	n, err := s.Get(Key(id), false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, ErrRunNotFound
+		}
+		return nil, err
+	}
+	return FromNode(n)
+}
+
+// Update stores a run previously read or created. It fails with ErrRunModified if
+// somebody else changed it in the meantime.
+func Update(s store.JobStore, r *Run) error {
+	value, err := encode(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.CompareAndSwap(Key(r.ID), value, 0, "", r.index)
+	if err != nil {
+		switch {
+		case store.IsKeyNotFound(err):
+			return ErrRunNotFound
+		case store.IsTestFailed(err):
+			return ErrRunModified
+		}
+		return err
+	}
+	r.index = resp.Node.ModifiedIndex
+	return nil
+}
+
+// List returns every run, sorted by id
+func List(s store.JobStore) ([]*Run, error) {
+	nodes, err := s.List(RUNS_DIR, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Run{}, nil
+		}
+		return nil, err
+	}
+	runs := []*Run{}
+	for _, n := range nodes {
+		if n.Dir {
+			continue
+		}
+		r, err := FromNode(n)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// Claim takes the given attempt of a run offered to executor. Only one executor succeeds,
+// the rest get ErrRunNotClaimable.
+func Claim(s store.JobStore, id string, executor string, attempt int) (*Run, error) {
+	r, err := Get(s, id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Status != RUN_OFFERED || r.Executor != executor || r.Attempt != attempt {
+		return nil, ErrRunNotClaimable
+	}
+	if err := r.Transition(RUN_CLAIMED, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	if err := Update(s, r); err != nil {
+		if err == ErrRunModified {
+			return nil, ErrRunNotClaimable
+		}
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,198 @@
+package run_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+)
+
+var fireTime = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestCreateOnce(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	if err := run.Create(s, run.New("report", fireTime, "agent_1")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := run.Create(s, run.New("report", fireTime, "agent_2")); err != run.ErrRunExists {
+		t.Errorf("Expected the same fire not to be run twice. Observed: %v", err)
+	}
+}
+
+func TestClaimOnce(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	r := run.New("report", fireTime, "agent_1")
+	run.Create(s, r)
+
+	var wg sync.WaitGroup
+	claimed := make(chan *run.Run, 10)
+	for i := 0; i < cap(claimed); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := run.Claim(s, r.ID, "agent_1", 1); err == nil {
+				claimed <- r
+			} else if err != run.ErrRunNotClaimable {
+				t.Errorf("Unexpected error: %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	close(claimed)
+
+	if len(claimed) != 1 {
+		t.Fatalf("Expected [%d] claim to succeed. Observed [%d]", 1, len(claimed))
+	}
+	if r := <-claimed; r.Status != run.RUN_CLAIMED || r.ClaimedAt.IsZero() {
+		t.Errorf("Expected run to be claimed. Observed: %+v", r)
+	}
+}
+
+func TestClaimNotOffered(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	r := run.New("report", fireTime, "agent_1")
+	run.Create(s, r)
+
+	for _, c := range []struct {
+		executor string
+		attempt  int
+	}{{"agent_2", 1}, {"agent_1", 2}} {
+		if _, err := run.Claim(s, r.ID, c.executor, c.attempt); err != run.ErrRunNotClaimable {
+			t.Errorf("Expected attempt [%d] not to be claimable by [%s]. Observed: %v", c.attempt, c.executor, err)
+		}
+	}
+	if _, err := run.Claim(s, "unknown", "agent_1", 1); err != run.ErrRunNotFound {
+		t.Errorf("Expected [%v]. Observed: %v", run.ErrRunNotFound, err)
+	}
+}
+
+func TestUpdateModified(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	r := run.New("report", fireTime, "agent_1")
+	run.Create(s, r)
+
+	stale, _ := run.Get(s, r.ID)
+	if _, err := run.Claim(s, r.ID, "agent_1", 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	stale.Move("agent_2", time.Now())
+	if err := run.Update(s, stale); err != run.ErrRunModified {
+		t.Errorf("Expected [%v]. Observed: %v", run.ErrRunModified, err)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	now := time.Now()
+	r := run.New("report", fireTime, "agent_1")
+	for _, status := range []string{run.RUN_RUNNING, run.RUN_SUCCEEDED} {
+		if err := r.Transition(status, now); err == nil {
+			t.Errorf("Expected offered run not to go to [%s]", status)
+		}
+	}
+
+	r.Transition(run.RUN_CLAIMED, now)
+	r.Transition(run.RUN_RUNNING, now)
+	if err := r.Reoffer("agent_2", now); err == nil {
+		t.Errorf("Expected running run not to be offered again before failing")
+	}
+	r.Transition(run.RUN_RETRYING, now)
+	if err := r.Reoffer("agent_2", now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Attempt != 2 || r.Executor != "agent_2" || !r.ClaimedAt.IsZero() {
+		t.Errorf("Expected attempt [%d] offered to [%s]. Observed: %+v", 2, "agent_2", r)
+	}
+
+	r.Transition(run.RUN_CLAIMED, now)
+	r.Transition(run.RUN_RUNNING, now)
+	if err := r.Finish(run.RUN_FAILED, errors.New("exit status 1"), now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Active() || r.Error != "exit status 1" || r.FinishedAt.IsZero() {
+		t.Errorf("Expected run to be finished. Observed: %+v", r)
+	}
+	if err := r.Transition(run.RUN_OFFERED, now); err == nil {
+		t.Errorf("Expected finished run not to be offered again")
+	}
+}
+
+func TestFail(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	retry := &job.RetryPolicy{MaxAttempts: 3, TimeBetweenAttempts: 10 * time.Second, Backoff: job.BACKOFF_LINEAR, RetryableExitCodes: []int{75}}
+	r := run.New("report", fireTime, "agent_1")
+
+	for attempt := 1; attempt < 3; attempt++ {
+		r.Transition(run.RUN_CLAIMED, now)
+		r.Transition(run.RUN_RUNNING, now)
+		r.ExitCode = 75
+		if err := r.Fail(job.ERROR_CLASS_FAILED, errors.New("exit status 75"), retry, now); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if expected := now.Add(time.Duration(attempt) * 10 * time.Second); r.Status != run.RUN_RETRYING || !r.RetryAt.Equal(expected) {
+			t.Errorf("Expected attempt [%d] to be retried at [%s]. Observed: %+v", attempt, expected, r)
+		}
+		if len(r.Attempts) != attempt || r.Attempts[attempt-1].ExitCode != 75 || r.Attempts[attempt-1].ErrorClass != job.ERROR_CLASS_FAILED {
+			t.Errorf("Expected attempt [%d] to be recorded. Observed: %+v", attempt, r.Attempts)
+		}
+		r.Reoffer("agent_1", now)
+	}
+
+	// out of attempts
+	r.Transition(run.RUN_CLAIMED, now)
+	r.Transition(run.RUN_RUNNING, now)
+	r.ExitCode = 75
+	r.Fail(job.ERROR_CLASS_FAILED, errors.New("exit status 75"), retry, now)
+	if r.Status != run.RUN_FAILED || r.Attempt != 3 || !r.RetryAt.IsZero() {
+		t.Errorf("Expected run to fail after [%d] attempts. Observed: %+v", 3, r)
+	}
+
+	// not retryable
+	r = run.New("report", fireTime, "agent_1")
+	r.Transition(run.RUN_CLAIMED, now)
+	r.Transition(run.RUN_RUNNING, now)
+	r.ExitCode = 1
+	r.Fail(job.ERROR_CLASS_FAILED, errors.New("exit status 1"), retry, now)
+	if r.Status != run.RUN_FAILED {
+		t.Errorf("Expected exit code [%d] not to be retried. Observed: %+v", 1, r)
+	}
+	r = run.New("report", fireTime, "agent_1")
+	r.Transition(run.RUN_CLAIMED, now)
+	r.Transition(run.RUN_RUNNING, now)
+	r.Fail(job.ERROR_CLASS_TIMED_OUT, errors.New("timed out"), &job.RetryPolicy{}, now)
+	if r.Status != run.RUN_TIMED_OUT {
+		t.Errorf("Expected run to time out. Observed: %+v", r)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	now := time.Now()
+	r := run.New("report", fireTime, "agent_1")
+	if err := r.Queue(now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Status != run.RUN_QUEUED || r.Executor != "" || r.Attempt != 1 || !r.QueuedAt.Equal(now) {
+		t.Errorf("Expected first attempt to be queued. Observed: %+v", r)
+	}
+	if err := r.Transition(run.RUN_CLAIMED, now); err == nil {
+		t.Errorf("Expected queued run not to be claimed before being offered")
+	}
+	r.Offer("agent_2", now)
+	r.Transition(run.RUN_CLAIMED, now)
+	r.Transition(run.RUN_RUNNING, now)
+	r.Transition(run.RUN_RETRYING, now)
+	if err := r.Queue(now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Status != run.RUN_QUEUED || r.Executor != "" || r.Attempt != 2 || !r.ClaimedAt.IsZero() {
+		t.Errorf("Expected attempt [%d] to be queued. Observed: %+v", 2, r)
+	}
+}
@@ -0,0 +1,303 @@
+package run
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jteso/xchronos/store"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	JOB_STATS_DIR      = "/xchronos/var/stats/jobs"
+	EXECUTOR_STATS_DIR = "/xchronos/var/stats/executors"
+)
+
+var (
+	ErrStatsNotFound = errors.New("Stats not found")
+	ErrStatsModified = errors.New("Stats have been modified since they were read")
+
+	// Number of the last runs durations and schedule lags are computed over
+	STATS_WINDOW = 100
+	// Max number of times stats are read again when changed while being updated
+	STATS_UPDATE_ATTEMPTS = 3
+)
+
+// Stats are the statistics of the runs of a job, stored under JOB_STATS_DIR/<job_id>, or
+// of the runs executed by an executor, stored under EXECUTOR_STATS_DIR/<executor_id>.
+// They are updated by the leader as runs are recorded in the history (see Archive), and
+// from the history on failover, for the runs recorded but not counted yet (see
+// CountStats).
+type Stats struct {
+	// Id of the job or executor
+	ID        string `codec:"id"`
+	Succeeded int    `codec:"succeeded"`
+	// Runs failed, timed out or unschedulable
+	Failed int `codec:"failed"`
+	// Runs taking more than one attempt
+	Retried       int       `codec:"retried"`
+	LastSuccessAt time.Time `codec:"lastSuccessAt,omitempty"`
+	LastFailureAt time.Time `codec:"lastFailureAt,omitempty"`
+	// Time the last STATS_WINDOW runs started took, oldest first
+	Durations []time.Duration `codec:"durations,omitempty"`
+	// Time from due to started of the last STATS_WINDOW runs started, oldest first
+	Lags      []time.Duration `codec:"lags,omitempty"`
+	UpdatedAt time.Time       `codec:"updatedAt"`
+	// Store index the last run counted was recorded at, so runs are counted once
+	Index uint64 `codec:"index,omitempty"`
+
+	// store index the stats were read at, used to detect concurrent updates
+	index uint64
+}
+
+// Runs returns the number of runs counted
+func (st *Stats) Runs() int {
+	return st.Succeeded + st.Failed
+}
+
+// RetryRate returns the fraction of the runs taking more than one attempt, from 0 to 1
+func (st *Stats) RetryRate() float64 {
+	if st.Runs() == 0 {
+		return 0
+	}
+	return float64(st.Retried) / float64(st.Runs())
+}
+
+// Percentile returns the duration the given percentage of the last runs took at most
+// (nearest rank), i.e. Percentile(95). 0 if no run started.
+func (st *Stats) Percentile(p float64) time.Duration {
+	if len(st.Durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, st.Durations...)
+	sort.Slice(sorted, func(i, k int) bool { return sorted[i] < sorted[k] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	switch {
+	case rank < 1:
+		rank = 1
+	case rank > len(sorted):
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// MeanLag returns the mean time the last runs started late by. 0 if no run started.
+func (st *Stats) MeanLag() time.Duration {
+	if len(st.Lags) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, lag := range st.Lags {
+		total += lag
+	}
+	return total / time.Duration(len(st.Lags))
+}
+
+// Add counts a finished run
+func (st *Stats) Add(rec *Record) {
+	if rec.Status == RUN_SUCCEEDED {
+		st.Succeeded++
+		if rec.FinishedAt.After(st.LastSuccessAt) {
+			st.LastSuccessAt = rec.FinishedAt
+		}
+	} else {
+		st.Failed++
+		if rec.FinishedAt.After(st.LastFailureAt) {
+			st.LastFailureAt = rec.FinishedAt
+		}
+	}
+	if rec.Attempt > 1 {
+		st.Retried++
+	}
+	if !rec.StartedAt.IsZero() {
+		duration := rec.Duration
+		if duration == 0 && !rec.FinishedAt.IsZero() {
+			duration = rec.FinishedAt.Sub(rec.StartedAt)
+		}
+		st.Durations = window(append(st.Durations, duration))
+		st.Lags = window(append(st.Lags, rec.StartedAt.Sub(rec.ScheduledAt)))
+	}
+}
+
+// window keeps the last STATS_WINDOW samples
+func window(samples []time.Duration) []time.Duration {
+	if len(samples) > STATS_WINDOW {
+		return samples[len(samples)-STATS_WINDOW:]
+	}
+	return samples
+}
+
+func JobStatsKey(jobID string) string {
+	return JOB_STATS_DIR + "/" + jobID
+}
+
+func ExecutorStatsKey(executorID string) string {
+	return EXECUTOR_STATS_DIR + "/" + executorID
+}
+
+// JobStats returns the stats of the runs of a job
+func JobStats(s store.JobStore, jobID string) (*Stats, error) {
+	return getStats(s, JobStatsKey(jobID))
+}
+
+// ExecutorStats returns the stats of the runs executed by an executor
+func ExecutorStats(s store.JobStore, executorID string) (*Stats, error) {
+	return getStats(s, ExecutorStatsKey(executorID))
+}
+
+// ListJobStats returns the stats of every job run, sorted by job id
+func ListJobStats(s store.JobStore) ([]*Stats, error) {
+	return listStats(s, JOB_STATS_DIR)
+}
+
+// ListExecutorStats returns the stats of every executor having run a job, sorted by
+// executor id
+func ListExecutorStats(s store.JobStore) ([]*Stats, error) {
+	return listStats(s, EXECUTOR_STATS_DIR)
+}
+
+// AddStats counts a run recorded in the history in the stats of its job and of the
+// executor of its last attempt, if any. Runs recorded are counted once, in the order they
+// were recorded: the ones recorded before the last run counted are skipped.
+func AddStats(s store.JobStore, rec *Record) error {
+	if err := addStats(s, JobStatsKey(rec.JobID), rec); err != nil {
+		return err
+	}
+	if rec.Executor == "" {
+		return nil
+	}
+	return addStats(s, ExecutorStatsKey(rec.Executor), rec)
+}
+
+// addStats counts a run in the stats stored under key, read again if changed meanwhile
+func addStats(s store.JobStore, key string, rec *Record) error {
+	for attempt := 0; attempt < STATS_UPDATE_ATTEMPTS; attempt++ {
+		st, err := getStats(s, key)
+		switch err {
+		case nil:
+		case ErrStatsNotFound:
+			st = &Stats{ID: store.Base(key)}
+		default:
+			return err
+		}
+		if rec.index != 0 && rec.index <= st.Index {
+			// counted already
+			return nil
+		}
+		st.Add(rec)
+		if rec.index > st.Index {
+			st.Index = rec.index
+		}
+		st.UpdatedAt = time.Now().UTC()
+		if err := putStats(s, key, st); err != ErrStatsModified {
+			return err
+		}
+	}
+	return ErrStatsModified
+}
+
+// CountStats counts the runs recorded in the history but not in the stats yet, i.e. when
+// the leader failed over in between, in the order they were recorded
+func CountStats(s store.JobStore) error {
+	nodes, err := s.List(HISTORY_DIR, true)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	counted := map[string]uint64{}
+	for _, dir := range []string{JOB_STATS_DIR, EXECUTOR_STATS_DIR} {
+		stats, err := listStats(s, dir)
+		if err != nil {
+			return err
+		}
+		for _, st := range stats {
+			counted[dir+"/"+st.ID] = st.Index
+		}
+	}
+
+	records := []*Record{}
+	for _, n := range nodes {
+		rec, err := recordFromNode(n)
+		if err != nil {
+			return err
+		}
+		if rec.index > counted[JobStatsKey(rec.JobID)] || (rec.Executor != "" && rec.index > counted[ExecutorStatsKey(rec.Executor)]) {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, k int) bool { return records[i].index < records[k].index })
+	for _, rec := range records {
+		if err := AddStats(s, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putStats stores the stats read, or new ones if never read. It fails with
+// ErrStatsModified if somebody else changed them in the meantime.
+func putStats(s store.JobStore, key string, st *Stats) error {
+	value, err := encode(st)
+	if err != nil {
+		return err
+	}
+	if st.index == 0 {
+		_, err = s.Create(key, value, 0)
+	} else {
+		_, err = s.CompareAndSwap(key, value, 0, "", st.index)
+	}
+	switch {
+	case err == nil:
+		return nil
+	case store.IsNodeExist(err), store.IsTestFailed(err), store.IsKeyNotFound(err):
+		return ErrStatsModified
+	}
+	return err
+}
+
+func getStats(s store.JobStore, key string) (*Stats, error) {
+	n, err := s.Get(key, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, ErrStatsNotFound
+		}
+		return nil, err
+	}
+	return statsFromNode(n)
+}
+
+func listStats(s store.JobStore, dir string) ([]*Stats, error) {
+	nodes, err := s.List(dir, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Stats{}, nil
+		}
+		return nil, err
+	}
+	stats := []*Stats{}
+	for _, n := range nodes {
+		if n.Dir {
+			continue
+		}
+		st, err := statsFromNode(n)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+func statsFromNode(n *store.Node) (*Stats, error) {
+	st := &Stats{}
+	if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(st); err != nil {
+		return nil, err
+	}
+	st.index = n.ModifiedIndex
+	return st, nil
+}
@@ -0,0 +1,111 @@
+package run_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+)
+
+// newRecord returns the record of a run due at fireTime, started lag later and taking
+// duration
+func newRecord(executor string, status string, attempt int, lag time.Duration, duration time.Duration) *run.Record {
+	return &run.Record{
+		RunID:       run.ID("report", fireTime),
+		JobID:       "report",
+		ScheduledAt: fireTime,
+		Executor:    executor,
+		Attempt:     attempt,
+		StartedAt:   fireTime.Add(lag),
+		FinishedAt:  fireTime.Add(lag + duration),
+		Status:      status,
+		Duration:    duration,
+	}
+}
+
+func TestStats(t *testing.T) {
+	st := &run.Stats{}
+	for i := 1; i <= 100; i++ {
+		status, attempt := run.RUN_SUCCEEDED, 1
+		if i%10 == 0 {
+			status = run.RUN_FAILED
+		}
+		if i%4 == 0 {
+			attempt = 2
+		}
+		st.Add(newRecord("agent_1", status, attempt, time.Duration(i%3)*time.Second, time.Duration(i)*time.Second))
+	}
+	if st.Succeeded != 90 || st.Failed != 10 || st.RetryRate() != 0.25 {
+		t.Errorf("Expected [%d] runs succeeded, [%d] failed and [%d] retried. Observed: %+v", 90, 10, 25, st)
+	}
+	for p, expected := range map[float64]time.Duration{50: 50 * time.Second, 95: 95 * time.Second, 99: 99 * time.Second} {
+		if observed := st.Percentile(p); observed != expected {
+			t.Errorf("Expected p%v [%s]. Observed [%s]", p, expected, observed)
+		}
+	}
+	// 98th run, late by 2 seconds
+	if expected := fireTime.Add(100 * time.Second); !st.LastSuccessAt.Equal(expected) {
+		t.Errorf("Expected last success at [%s]. Observed [%s]", expected, st.LastSuccessAt)
+	}
+	if expected := time.Second; st.MeanLag() != expected {
+		t.Errorf("Expected mean schedule lag [%s]. Observed [%s]", expected, st.MeanLag())
+	}
+
+	// rolling
+	st.Add(newRecord("agent_1", run.RUN_SUCCEEDED, 1, 0, 1000*time.Second))
+	if len(st.Durations) != run.STATS_WINDOW || st.Percentile(100) != 1000*time.Second || st.Percentile(1) != 2*time.Second {
+		t.Errorf("Expected durations of the last [%d] runs. Observed: %v", run.STATS_WINDOW, st.Durations)
+	}
+}
+
+func TestAddStats(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	run.AddStats(s, newRecord("agent_1", run.RUN_SUCCEEDED, 1, time.Second, time.Minute))
+	run.AddStats(s, newRecord("agent_2", run.RUN_FAILED, 3, time.Second, time.Minute))
+	unschedulable := newRecord("", run.RUN_UNSCHEDULABLE, 1, 0, 0)
+	unschedulable.StartedAt = time.Time{}
+	run.AddStats(s, unschedulable)
+
+	st, err := run.JobStats(s, "report")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if st.ID != "report" || st.Succeeded != 1 || st.Failed != 2 || st.Retried != 1 || len(st.Durations) != 2 {
+		t.Errorf("Expected every run of the job to be counted. Observed: %+v", st)
+	}
+	executors, _ := run.ListExecutorStats(s)
+	if len(executors) != 2 || executors[0].ID != "agent_1" || executors[0].Succeeded != 1 || executors[1].ID != "agent_2" || executors[1].Failed != 1 {
+		t.Errorf("Expected runs counted by executor. Observed: %+v", executors)
+	}
+	if _, err := run.ExecutorStats(s, "agent_3"); err != run.ErrStatsNotFound {
+		t.Errorf("Expected [%v]. Observed: %v", run.ErrStatsNotFound, err)
+	}
+}
+
+func TestCountStats(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	archiveRun(t, s, "report", fireTime, run.RUN_SUCCEEDED)
+	records, _ := run.History(s, "report")
+	run.AddStats(s, records[0])
+	// counted again, i.e. by the next leader
+	run.AddStats(s, records[0])
+	// recorded but not counted before a failover
+	archiveRun(t, s, "report", fireTime.Add(time.Hour), run.RUN_FAILED)
+	archiveRun(t, s, "report", fireTime.Add(2*time.Hour), run.RUN_SUCCEEDED)
+
+	for i := 0; i < 2; i++ {
+		if err := run.CountStats(s); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	st, _ := run.JobStats(s, "report")
+	if st.Succeeded != 2 || st.Failed != 1 || !st.LastSuccessAt.Equal(fireTime.Add(3*time.Hour)) {
+		t.Errorf("Expected every run recorded to be counted once. Observed: %+v", st)
+	}
+	if st, _ := run.ExecutorStats(s, "agent_1"); st.Runs() != 3 {
+		t.Errorf("Expected [%d] runs counted for the executor. Observed [%d]", 3, st.Runs())
+	}
+}
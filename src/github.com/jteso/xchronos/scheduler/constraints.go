@@ -0,0 +1,67 @@
+package scheduler
+
+import (
+	"fmt"
+
+	"github.com/jteso/xchronos/job"
+)
+
+// Satisfies tells whether an executor meets a constraint of a job
+func (e *Executor) Satisfies(c job.Constraint) bool {
+	value, found := e.Label(c.Label)
+	switch c.Operator {
+	case job.CONSTRAINT_EQUALS:
+		return found && value == c.Values[0]
+	case job.CONSTRAINT_NOT_EQUALS:
+		return !found || value != c.Values[0]
+	case job.CONSTRAINT_IN:
+		for _, v := range c.Values {
+			if found && value == v {
+				return true
+			}
+		}
+		return false
+	case job.CONSTRAINT_EXISTS:
+		return found
+	case job.CONSTRAINT_ANTI_AFFINITY:
+		for _, id := range c.Values {
+			if e.Jobs[id] > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Eligible returns the executors meeting every constraint of a job, and big enough for
+// its runs. It fails telling the constraint ruling the last ones out when there is none.
+func Eligible(j *job.Job, executors []*Executor) ([]*Executor, error) {
+	if len(executors) == 0 {
+		return executors, ErrNoExecutors
+	}
+	alive := len(executors)
+	for _, c := range j.Constraints {
+		eligible := []*Executor{}
+		for _, e := range executors {
+			if e.Satisfies(c) {
+				eligible = append(eligible, e)
+			}
+		}
+		if len(eligible) == 0 {
+			return eligible, fmt.Errorf("No executor meets [%s], %d alive", c, alive)
+		}
+		executors = eligible
+	}
+	slots := j.RunSlots()
+	eligible := []*Executor{}
+	for _, e := range executors {
+		if e.Capacity == 0 || e.Capacity >= slots {
+			eligible = append(eligible, e)
+		}
+	}
+	if len(eligible) == 0 {
+		return eligible, fmt.Errorf("No executor has %d capacity slots, %d alive", slots, alive)
+	}
+	return eligible, nil
+}
@@ -0,0 +1,105 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
+)
+
+func newLabelledExecutors() []*scheduler.Executor {
+	executors := newExecutors("agent_1", "agent_2", "agent_3")
+	executors[0].Labels = map[string]string{"region": "us-east-1", "diskType": "SSD"}
+	executors[0].Jobs = map[string]int{"apache": 1}
+	executors[1].Labels = map[string]string{"region": "us-west-1"}
+	executors[1].Hostname = "web-2"
+	executors[2].Labels = map[string]string{"region": "eu-west-1", "diskType": "HDD"}
+	return executors
+}
+
+func TestEligible(t *testing.T) {
+	tests := []struct {
+		constraint job.Constraint
+		expected   []string
+	}{
+		{job.Constraint{Label: "region", Operator: job.CONSTRAINT_EQUALS, Values: []string{"us-east-1"}}, []string{"agent_1"}},
+		{job.Constraint{Label: "diskType", Operator: job.CONSTRAINT_NOT_EQUALS, Values: []string{"SSD"}}, []string{"agent_2", "agent_3"}},
+		{job.Constraint{Label: "region", Operator: job.CONSTRAINT_IN, Values: []string{"us-east-1", "us-west-1"}}, []string{"agent_1", "agent_2"}},
+		{job.Constraint{Label: "diskType", Operator: job.CONSTRAINT_EXISTS}, []string{"agent_1", "agent_3"}},
+		{job.Constraint{Label: scheduler.LABEL_HOSTNAME, Operator: job.CONSTRAINT_EQUALS, Values: []string{"web-2"}}, []string{"agent_2"}},
+		{job.Constraint{Label: scheduler.LABEL_ID, Operator: job.CONSTRAINT_EQUALS, Values: []string{"agent_3"}}, []string{"agent_3"}},
+		{job.Constraint{Operator: job.CONSTRAINT_ANTI_AFFINITY, Values: []string{"apache"}}, []string{"agent_2", "agent_3"}},
+	}
+	for _, test := range tests {
+		j := job.New("report")
+		j.Constraints = []job.Constraint{test.constraint}
+		eligible, err := scheduler.Eligible(j, newLabelledExecutors())
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		ids := []string{}
+		for _, e := range eligible {
+			ids = append(ids, e.ID)
+		}
+		if len(ids) != len(test.expected) || ids[0] != test.expected[0] || ids[len(ids)-1] != test.expected[len(test.expected)-1] {
+			t.Errorf("Expected [%s] to be met by %v. Observed %v", test.constraint, test.expected, ids)
+		}
+	}
+}
+
+func TestEligibleUnsatisfiable(t *testing.T) {
+	j := job.New("report")
+	j.Constraints = []job.Constraint{
+		{Label: "region", Operator: job.CONSTRAINT_IN, Values: []string{"us-east-1", "eu-west-1"}},
+		{Label: "diskType", Operator: job.CONSTRAINT_EQUALS, Values: []string{"NVMe"}},
+	}
+	_, err := scheduler.Eligible(j, newLabelledExecutors())
+	if expected := "No executor meets [diskType equals [NVMe]], 3 alive"; err == nil || err.Error() != expected {
+		t.Errorf("Expected [%s]. Observed: %v", expected, err)
+	}
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	startedAt := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	value, _ := scheduler.EncodeMetadata(&scheduler.Metadata{StartedAt: startedAt, Labels: map[string]string{"region": "us-east-1"}})
+	m, err := scheduler.DecodeMetadata(value)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !m.StartedAt.Equal(startedAt) || m.Labels["region"] != "us-east-1" {
+		t.Errorf("Expected metadata to be decoded. Observed: %+v", m)
+	}
+}
+
+func TestSchedulerHonorsConstraints(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	for id, region := range map[string]string{"agent_1": "us-east-1", "agent_2": "us-west-1"} {
+		value, _ := scheduler.EncodeMetadata(&scheduler.Metadata{StartedAt: time.Now().UTC(), Labels: map[string]string{"region": region}})
+		s.Set(scheduler.EXECUTORS_DIR+"/"+id, value, 0)
+	}
+	west := newRepeatingJob("report", time.Hour, 0)
+	west.Constraints = []job.Constraint{{Label: "region", Operator: job.CONSTRAINT_EQUALS, Values: []string{"us-west-1"}}}
+	job.Create(s, west)
+	asia := newRepeatingJob("backup", time.Hour, 0)
+	asia.Constraints = []job.Constraint{{Label: "region", Operator: job.CONSTRAINT_EQUALS, Values: []string{"ap-south-1"}}}
+	job.Create(s, asia)
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	if offers := waitForOffers(t, s, "report", 1); len(offers) != 1 || offers[0].Executor != "agent_2" {
+		t.Errorf("Expected run offered to [%s]. Observed: %+v", "agent_2", offers)
+	}
+	f := waitForFire(t, s, "backup")
+	if f == nil || f.Status != run.FIRE_FAILED || len(f.Runs) != 1 {
+		t.Fatalf("Expected fire to fail. Observed: %+v", f)
+	}
+	records, _ := run.LastRuns(s, "backup", 1)
+	if expected := "No executor meets [region equals [ap-south-1]], 2 alive"; len(records) != 1 || records[0].Status != run.RUN_UNSCHEDULABLE || records[0].Error != expected {
+		t.Errorf("Expected run unschedulable as [%s]. Observed: %+v", expected, records)
+	}
+}
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Labels every executor has, on top of the ones it advertises
+const (
+	LABEL_ID       = "xchronos.id"
+	LABEL_HOSTNAME = "xchronos.hostname"
+	LABEL_VERSION  = "xchronos.version"
+)
+
+// Metadata is advertised by every executor as the value of EXECUTORS_DIR/<id>, renewed
+// with every heartbeat
+type Metadata struct {
+	// Time the agent started, telling a restart from a heartbeat
+	StartedAt time.Time `codec:"startedAt"`
+	Hostname  string    `codec:"hostname,omitempty"`
+	// Release of the agent
+	Version string `codec:"version,omitempty"`
+	// Capacity slots, taken by the runs (see job.Slots). Unlimited if 0
+	Capacity int `codec:"capacity,omitempty"`
+	// Slots taken by the runs being executed, as reported by the executor (see
+	// Executor.Utilization)
+	Usage int `codec:"usage,omitempty"`
+	// Checked against the constraints of the jobs, i.e. region=us-east-1
+	Labels map[string]string `codec:"labels,omitempty"`
+}
+
+// EncodeMetadata serializes the metadata of an executor
+func EncodeMetadata(m *Metadata) (string, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, jsonHandle).Encode(m)
+	return string(b), err
+}
+
+// DecodeMetadata deserializes the metadata of an executor
+func DecodeMetadata(value string) (*Metadata, error) {
+	m := &Metadata{}
+	if err := codec.NewDecoderBytes([]byte(value), jsonHandle).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Fits tells whether the executor has free capacity for a run taking the given slots
+func (e *Executor) Fits(slots int) bool {
+	return e.Capacity == 0 || e.Used+slots <= e.Capacity
+}
+
+// Utilization returns the fraction of its capacity the executor has taken, counting the
+// slots taken as the leader does or as the executor reports, whichever is higher. Slots
+// taken count whole for executors of unlimited capacity.
+func (e *Executor) Utilization() float64 {
+	taken := e.Used
+	if e.Usage > taken {
+		taken = e.Usage
+	}
+	if e.Capacity == 0 {
+		return float64(taken)
+	}
+	return float64(taken) / float64(e.Capacity)
+}
+
+// Label returns the value of a label of the executor, built-in ones (LABEL_*) included
+func (e *Executor) Label(name string) (string, bool) {
+	if value, found := e.Labels[name]; found {
+		return value, true
+	}
+	switch name {
+	case LABEL_ID:
+		return e.ID, true
+	case LABEL_HOSTNAME:
+		return e.Hostname, e.Hostname != ""
+	case LABEL_VERSION:
+		return e.Version, e.Version != ""
+	}
+	return "", false
+}
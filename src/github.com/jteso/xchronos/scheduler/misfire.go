@@ -0,0 +1,249 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+	"github.com/jteso/xchronos/trigger"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	MISFIRES_DIR = "/xchronos/var/misfires"
+)
+
+// What was done about a misfire
+const (
+	// fired once, right away
+	MISFIRE_ACTION_FIRE_NOW = "fire_now"
+	// every missed fire is fired, right away
+	MISFIRE_ACTION_CATCH_UP = "catch_up"
+	// missed fires are skipped, waiting for the next scheduled one
+	MISFIRE_ACTION_SKIP = "skip"
+)
+
+var (
+	// How late a fire has to be to be considered misfired
+	MISFIRE_THRESHOLD = 60 * time.Second
+	// How long misfire records are kept, deleted by the leader as it compacts the history
+	MISFIRE_RECORD_MAX_AGE = 7 * 24 * time.Hour
+	// Max number of missed fires counted for triggers other than simple ones
+	MISFIRE_COUNT_LIMIT = 10000
+
+	jsonHandle = new(codec.JsonHandle)
+)
+
+// Misfire records the decision taken about a job that could not be fired on time,
+// stored under MISFIRES_DIR/<job_id>/<detected_at>
+type Misfire struct {
+	JobID  string `codec:"jobId"`
+	Policy string `codec:"policy"`
+	// One of MISFIRE_ACTION_*
+	Action string `codec:"action"`
+	// First fire missed
+	ScheduledAt time.Time `codec:"scheduledAt"`
+	DetectedAt  time.Time `codec:"detectedAt"`
+	// Number of fires missed until DetectedAt (capped to MISFIRE_COUNT_LIMIT)
+	Missed int `codec:"missed"`
+	// When the job is fired next, zero if never
+	NextFireTime time.Time `codec:"nextFireTime"`
+}
+
+func (m *Misfire) String() string {
+	return fmt.Sprintf("Job %s misfired %d times since %s, applied %s: %s, next fire at %s",
+		m.JobID, m.Missed, m.ScheduledAt, m.Policy, m.Action, m.NextFireTime)
+}
+
+// HandleMisfire applies the misfire policy of a job whose next fire is late by more than
+// threshold, updating its trigger state accordingly. Returns nil if the job did not misfire.
+func HandleMisfire(j *job.Job, st *trigger.State, now time.Time, threshold time.Duration) (*Misfire, error) {
+	if st.NextFireTime.IsZero() || now.Sub(st.NextFireTime) <= threshold {
+		return nil, nil
+	}
+	tr, err := trigger.New(j.Trigger, st)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Misfire{
+		JobID:       j.ID,
+		Policy:      j.MisfirePolicy,
+		ScheduledAt: st.NextFireTime,
+		DetectedAt:  now,
+		Missed:      countMissed(tr, st.NextFireTime, now),
+	}
+	switch j.MisfirePolicy {
+	case job.MISFIRE_INSTRUCTION_IGNORE_MISFIRE_POLICY:
+		// fired from the first missed one on, as if nothing happened
+		m.Action = MISFIRE_ACTION_CATCH_UP
+
+	case job.MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_EXISTING_COUNT:
+		// the schedule is resumed from the next fire, honoring the total number of fires
+		m.Action = MISFIRE_ACTION_SKIP
+		st.NextFireTime = nextIgnoringCount(tr, now)
+		if !st.NextFireTime.IsZero() {
+			st.StartTime = st.NextFireTime
+		}
+
+	case job.MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT:
+		// missed fires count as fired
+		m.Action = MISFIRE_ACTION_SKIP
+		st.FiredCount += m.Missed
+		st.NextFireTime = tr.NextFireTime(now)
+
+	case job.MISFIRE_INSTRUCTION_RESCHEDULE_NOW_WITH_EXISTING_REPEAT_COUNT:
+		// the schedule starts over now, honoring the total number of fires
+		m.Action = MISFIRE_ACTION_FIRE_NOW
+		st.StartTime = now
+		st.NextFireTime = now
+
+	default:
+		// MISFIRE_INSTRUCTION_FIRE_NOW
+		m.Action = MISFIRE_ACTION_FIRE_NOW
+		st.NextFireTime = now
+	}
+	m.NextFireTime = st.NextFireTime
+	return m, nil
+}
+
+// countMissed returns the number of fires from `from` (a fire time) to now
+func countMissed(tr trigger.Trigger, from time.Time, now time.Time) int {
+	if simple, ok := tr.(*trigger.SimpleTrigger); ok {
+		if simple.RepeatInterval <= 0 {
+			return 1
+		}
+		missed := int(now.Sub(from)/simple.RepeatInterval) + 1
+		if simple.RepeatCount >= 0 && missed > simple.RepeatCount-simple.FiredCount+1 {
+			missed = simple.RepeatCount - simple.FiredCount + 1
+		}
+		return missed
+	}
+
+	missed := 0
+	for next := from; !next.IsZero() && !next.After(now) && missed < MISFIRE_COUNT_LIMIT; next = tr.NextFireTime(next) {
+		missed++
+	}
+	return missed
+}
+
+// nextIgnoringCount returns the next fire time after now, even if the number of fires
+// of a simple trigger is already exhausted by the missed ones
+func nextIgnoringCount(tr trigger.Trigger, now time.Time) time.Time {
+	if simple, ok := tr.(*trigger.SimpleTrigger); ok {
+		unbounded := *simple
+		unbounded.RepeatCount = -1
+		unbounded.FiredCount = 0
+		return unbounded.NextFireTime(now)
+	}
+	return tr.NextFireTime(now)
+}
+
+// CheckMisfires applies the misfire policies of every enabled job, to be called by a
+// scheduler becoming leader. Decisions are recorded, see `ListMisfires`. Jobs that
+// cannot be decoded or scheduled are skipped, the scheduler reports them.
+func CheckMisfires(s store.JobStore, now time.Time) ([]*Misfire, error) {
+	jobs, err := job.List(s)
+	if _, ok := err.(*job.ListError); err != nil && !ok {
+		return nil, err
+	}
+
+	misfires := []*Misfire{}
+	for _, j := range jobs {
+		if !j.Enabled {
+			continue
+		}
+		st, err := trigger.LoadState(s, j.ID)
+		if err == trigger.ErrStateNotFound {
+			// never scheduled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		m, err := HandleMisfire(j, st, now, MISFIRE_THRESHOLD)
+		if err != nil || m == nil {
+			// unschedulable jobs included
+			continue
+		}
+		if err := trigger.SaveState(s, st); err != nil {
+			return nil, err
+		}
+		if err := RecordMisfire(s, m); err != nil {
+			return nil, err
+		}
+		misfires = append(misfires, m)
+	}
+	return misfires, nil
+}
+
+// RecordMisfire stores a misfire decision, so operators can tell why a job ran late or
+// was skipped
+func RecordMisfire(s store.JobStore, m *Misfire) error {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, jsonHandle).Encode(m); err != nil {
+		return err
+	}
+	_, err := s.Set(MisfireKey(m.JobID, m.DetectedAt), string(b), 0)
+	return err
+}
+
+func MisfireKey(jobID string, detectedAt time.Time) string {
+	return fmt.Sprintf("%s/%s/%020d", MISFIRES_DIR, jobID, detectedAt.UnixNano())
+}
+
+// ListMisfires returns the misfire decisions recorded for a job, oldest first
+func ListMisfires(s store.JobStore, jobID string) ([]*Misfire, error) {
+	nodes, err := s.List(MISFIRES_DIR+"/"+jobID, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Misfire{}, nil
+		}
+		return nil, err
+	}
+
+	misfires := []*Misfire{}
+	for _, n := range nodes {
+		m := &Misfire{}
+		if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(m); err != nil {
+			return nil, err
+		}
+		misfires = append(misfires, m)
+	}
+	return misfires, nil
+}
+
+// CompactMisfires deletes the misfire decisions recorded more than MISFIRE_RECORD_MAX_AGE
+// before now. It returns the number of decisions deleted.
+func CompactMisfires(s store.JobStore, now time.Time) (int, error) {
+	nodes, err := s.List(MISFIRES_DIR, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	deleted := 0
+	for _, n := range nodes {
+		if !n.Dir {
+			continue
+		}
+		misfires, err := ListMisfires(s, store.Base(n.Key))
+		if err != nil {
+			return deleted, err
+		}
+		for _, m := range misfires {
+			if !m.DetectedAt.Before(now.Add(-MISFIRE_RECORD_MAX_AGE)) {
+				continue
+			}
+			if _, err := s.Delete(MisfireKey(m.JobID, m.DetectedAt), false); err != nil && !store.IsKeyNotFound(err) {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,133 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
+	"github.com/jteso/xchronos/trigger"
+)
+
+var scheduledAt = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newMisfiredJob returns a job firing every minute, 11 times, which fired twice and
+// then missed the fires from 00:02 to 00:05
+func newMisfiredJob(policy string) (*job.Job, *trigger.State) {
+	j := job.New("report")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_COMMAND, Command: "/usr/bin/report.sh"}
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_SIMPLE, RepeatInterval: time.Minute, RepeatCount: 10}
+	j.MisfirePolicy = policy
+
+	st := trigger.NewState(j, scheduledAt)
+	st.Fired(scheduledAt, scheduledAt.Add(time.Minute))
+	st.Fired(scheduledAt.Add(time.Minute), scheduledAt.Add(2*time.Minute))
+	return j, st
+}
+
+// remainingFires returns the fires left from the trigger state on
+func remainingFires(t *testing.T, j *job.Job, st *trigger.State) []time.Time {
+	fires := []time.Time{}
+	for next := st.NextFireTime; !next.IsZero() && len(fires) < 100; {
+		fires = append(fires, next)
+		st.Fired(next, time.Time{})
+		tr, err := trigger.New(j.Trigger, st)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		next = tr.NextFireTime(next)
+	}
+	return fires
+}
+
+func TestMisfirePolicies(t *testing.T) {
+	now := scheduledAt.Add(5*time.Minute + 30*time.Second)
+	cases := []struct {
+		policy    string
+		action    string
+		first     time.Time
+		remaining int
+	}{
+		{job.MISFIRE_INSTRUCTION_FIRE_NOW, scheduler.MISFIRE_ACTION_FIRE_NOW, now, 6},
+		{job.MISFIRE_INSTRUCTION_IGNORE_MISFIRE_POLICY, scheduler.MISFIRE_ACTION_CATCH_UP, scheduledAt.Add(2 * time.Minute), 9},
+		{job.MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_EXISTING_COUNT, scheduler.MISFIRE_ACTION_SKIP, scheduledAt.Add(6 * time.Minute), 9},
+		{job.MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT, scheduler.MISFIRE_ACTION_SKIP, scheduledAt.Add(6 * time.Minute), 5},
+		{job.MISFIRE_INSTRUCTION_RESCHEDULE_NOW_WITH_EXISTING_REPEAT_COUNT, scheduler.MISFIRE_ACTION_FIRE_NOW, now, 9},
+	}
+
+	for _, c := range cases {
+		j, st := newMisfiredJob(c.policy)
+		m, err := scheduler.HandleMisfire(j, st, now, time.Minute)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if m == nil || m.Action != c.action || m.Missed != 4 {
+			t.Errorf("Expected %s to %s 4 missed fires. Observed: %v", c.policy, c.action, m)
+			continue
+		}
+		fires := remainingFires(t, j, st)
+		if len(fires) != c.remaining || !fires[0].Equal(c.first) {
+			t.Errorf("Expected %s to fire [%d] more times from [%s]. Observed %v", c.policy, c.remaining, c.first, fires)
+		}
+	}
+}
+
+func TestMisfireThreshold(t *testing.T) {
+	j, st := newMisfiredJob(job.MISFIRE_INSTRUCTION_FIRE_NOW)
+	m, err := scheduler.HandleMisfire(j, st, scheduledAt.Add(2*time.Minute+30*time.Second), time.Minute)
+	if err != nil || m != nil {
+		t.Errorf("Expected a fire late by less than the threshold not to misfire. Observed: %v %v", m, err)
+	}
+}
+
+func TestCheckMisfires(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	j, st := newMisfiredJob(job.MISFIRE_INSTRUCTION_RESCHEDULE_NEXT_WITH_REMAINING_COUNT)
+	if err := job.Create(s, j); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := trigger.SaveState(s, st); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	now := scheduledAt.Add(5*time.Minute + 30*time.Second)
+	misfires, err := scheduler.CheckMisfires(s, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(misfires) != 1 {
+		t.Fatalf("Expected [%d] misfires. Observed [%d] misfires", 1, len(misfires))
+	}
+
+	// the decision is saved and recorded
+	st, _ = trigger.LoadState(s, j.ID)
+	if !st.NextFireTime.Equal(scheduledAt.Add(6*time.Minute)) || st.FiredCount != 6 {
+		t.Errorf("Expected trigger state to be rescheduled. Observed: %+v", st)
+	}
+	recorded, err := scheduler.ListMisfires(s, j.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(recorded) != 1 || recorded[0].Missed != 4 || !recorded[0].DetectedAt.Equal(now) {
+		t.Errorf("Expected misfire to be recorded. Observed: %+v", recorded)
+	}
+
+	// already handled
+	if misfires, _ := scheduler.CheckMisfires(s, now); len(misfires) != 0 {
+		t.Errorf("Expected [%d] misfires. Observed [%d] misfires", 0, len(misfires))
+	}
+
+	// kept for a week
+	if deleted, err := scheduler.CompactMisfires(s, now.Add(scheduler.MISFIRE_RECORD_MAX_AGE)); err != nil || deleted != 0 {
+		t.Errorf("Expected no misfire deleted. Observed [%d] %v", deleted, err)
+	}
+	if deleted, err := scheduler.CompactMisfires(s, now.Add(scheduler.MISFIRE_RECORD_MAX_AGE+time.Second)); err != nil || deleted != 1 {
+		t.Errorf("Expected [%d] misfires deleted. Observed [%d] %v", 1, deleted, err)
+	}
+	if recorded, _ := scheduler.ListMisfires(s, j.ID); len(recorded) != 0 {
+		t.Errorf("Expected misfire to be deleted. Observed: %+v", recorded)
+	}
+}
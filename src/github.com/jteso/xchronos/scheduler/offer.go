@@ -0,0 +1,65 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	OFFERS_DIR = "/xchronos/var/offers"
+)
+
+// Offer is a job run offered by the leader to an executor, stored under
+// OFFERS_DIR/<executor>/<run_id> until the executor claims the run (see `run.Claim`)
+type Offer struct {
+	RunID string `codec:"runId"`
+	JobID string `codec:"jobId"`
+	// Executor the run is offered to
+	Executor string `codec:"executor"`
+	// Attempt of the run being offered
+	Attempt int `codec:"attempt"`
+	// Time the job was due
+	FireTime  time.Time `codec:"fireTime"`
+	OfferedAt time.Time `codec:"offeredAt"`
+}
+
+// NewOffer returns the offer of the current attempt of a run
+func NewOffer(r *run.Run) *Offer {
+	return &Offer{
+		RunID:     r.ID,
+		JobID:     r.JobID,
+		Executor:  r.Executor,
+		Attempt:   r.Attempt,
+		FireTime:  r.FireTime,
+		OfferedAt: r.OfferedAt,
+	}
+}
+
+// OfferKey returns the job store key an offer is published at
+func OfferKey(executor string, runID string) string {
+	return OFFERS_DIR + "/" + executor + "/" + runID
+}
+
+// PublishOffer writes an offer to the queue of its executor. It fails with a
+// store.ErrCodeNodeExist error if it is there already.
+func PublishOffer(s store.JobStore, o *Offer) error {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, jsonHandle).Encode(o); err != nil {
+		return err
+	}
+	_, err := s.Create(OfferKey(o.Executor, o.RunID), string(b), 0)
+	return err
+}
+
+// DecodeOffer decodes an offer read from the job store, i.e. received via Watch
+func DecodeOffer(n *store.Node) (*Offer, error) {
+	o := &Offer{}
+	if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+)
+
+const (
+	EXECUTORS_DIR = "/xchronos/etc/executors"
+)
+
+var (
+	ErrNoExecutors = errors.New("No executor available")
+	ErrSaturated   = errors.New("No executor with free capacity")
+
+	// Placement of the jobs not choosing one
+	DEFAULT_PLACEMENT = job.PLACEMENT_ROUND_ROBIN
+)
+
+// Executor is an agent advertising itself under EXECUTORS_DIR/<id>, with its metadata
+// as value
+type Executor struct {
+	ID string
+	Metadata
+	// Number of offers waiting in its queue
+	Load int
+	// Capacity slots taken by the runs offered to, or run by, the executor. Counted by the
+	// leader, so runs just offered or finished are taken into account before the executor
+	// reports them
+	Used int
+	// Number of runs of every job offered to, or run by, the executor, by job id
+	Jobs map[string]int
+}
+
+// Placement chooses the executor a run is offered to, out of the live ones (never empty,
+// sorted by id)
+type Placement interface {
+	Place(r *run.Run, executors []*Executor) *Executor
+}
+
+// RoundRobin offers every run to the next executor
+type RoundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *RoundRobin) Place(r *run.Run, executors []*Executor) *Executor {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e := executors[p.next%len(executors)]
+	p.next++
+	return e
+}
+
+// LeastLoaded offers every run to the executor using the smallest fraction of its capacity
+// (see Executor.Utilization), the one with the fewest offers in its queue on a tie
+type LeastLoaded struct{}
+
+func (p LeastLoaded) Place(r *run.Run, executors []*Executor) *Executor {
+	least := executors[0]
+	for _, e := range executors[1:] {
+		used, leastUsed := e.Utilization(), least.Utilization()
+		if used < leastUsed || (used == leastUsed && e.Load < least.Load) {
+			least = e
+		}
+	}
+	return least
+}
+
+// Random offers every run to any executor
+type Random struct{}
+
+func (p Random) Place(r *run.Run, executors []*Executor) *Executor {
+	return executors[rand.Intn(len(executors))]
+}
+
+// Sticky offers every run of a job to the same executor for as long as it is alive. It
+// uses rendezvous hashing, so executors joining or leaving only move the jobs they win
+// or lose.
+type Sticky struct{}
+
+func (p Sticky) Place(r *run.Run, executors []*Executor) *Executor {
+	var best *Executor
+	var bestWeight uint64
+	for _, e := range executors {
+		h := fnv.New64a()
+		h.Write([]byte(r.JobID + "/" + e.ID))
+		if weight := h.Sum64(); best == nil || weight > bestWeight {
+			best, bestWeight = e, weight
+		}
+	}
+	return best
+}
+
+// DefaultPlacements returns a new instance of every built-in strategy, by name
+func DefaultPlacements() map[string]Placement {
+	return map[string]Placement{
+		job.PLACEMENT_ROUND_ROBIN:  &RoundRobin{},
+		job.PLACEMENT_LEAST_LOADED: LeastLoaded{},
+		job.PLACEMENT_RANDOM:       Random{},
+		job.PLACEMENT_STICKY:       Sticky{},
+	}
+}
+
+// ListExecutors returns the live executors, sorted by id, along with their load and
+// the jobs they run
+func ListExecutors(s store.JobStore) ([]*Executor, error) {
+	nodes, err := s.List(EXECUTORS_DIR, false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return []*Executor{}, nil
+		}
+		return nil, err
+	}
+	executors := []*Executor{}
+	byID := map[string]*Executor{}
+	for _, n := range nodes {
+		if n.Dir {
+			continue
+		}
+		m, err := DecodeMetadata(n.Value)
+		if err != nil {
+			// an executor advertising nonsense gets nothing to run
+			continue
+		}
+		e := &Executor{ID: store.Base(n.Key), Metadata: *m, Jobs: map[string]int{}}
+		executors = append(executors, e)
+		byID[e.ID] = e
+	}
+	sort.Sort(executorsByID(executors))
+
+	offers, err := s.List(OFFERS_DIR, true)
+	if err != nil && !store.IsKeyNotFound(err) {
+		return nil, err
+	}
+	for _, n := range offers {
+		// OFFERS_DIR/<executor>/<run_id>
+		id := strings.SplitN(strings.TrimPrefix(n.Key, OFFERS_DIR+"/"), "/", 2)[0]
+		if e, found := byID[id]; found {
+			e.Load++
+		}
+	}
+
+	runs, err := run.List(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range runs {
+		if e, found := byID[r.Executor]; found && r.Active() && r.Status != run.RUN_RETRYING {
+			e.Jobs[r.JobID]++
+			e.Used += r.TakenSlots()
+		}
+	}
+	return executors, nil
+}
+
+type executorsByID []*Executor
+
+func (es executorsByID) Len() int           { return len(es) }
+func (es executorsByID) Less(i, j int) bool { return es[i].ID < es[j].ID }
+func (es executorsByID) Swap(i, j int)      { es[i], es[j] = es[j], es[i] }
@@ -0,0 +1,126 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
+)
+
+func newExecutors(ids ...string) []*scheduler.Executor {
+	executors := []*scheduler.Executor{}
+	for _, id := range ids {
+		executors = append(executors, &scheduler.Executor{ID: id})
+	}
+	return executors
+}
+
+func newJobRun(jobID string) *run.Run {
+	return run.New(jobID, scheduledAt, "")
+}
+
+func TestRoundRobin(t *testing.T) {
+	executors := newExecutors("agent_1", "agent_2", "agent_3")
+	p := &scheduler.RoundRobin{}
+	for i, expected := range []string{"agent_1", "agent_2", "agent_3", "agent_1"} {
+		if e := p.Place(newJobRun("report"), executors); e.ID != expected {
+			t.Errorf("Expected offer #%d placed on [%s]. Observed [%s]", i, expected, e.ID)
+		}
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	executors := newExecutors("agent_1", "agent_2", "agent_3")
+	executors[0].Load = 3
+	executors[1].Load = 1
+	executors[2].Load = 1
+	if e := (scheduler.LeastLoaded{}).Place(newJobRun("report"), executors); e.ID != "agent_2" {
+		t.Errorf("Expected offer placed on [%s]. Observed [%s]", "agent_2", e.ID)
+	}
+
+	// a quarter, half and three quarters of their capacity taken
+	executors[0].Capacity, executors[0].Used = 8, 2
+	executors[1].Capacity, executors[1].Used = 2, 1
+	executors[2].Capacity, executors[2].Used, executors[2].Usage = 4, 1, 3
+	if e := (scheduler.LeastLoaded{}).Place(newJobRun("report"), executors); e.ID != "agent_1" {
+		t.Errorf("Expected offer placed on [%s]. Observed [%s]", "agent_1", e.ID)
+	}
+}
+
+func TestSticky(t *testing.T) {
+	executors := newExecutors("agent_1", "agent_2", "agent_3", "agent_4")
+	placed := map[string]string{}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		placed[id] = (scheduler.Sticky{}).Place(newJobRun(id), executors).ID
+		if again := (scheduler.Sticky{}).Place(newJobRun(id), executors).ID; again != placed[id] {
+			t.Errorf("Expected job [%s] to stick to [%s]. Observed [%s]", id, placed[id], again)
+		}
+	}
+
+	// only the jobs of the executor gone are moved
+	gone := placed["a"]
+	alive := []*scheduler.Executor{}
+	for _, e := range executors {
+		if e.ID != gone {
+			alive = append(alive, e)
+		}
+	}
+	for id, previous := range placed {
+		e := (scheduler.Sticky{}).Place(newJobRun(id), alive)
+		if previous != gone && e.ID != previous {
+			t.Errorf("Expected job [%s] to stay on [%s]. Observed [%s]", id, previous, e.ID)
+		}
+	}
+}
+
+func TestListExecutors(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_2", "agent_1")
+	scheduler.PublishOffer(s, scheduler.NewOffer(run.New("report", scheduledAt, "agent_2")))
+	scheduler.PublishOffer(s, scheduler.NewOffer(run.New("report", scheduledAt.Add(time.Minute), "agent_2")))
+
+	executors, err := scheduler.ListExecutors(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(executors) != 2 || executors[0].ID != "agent_1" || executors[0].Load != 0 || executors[1].Load != 2 {
+		t.Errorf("Expected agent_1 idle and agent_2 with 2 offers. Observed: %+v %+v", executors[0], executors[1])
+	}
+}
+
+func TestSchedulerPlacesOffers(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	defer func(wait time.Duration) { scheduler.SCHEDULER_RETRY_WAIT = wait }(scheduler.SCHEDULER_RETRY_WAIT)
+	scheduler.SCHEDULER_RETRY_WAIT = 20 * time.Millisecond
+
+	j := newRepeatingJob("report", 20*time.Millisecond, 3)
+	j.Placement = job.PLACEMENT_STICKY
+	job.Create(s, j)
+
+	// nothing is fired until there are executors
+	stop := startScheduler(t, s)
+	defer stop()
+	time.Sleep(50 * time.Millisecond)
+	if offers := listOffers(t, s, "report"); len(offers) != 0 {
+		t.Fatalf("Expected no offers without executors. Observed [%d] offers", len(offers))
+	}
+
+	addExecutors(s, "agent_1", "agent_2", "agent_3")
+	offers := waitForOffers(t, s, "report", 4)
+	if len(offers) != 4 {
+		t.Fatalf("Expected [%d] offers. Observed [%d] offers", 4, len(offers))
+	}
+	for _, o := range offers {
+		if o.Executor != offers[0].Executor {
+			t.Errorf("Expected every offer placed on [%s]. Observed [%s]", offers[0].Executor, o.Executor)
+		}
+		if _, err := s.Get(scheduler.OfferKey(o.Executor, o.RunID), false); err != nil {
+			t.Errorf("Expected offer in the queue of [%s]. Observed: %s", o.Executor, err.Error())
+		}
+	}
+}
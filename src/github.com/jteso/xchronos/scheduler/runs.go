@@ -0,0 +1,422 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+)
+
+// applyRun reacts to a change under RUNS_DIR, keeping track of the runs to retry and
+// recording, then deleting, the ones finished
+func (s *Scheduler) applyRun(resp *store.Response) {
+	if resp.Node == nil || resp.Node.Dir {
+		return
+	}
+	id := store.Base(resp.Node.Key)
+	switch resp.Action {
+	case store.ActionDelete, store.ActionExpire, store.ActionCompareAndDelete:
+		delete(s.retries, id)
+		delete(s.queued, id)
+		s.dispatchPending = true
+		return
+	}
+
+	r, err := run.FromNode(resp.Node)
+	if err != nil {
+		s.logf("Ignoring run %s: %s", resp.Node.Key, err.Error())
+		return
+	}
+	if known, found := s.retries[id]; found && known.Index() >= r.Index() {
+		// already seen, i.e. replayed by the watch
+		return
+	}
+	if r.Status == run.RUN_RETRYING {
+		s.retries[id] = r
+	} else {
+		delete(s.retries, id)
+	}
+	if r.Status == run.RUN_QUEUED {
+		s.queued[id] = r
+	} else {
+		delete(s.queued, id)
+	}
+	if r.Status == run.RUN_RETRYING || !r.Active() {
+		// capacity freed
+		s.dispatchPending = true
+	}
+	if r.Active() {
+		return
+	}
+	s.archive(r)
+	if err := s.settle(r.FireID); err != nil {
+		s.logf("Fire %s not settled: %s", r.FireID, err.Error())
+	}
+	if err := s.prune(r); err != nil && err != run.ErrRunModified && err != run.ErrFireModified {
+		s.logf("Run %s not deleted: %s", r.ID, err.Error())
+	}
+}
+
+// archive records a finished run in the history of its job, counting it in the stats
+// of the job and executor. Once the stats could not be updated, runs are counted from the
+// history, so none is skipped (see run.CountStats).
+func (s *Scheduler) archive(r *run.Run) {
+	rec, err := run.Archive(s.store, r)
+	switch err {
+	case nil:
+	case run.ErrRecordExists:
+		return
+	default:
+		s.logf("Run %s not recorded: %s", r.ID, err.Error())
+		return
+	}
+	if s.statsPending {
+		err = run.CountStats(s.store)
+	} else {
+		err = run.AddStats(s.store, rec)
+	}
+	if err != nil {
+		s.logf("Run %s not counted in stats yet: %s", r.ID, err.Error())
+	}
+	s.statsPending = err != nil
+}
+
+// prune deletes a finished run once recorded, along with the rest of its fire once
+// settled (see run.Prune)
+func (s *Scheduler) prune(r *run.Run) error {
+	f, err := run.GetFire(s.store, r.FireID)
+	switch err {
+	case nil:
+		_, err = run.Prune(s.store, f)
+		return err
+	case run.ErrFireNotFound:
+		// pruned already
+		return nil
+	}
+	return err
+}
+
+// compact enforces the retention of the history of the jobs, and of the misfire decisions,
+// every HISTORY_COMPACTION_INTERVAL, until stop is closed. done is closed on return.
+func (s *Scheduler) compact(stop chan bool, done chan bool) {
+	defer close(done)
+	ticker := time.NewTicker(HISTORY_COMPACTION_INTERVAL)
+	defer ticker.Stop()
+	for {
+		if deleted, err := run.Compact(s.store, time.Now().UTC()); err != nil {
+			s.logf("History not compacted: %s", err.Error())
+		} else if deleted > 0 {
+			s.logf("History compacted, %d runs deleted", deleted)
+		}
+		if deleted, err := CompactMisfires(s.store, time.Now().UTC()); err != nil {
+			s.logf("Misfires not compacted: %s", err.Error())
+		} else if deleted > 0 {
+			s.logf("Misfires compacted, %d decisions deleted", deleted)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// settle settles a fire once the outcome of its runs is known, as the success policy of
+// its job tells
+func (s *Scheduler) settle(id string) error {
+	f, err := run.GetFire(s.store, id)
+	switch {
+	case err == run.ErrFireNotFound:
+		// settled and pruned already, i.e. the run is read again on failover
+		return nil
+	case err != nil:
+		return err
+	case !f.Active():
+		return nil
+	}
+	runs, err := run.FireRuns(s.store, f)
+	if err != nil {
+		return err
+	}
+	if !f.Settle(runs, time.Now().UTC()) {
+		return nil
+	}
+	switch err := run.UpdateFire(s.store, f); err {
+	case nil:
+	case run.ErrFireModified, run.ErrFireNotFound:
+		// settled in the meantime
+		return nil
+	default:
+		return err
+	}
+	if f.Status == run.FIRE_FAILED {
+		s.logf("Fire %s of job %s failed: %s", f.ID, f.JobID, f.Error)
+	} else {
+		s.logf("Fire %s of job %s %s, %d of %d runs succeeded", f.ID, f.JobID, f.Status, f.Succeeded, len(f.Runs))
+	}
+	return nil
+}
+
+// settleFires settles the fires whose runs finished while there was no leader
+func (s *Scheduler) settleFires() error {
+	fires, err := run.ListFires(s.store)
+	if err != nil {
+		return err
+	}
+	for _, f := range fires {
+		if f.Active() {
+			if err := s.settle(f.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// busyExecutors returns the executors running other replicas of the fire of a run
+func (s *Scheduler) busyExecutors(r *run.Run) map[string]bool {
+	busy := map[string]bool{}
+	for _, id := range r.Siblings() {
+		if sibling, err := run.Get(s.store, id); err == nil && sibling.Active() {
+			busy[sibling.Executor] = true
+		}
+	}
+	return busy
+}
+
+// nextRetryAt returns the time the next retry is due, zero if there is none
+func (s *Scheduler) nextRetryAt() time.Time {
+	next := time.Time{}
+	for _, r := range s.retries {
+		if next.IsZero() || r.RetryAt.Before(next) {
+			next = r.RetryAt
+		}
+	}
+	return next
+}
+
+// retryDue offers the next attempt of every run due by now
+func (s *Scheduler) retryDue(now time.Time, executors []*Executor) error {
+	for id, r := range s.retries {
+		if r.RetryAt.After(now) {
+			continue
+		}
+		delete(s.retries, id)
+
+		if err := s.retry(r, executors, now.UTC()); err != nil {
+			return err
+		}
+		switch err := run.Update(s.store, r); err {
+		case nil:
+		case run.ErrRunModified, run.ErrRunNotFound:
+			// changed in the meantime, the watch tells how
+			continue
+		default:
+			return err
+		}
+
+		switch {
+		case r.Status == run.RUN_QUEUED:
+			s.queued[id] = r
+			s.logf("Run %s retried, attempt %d queued: %s", r.ID, r.Attempt, ErrSaturated.Error())
+			continue
+		case !r.Active():
+			s.logf("Run %s %s: %s", r.ID, r.Status, r.Error)
+			continue
+		}
+		if err := s.offer(r); err != nil {
+			return err
+		}
+		s.logf("Run %s retried, attempt %d offered to %s", r.ID, r.Attempt, r.Executor)
+	}
+	return nil
+}
+
+// retry offers the next attempt of a run, finishing it if it can not be run anymore
+func (s *Scheduler) retry(r *run.Run, executors []*Executor, now time.Time) error {
+	if _, found := s.entries[r.JobID]; !found {
+		return r.Finish(run.RUN_FAILED, job.ErrJobNotFound, now)
+	}
+	target, err := s.place(r, executors, s.busyExecutors(r))
+	switch {
+	case err == ErrSaturated:
+		return r.Queue(now)
+	case err != nil:
+		return r.Finish(run.RUN_UNSCHEDULABLE, err, now)
+	}
+	return r.Reoffer(target.ID, now)
+}
+
+// dispatch offers the queued runs to the executors with free capacity, the ones of the
+// jobs with the highest priority first, then the oldest ones
+func (s *Scheduler) dispatch(executors []*Executor, now time.Time) error {
+	s.dispatchPending = false
+	queued := []*run.Run{}
+	for _, r := range s.queued {
+		queued = append(queued, r)
+	}
+	sort.Slice(queued, func(i, k int) bool {
+		if pi, pk := s.priority(queued[i]), s.priority(queued[k]); pi != pk {
+			return pi > pk
+		}
+		if !queued[i].QueuedAt.Equal(queued[k].QueuedAt) {
+			return queued[i].QueuedAt.Before(queued[k].QueuedAt)
+		}
+		return queued[i].ID < queued[k].ID
+	})
+
+	for _, r := range queued {
+		var err error
+		if _, found := s.entries[r.JobID]; !found {
+			err = r.Finish(run.RUN_FAILED, job.ErrJobNotFound, now)
+		} else if target, placeErr := s.place(r, executors, s.busyExecutors(r)); placeErr == ErrSaturated {
+			// smaller runs may fit still
+			continue
+		} else if placeErr != nil {
+			err = r.Finish(run.RUN_UNSCHEDULABLE, placeErr, now)
+		} else {
+			err = r.Offer(target.ID, now)
+		}
+		if err != nil {
+			return err
+		}
+		delete(s.queued, r.ID)
+		switch err := run.Update(s.store, r); err {
+		case nil:
+		case run.ErrRunModified, run.ErrRunNotFound:
+			// changed in the meantime, the watch tells how
+			continue
+		default:
+			return err
+		}
+
+		if !r.Active() {
+			s.logf("Run %s %s: %s", r.ID, r.Status, r.Error)
+			continue
+		}
+		if err := s.offer(r); err != nil {
+			return err
+		}
+		s.logf("Run %s dequeued, offered to %s", r.ID, r.Executor)
+	}
+	return nil
+}
+
+// priority returns the priority of the job of a run
+func (s *Scheduler) priority(r *run.Run) int {
+	if e, found := s.entries[r.JobID]; found {
+		return e.job.Priority
+	}
+	return 0
+}
+
+// recoverRuns goes through the runs not finished yet, failing the ones whose executor
+// is gone, or has restarted since claiming them. Runs not claimed yet are just moved to
+// a live executor. Runs finished but not recorded yet, i.e. before a failover, are
+// recorded too.
+func (s *Scheduler) recoverRuns() error {
+	runs, err := run.List(s.store)
+	if err != nil {
+		return err
+	}
+	executors, err := ListExecutors(s.store)
+	if err != nil {
+		return err
+	}
+	live := map[string]*Executor{}
+	for _, e := range executors {
+		live[e.ID] = e
+	}
+
+	now := time.Now().UTC()
+	for _, r := range runs {
+		if !r.Active() {
+			s.archive(r)
+			continue
+		}
+		e, found := live[r.Executor]
+		switch {
+		case r.Status == run.RUN_RETRYING:
+			s.retries[r.ID] = r
+			continue
+		case r.Status == run.RUN_QUEUED:
+			s.queued[r.ID] = r
+			continue
+		case found && r.Status == run.RUN_OFFERED:
+			// the offer may have not been published before a failover
+			if err := s.offer(r); err != nil {
+				return err
+			}
+			continue
+		case found && !e.StartedAt.After(r.ClaimedAt):
+			// still at it
+			continue
+		}
+		if err := s.recoverRun(r, executors, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverRun fails the attempt of a run whose executor has been lost, retrying it as
+// the retry policy of its job tells
+func (s *Scheduler) recoverRun(r *run.Run, executors []*Executor, now time.Time) error {
+	lost := r.Executor
+	var err error
+	switch {
+	case r.Status != run.RUN_OFFERED:
+		retry := &job.RetryPolicy{}
+		if e, found := s.entries[r.JobID]; found {
+			retry = &e.job.Retry
+		}
+		err = r.Fail(job.ERROR_CLASS_EXECUTOR_LOST, fmt.Errorf("Executor %s lost", lost), retry, now)
+	case len(executors) == 0:
+		// moved once an executor joins
+		s.logf("Run %s: %s", r.ID, ErrNoExecutors.Error())
+		return nil
+	default:
+		var target *Executor
+		switch target, err = s.place(r, executors, s.busyExecutors(r)); {
+		case err == ErrSaturated:
+			err = r.Queue(now)
+		case err != nil:
+			err = r.Finish(run.RUN_UNSCHEDULABLE, err, now)
+		default:
+			err = r.Move(target.ID, now)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	switch err := run.Update(s.store, r); err {
+	case nil:
+	case run.ErrRunModified, run.ErrRunNotFound:
+		// claimed or finished in the meantime
+		return nil
+	default:
+		return err
+	}
+	if _, err := s.store.Delete(OfferKey(lost, r.ID), false); err != nil && !store.IsKeyNotFound(err) {
+		return err
+	}
+
+	switch r.Status {
+	case run.RUN_RETRYING:
+		s.retries[r.ID] = r
+		s.logf("Run %s of executor %s lost, attempt %d due at %s", r.ID, lost, r.Attempt+1, r.RetryAt)
+	case run.RUN_OFFERED:
+		s.logf("Run %s of executor %s lost, moved to %s", r.ID, lost, r.Executor)
+		return s.offer(r)
+	case run.RUN_QUEUED:
+		s.queued[r.ID] = r
+		s.logf("Run %s of executor %s lost, queued: %s", r.ID, lost, ErrSaturated.Error())
+	default:
+		s.logf("Run %s %s, executor %s lost: %s", r.ID, r.Status, lost, r.Error)
+	}
+	return nil
+}
@@ -0,0 +1,604 @@
+package scheduler
+
+import (
+	"container/heap"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/store"
+	"github.com/jteso/xchronos/trigger"
+)
+
+const (
+	SCHEDULER_DIR = "/xchronos/var/scheduler"
+	// Written by a leader right before loading the jobs, so it watches them from then on
+	SCHEDULER_CHECKPOINT_KEY = SCHEDULER_DIR + "/checkpoint"
+)
+
+var (
+	// Max time sleeping when no job is due, the scheduler wakes up on job changes anyway
+	SCHEDULER_IDLE_WAIT = time.Hour
+	// Time to wait before firing again the jobs due when there was no executor
+	SCHEDULER_RETRY_WAIT = time.Second
+	// Time between compactions of the history of the jobs and misfire decisions (see
+	// run.Compact and CompactMisfires)
+	HISTORY_COMPACTION_INTERVAL = 10 * time.Minute
+)
+
+// entry is a scheduled job, queued by its next fire time
+type entry struct {
+	job   *job.Job
+	state *trigger.State
+	// position in the queue
+	pos int
+}
+
+// fireQueue is a min-heap of entries by next fire time
+type fireQueue []*entry
+
+func (q fireQueue) Len() int { return len(q) }
+
+func (q fireQueue) Less(i, j int) bool {
+	return q[i].state.NextFireTime.Before(q[j].state.NextFireTime)
+}
+
+func (q fireQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].pos = i
+	q[j].pos = j
+}
+
+func (q *fireQueue) Push(x interface{}) {
+	e := x.(*entry)
+	e.pos = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *fireQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	e.pos = -1
+	*q = old[:len(old)-1]
+	return e
+}
+
+// Scheduler fires the jobs of the job store as their triggers tell, creating a run and
+// publishing its offer for every fire. It also offers again the runs failed, as the retry
+// policies of their jobs tell. It is meant to run on the leader only.
+type Scheduler struct {
+	store store.JobStore
+	// scheduled jobs by id, the ones queued have a next fire time
+	entries map[string]*entry
+	queue   fireQueue
+	// store index job changes are watched from
+	watchIndex uint64
+	// placement strategies by name
+	placements map[string]Placement
+	// runs waiting for their next attempt, by id
+	retries map[string]*run.Run
+	// runs waiting for an executor with free capacity, by id
+	queued map[string]*run.Run
+	// capacity may have been freed since the queued runs were last dispatched
+	dispatchPending bool
+	// runs recorded may have not been counted in the stats
+	statsPending bool
+	// nothing is fired before then, i.e. no executor was available
+	retryAt time.Time
+
+	logf func(format string, v ...interface{})
+}
+
+func New(s store.JobStore, logf func(format string, v ...interface{})) *Scheduler {
+	return &Scheduler{
+		store:      s,
+		entries:    map[string]*entry{},
+		queue:      fireQueue{},
+		retries:    map[string]*run.Run{},
+		queued:     map[string]*run.Run{},
+		placements: DefaultPlacements(),
+		logf:       logf,
+	}
+}
+
+// SetPlacement replaces the strategy used by the jobs choosing the given placement
+func (s *Scheduler) SetPlacement(name string, p Placement) {
+	s.placements[name] = p
+}
+
+// Load (re)loads every job and trigger state from the job store, applying the misfire
+// policies of the jobs not fired on time, and recording, and counting in the stats, the
+// runs finished meanwhile
+func (s *Scheduler) Load() error {
+	// most writes go before the checkpoint, so the watches find it in the history of the
+	// store. Runs finished meanwhile are recorded as they are recovered.
+	misfires, err := CheckMisfires(s.store, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, m := range misfires {
+		s.logf("%s", m)
+	}
+	if err := run.CountStats(s.store); err != nil {
+		return err
+	}
+	s.statsPending = false
+
+	r, err := s.store.Set(SCHEDULER_CHECKPOINT_KEY, time.Now().UTC().Format(time.RFC3339Nano), 0)
+	if err != nil {
+		return err
+	}
+	s.watchIndex = r.Node.ModifiedIndex + 1
+
+	jobs, err := job.List(s.store)
+	if invalid, ok := err.(*job.ListError); ok {
+		for key, err := range invalid.Errors {
+			s.logf("Ignoring job %s: %s", key, err.Error())
+		}
+	} else if err != nil {
+		return err
+	}
+	s.entries = map[string]*entry{}
+	s.queue = fireQueue{}
+	for _, j := range jobs {
+		if err := s.schedule(j); err != nil {
+			return err
+		}
+	}
+	// executors may have been lost, and runs finished, while there was no leader
+	s.retries = map[string]*run.Run{}
+	s.queued = map[string]*run.Run{}
+	s.dispatchPending = true
+	if err := s.recoverRuns(); err != nil {
+		return err
+	}
+	return s.settleFires()
+}
+
+// watch is a running watch of a job store directory
+type watch struct {
+	receiver chan *store.Response
+	stop     chan bool
+	err      chan error
+}
+
+func (s *Scheduler) watch(dir string) *watch {
+	w := &watch{
+		receiver: make(chan *store.Response, 16),
+		stop:     make(chan bool, 1),
+		err:      make(chan error, 1),
+	}
+	go func() {
+		w.err <- s.store.Watch(dir, s.watchIndex, true, w.receiver, w.stop)
+	}()
+	return w
+}
+
+// close stops the watch, returning the error it failed with if it had stopped already
+func (w *watch) close() error {
+	w.stop <- true
+	for range w.receiver {
+	}
+	if err := <-w.err; err != store.ErrWatchStoppedByUser {
+		return err
+	}
+	return nil
+}
+
+// Run fires the jobs as they are due until stop is signaled, reacting to the changes
+// of the jobs, executors and runs in the meantime. Everything is loaded again whenever
+// changes were missed, i.e. the store cleared them before they were watched.
+func (s *Scheduler) Run(stop chan bool) error {
+	for {
+		err := s.run(stop)
+		if store.ErrorCode(err) != store.ErrCodeIndexCleared {
+			return err
+		}
+		s.logf("Reloading, changes missed: %s", err.Error())
+	}
+}
+
+func (s *Scheduler) run(stop chan bool) (err error) {
+	if err := s.Load(); err != nil {
+		return err
+	}
+
+	compactionStop, compacted := make(chan bool), make(chan bool)
+	go s.compact(compactionStop, compacted)
+	defer func() {
+		close(compactionStop)
+		<-compacted
+	}()
+
+	jobs := s.watch(job.JOBS_DIR)
+	executors := s.watch(EXECUTORS_DIR)
+	runs := s.watch(run.RUNS_DIR)
+	defer func() {
+		// the error of a failed watch tells more than the stop of its receiver
+		if watchErr := jobs.close(); watchErr != nil {
+			err = watchErr
+		}
+		if watchErr := executors.close(); watchErr != nil {
+			err = watchErr
+		}
+		if watchErr := runs.close(); watchErr != nil {
+			err = watchErr
+		}
+	}()
+
+	for {
+		timer := time.NewTimer(s.untilNext())
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+
+		case r, ok := <-jobs.receiver:
+			timer.Stop()
+			if !ok {
+				return fmt.Errorf("Watch of %s stopped", job.JOBS_DIR)
+			}
+			if err := s.apply(r); err != nil {
+				return err
+			}
+
+		case r, ok := <-executors.receiver:
+			timer.Stop()
+			if !ok {
+				return fmt.Errorf("Watch of %s stopped", EXECUTORS_DIR)
+			}
+			if err := s.applyExecutor(r); err != nil {
+				return err
+			}
+
+		case r, ok := <-runs.receiver:
+			timer.Stop()
+			if !ok {
+				return fmt.Errorf("Watch of %s stopped", run.RUNS_DIR)
+			}
+			s.applyRun(r)
+
+		case <-timer.C:
+			if err := s.fireDue(time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// untilNext returns the time to wait until the next fire, retry or dispatch of the
+// queued runs
+func (s *Scheduler) untilNext() time.Duration {
+	next := s.nextRetryAt()
+	if s.dispatchPending && len(s.queued) > 0 {
+		next = time.Now()
+	}
+	if len(s.queue) > 0 && (next.IsZero() || s.queue[0].state.NextFireTime.Before(next)) {
+		next = s.queue[0].state.NextFireTime
+	}
+	if next.IsZero() {
+		return SCHEDULER_IDLE_WAIT
+	}
+	if s.retryAt.After(next) {
+		next = s.retryAt
+	}
+	wait := next.Sub(time.Now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// apply reacts to a change under JOBS_DIR
+func (s *Scheduler) apply(r *store.Response) error {
+	switch r.Action {
+	case store.ActionDelete, store.ActionExpire, store.ActionCompareAndDelete:
+		id := store.Base(r.Node.Key)
+		s.logf("Job %s deleted", id)
+		s.unschedule(id)
+		return trigger.DeleteState(s.store, id)
+	}
+
+	if r.Node == nil || r.Node.Dir {
+		return nil
+	}
+	j, err := job.FromNode(r.Node)
+	if err != nil {
+		// a broken job must not stop the rest
+		s.logf("Ignoring job %s: %s", r.Node.Key, err.Error())
+		return nil
+	}
+	if e, found := s.entries[j.ID]; found && e.job.Index() >= j.Index() {
+		// already seen, i.e. replayed by the watch
+		return nil
+	}
+	s.logf("Job %s changed", j.ID)
+	// i.e. its constraints may be met now
+	s.dispatchPending = true
+	return s.schedule(j)
+}
+
+// applyExecutor reacts to a change under EXECUTORS_DIR, recovering the runs of the
+// executors lost or restarted, and the ones waiting for an executor to join
+func (s *Scheduler) applyExecutor(r *store.Response) error {
+	switch {
+	case r.Action == store.ActionDelete, r.Action == store.ActionExpire, r.Action == store.ActionCompareAndDelete:
+		s.logf("Executor %s lost", store.Base(r.Node.Key))
+	case r.PrevNode == nil:
+		s.logf("Executor %s joined", store.Base(r.Node.Key))
+		s.dispatchPending = true
+	case r.Node != nil && restarted(r.PrevNode.Value, r.Node.Value):
+		s.logf("Executor %s restarted", store.Base(r.Node.Key))
+	default:
+		// heartbeat
+		return nil
+	}
+	return s.recoverRuns()
+}
+
+// restarted tells whether an executor advertising the given metadata has restarted
+// since it advertised the previous one
+func restarted(prev string, value string) bool {
+	p, err := DecodeMetadata(prev)
+	if err != nil {
+		return prev != value
+	}
+	m, err := DecodeMetadata(value)
+	return err != nil || !p.StartedAt.Equal(m.StartedAt)
+}
+
+// schedule (re)schedules a job, starting its trigger over if it has changed
+func (s *Scheduler) schedule(j *job.Job) error {
+	prev, found := s.entries[j.ID]
+	s.unschedule(j.ID)
+
+	st, err := trigger.LoadState(s.store, j.ID)
+	switch {
+	case err == trigger.ErrStateNotFound:
+		st = trigger.NewState(j, time.Now())
+	case err != nil:
+		return err
+	case found && !reflect.DeepEqual(prev.job.Trigger, j.Trigger):
+		st.Reset(j, time.Now())
+	}
+
+	e := &entry{job: j, state: st, pos: -1}
+	s.entries[j.ID] = e
+	if !j.Enabled {
+		return nil
+	}
+
+	if st.FiredCount == 0 && st.NextFireTime.IsZero() {
+		// never fired
+		tr, err := trigger.New(j.Trigger, st)
+		if err != nil {
+			s.logf("Ignoring job %s: %s", j.ID, err.Error())
+			return nil
+		}
+		st.NextFireTime = tr.NextFireTime(st.StartTime.Add(-time.Nanosecond))
+		if err := trigger.SaveState(s.store, st); err != nil {
+			return err
+		}
+	}
+	if !st.NextFireTime.IsZero() {
+		heap.Push(&s.queue, e)
+	}
+	return nil
+}
+
+func (s *Scheduler) unschedule(id string) {
+	if e, found := s.entries[id]; found {
+		if e.pos >= 0 {
+			heap.Remove(&s.queue, e.pos)
+		}
+		delete(s.entries, id)
+	}
+}
+
+// fireDue offers the queued runs executors have capacity for, then fires every job, and
+// retries every run, due by now
+func (s *Scheduler) fireDue(now time.Time) error {
+	retryAt := s.nextRetryAt()
+	jobsDue := len(s.queue) > 0 && !s.queue[0].state.NextFireTime.After(now)
+	dispatchDue := s.dispatchPending && len(s.queued) > 0
+	if !jobsDue && !dispatchDue && (retryAt.IsZero() || retryAt.After(now)) {
+		return nil
+	}
+	executors, err := ListExecutors(s.store)
+	if err != nil {
+		return err
+	}
+	if len(executors) == 0 {
+		s.logf("%s, retrying in %s", ErrNoExecutors.Error(), SCHEDULER_RETRY_WAIT)
+		s.retryAt = now.Add(SCHEDULER_RETRY_WAIT)
+		return nil
+	}
+
+	if err := s.dispatch(executors, now.UTC()); err != nil {
+		return err
+	}
+	// jobs waiting for enough executors to be alive
+	waiting := []*entry{}
+	for len(s.queue) > 0 && !s.queue[0].state.NextFireTime.After(now) {
+		e := s.queue[0]
+		eligible, err := Eligible(e.job, executors)
+		if err == nil && e.job.ShortagePolicy == job.SHORTAGE_WAIT && len(eligible) < e.job.Availability {
+			s.logf("Job %s waiting for %d executors, %d eligible, retrying in %s", e.job.ID, e.job.Availability, len(eligible), SCHEDULER_RETRY_WAIT)
+			waiting = append(waiting, heap.Pop(&s.queue).(*entry))
+			continue
+		}
+		if err := s.fire(e, executors); err != nil {
+			return err
+		}
+	}
+	for _, e := range waiting {
+		heap.Push(&s.queue, e)
+		s.retryAt = now.Add(SCHEDULER_RETRY_WAIT)
+	}
+	return s.retryDue(now, executors)
+}
+
+// place chooses the executor a run is offered to, out of the ones meeting the
+// constraints of its job and with free capacity, as told by its placement. Busy
+// executors, i.e. running other replicas of the fire, are only chosen when there is no
+// other one. It fails when no executor meets the constraints, or with ErrSaturated when
+// none has free capacity.
+func (s *Scheduler) place(r *run.Run, executors []*Executor, busy map[string]bool) (*Executor, error) {
+	placement := DEFAULT_PLACEMENT
+	if e, found := s.entries[r.JobID]; found {
+		placement = e.job.Placement
+		var err error
+		if executors, err = Eligible(e.job, executors); err != nil {
+			return nil, err
+		}
+	}
+	p, found := s.placements[placement]
+	if !found {
+		p = s.placements[DEFAULT_PLACEMENT]
+	}
+	free := []*Executor{}
+	for _, e := range executors {
+		if e.Fits(r.TakenSlots()) {
+			free = append(free, e)
+		}
+	}
+	if len(free) == 0 {
+		return nil, ErrSaturated
+	}
+	candidates := []*Executor{}
+	for _, e := range free {
+		if !busy[e.ID] {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = free
+	}
+	e := p.Place(r, candidates)
+	e.Load++
+	e.Used += r.TakenSlots()
+	e.Jobs[r.JobID]++
+	return e, nil
+}
+
+// offer publishes the offer of the current attempt of a run, unless it is there already
+func (s *Scheduler) offer(r *run.Run) error {
+	if err := PublishOffer(s.store, NewOffer(r)); err != nil && !store.IsNodeExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fire creates and offers the next runs of a job, one per executor it is run by, and
+// works out the following fire
+func (s *Scheduler) fire(e *entry, executors []*Executor) error {
+	fireTime := e.state.NextFireTime
+	if err := s.fireReplicas(e.job, fireTime, executors); err != nil {
+		return err
+	}
+
+	e.state.Fired(fireTime, time.Time{})
+	tr, err := trigger.New(e.job.Trigger, e.state)
+	if err != nil {
+		s.logf("Ignoring job %s: %s", e.job.ID, err.Error())
+		heap.Remove(&s.queue, e.pos)
+		return nil
+	}
+	e.state.NextFireTime = tr.NextFireTime(fireTime)
+	if err := trigger.SaveState(s.store, e.state); err != nil {
+		return err
+	}
+
+	if e.state.NextFireTime.IsZero() {
+		heap.Remove(&s.queue, e.pos)
+	} else {
+		heap.Fix(&s.queue, e.pos)
+	}
+	return nil
+}
+
+// fireReplicas creates the fire of a job, offering a run of it to as many distinct
+// executors as its availability tells, or as the shortage policy allows
+func (s *Scheduler) fireReplicas(j *job.Job, fireTime time.Time, executors []*Executor) error {
+	replicas := j.Availability
+	if replicas < 1 {
+		replicas = 1
+	}
+	eligible, unschedulable := Eligible(j, executors)
+	var shortage error
+	switch {
+	case unschedulable != nil:
+		// a single run tells why
+		replicas = 1
+	case len(eligible) < replicas:
+		shortage = fmt.Errorf("%d executors eligible, %d needed", len(eligible), replicas)
+		replicas = len(eligible)
+		if j.ShortagePolicy == job.SHORTAGE_FAIL {
+			replicas = 0
+		}
+	}
+
+	f := run.NewFire(j, fireTime, replicas)
+	if replicas == 0 {
+		f.Fail(shortage, time.Now().UTC())
+	}
+	switch err := run.CreateFire(s.store, f); err {
+	case nil:
+	case run.ErrFireExists:
+		// fired by a previous leader already, which may have not created every run
+		if f, err = run.GetFire(s.store, f.ID); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	if replicas == 0 {
+		s.logf("Job %s fire %s failed: %s", j.ID, f.ID, shortage.Error())
+		return nil
+	}
+	if shortage != nil {
+		s.logf("Job %s fire %s degraded: %s", j.ID, f.ID, shortage.Error())
+	}
+
+	busy := map[string]bool{}
+	for i := range f.Runs {
+		r := run.NewReplica(j.ID, fireTime, "", i+1, len(f.Runs))
+		r.Slots = j.Slots
+		target, err := s.place(r, executors, busy)
+		switch {
+		case err == nil:
+			r.Executor = target.ID
+		case err == ErrSaturated:
+			err = r.Queue(time.Now().UTC())
+		default:
+			err = r.Finish(run.RUN_UNSCHEDULABLE, err, time.Now().UTC())
+		}
+		if err != nil {
+			return err
+		}
+		switch err := run.Create(s.store, r); err {
+		case nil:
+			if r.Status == run.RUN_QUEUED {
+				s.queued[r.ID] = r
+				s.logf("Job %s fired, run %s queued: %s", j.ID, r.ID, ErrSaturated.Error())
+				continue
+			}
+			if !r.Active() {
+				s.logf("Job %s fired, run %s %s: %s", j.ID, r.ID, r.Status, r.Error)
+				continue
+			}
+			busy[r.Executor] = true
+			if err := s.offer(r); err != nil {
+				return err
+			}
+			s.logf("Job %s fired, run %s offered to %s", j.ID, r.ID, r.Executor)
+		case run.ErrRunExists:
+			s.logf("Job %s fired, run %s exists already", j.ID, r.ID)
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,619 @@
+package scheduler_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/run"
+	"github.com/jteso/xchronos/scheduler"
+	"github.com/jteso/xchronos/store"
+	"github.com/jteso/xchronos/trigger"
+)
+
+func newRepeatingJob(id string, interval time.Duration, repeatCount int) *job.Job {
+	j := job.New(id)
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_COMMAND, Command: "/usr/bin/report.sh"}
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_SIMPLE, RepeatInterval: interval, RepeatCount: repeatCount}
+	return j
+}
+
+func addExecutors(s store.JobStore, ids ...string) {
+	for _, id := range ids {
+		value, _ := scheduler.EncodeMetadata(&scheduler.Metadata{StartedAt: time.Now().UTC()})
+		s.Set(scheduler.EXECUTORS_DIR+"/"+id, value, 0)
+	}
+}
+
+func startScheduler(t *testing.T, s store.JobStore) (stop func()) {
+	stopC := make(chan bool, 1)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- scheduler.New(s, t.Logf).Run(stopC)
+	}()
+	return func() {
+		stopC <- true
+		if err := <-errC; err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+		}
+	}
+}
+
+// waitForOffers waits until there are n offers of a job, returning them
+func waitForOffers(t *testing.T, s store.JobStore, jobID string, n int) []*scheduler.Offer {
+	offers := []*scheduler.Offer{}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		offers = listOffers(t, s, jobID)
+		if len(offers) >= n {
+			break
+		}
+	}
+	return offers
+}
+
+func listOffers(t *testing.T, s store.JobStore, jobID string) []*scheduler.Offer {
+	nodes, err := s.List(scheduler.OFFERS_DIR, true)
+	if err != nil && !store.IsKeyNotFound(err) {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	offers := []*scheduler.Offer{}
+	for _, n := range nodes {
+		o, err := scheduler.DecodeOffer(n)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if o.JobID == jobID {
+			offers = append(offers, o)
+		}
+	}
+	return offers
+}
+
+func TestSchedulerFiresLoadedJobs(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	job.Create(s, newRepeatingJob("report", 50*time.Millisecond, 2))
+
+	stop := startScheduler(t, s)
+	offers := waitForOffers(t, s, "report", 3)
+	stop()
+
+	if len(offers) != 3 {
+		t.Fatalf("Expected [%d] offers. Observed [%d] offers", 3, len(offers))
+	}
+	for i := 1; i < len(offers); i++ {
+		if interval := offers[i].FireTime.Sub(offers[i-1].FireTime); interval != 50*time.Millisecond {
+			t.Errorf("Expected [%s] between fires. Observed [%s]", 50*time.Millisecond, interval)
+		}
+	}
+	st, _ := trigger.LoadState(s, "report")
+	if st.FiredCount != 3 || !st.NextFireTime.IsZero() {
+		t.Errorf("Expected trigger state to be saved. Observed: %+v", st)
+	}
+}
+
+func TestSchedulerWatchesJobs(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	// created
+	j := newRepeatingJob("report", 20*time.Millisecond, -1)
+	job.Create(s, j)
+	if offers := waitForOffers(t, s, "report", 2); len(offers) < 2 {
+		t.Fatalf("Expected new job to be fired. Observed [%d] offers", len(offers))
+	}
+
+	// disabled
+	j, _ = job.Get(s, "report")
+	j.Enabled = false
+	job.Update(s, j)
+	time.Sleep(50 * time.Millisecond)
+	fired := len(listOffers(t, s, "report"))
+	time.Sleep(100 * time.Millisecond)
+	if offers := listOffers(t, s, "report"); len(offers) != fired {
+		t.Errorf("Expected disabled job not to be fired. Observed [%d] more offers", len(offers)-fired)
+	}
+
+	// deleted
+	job.Delete(s, "report")
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := trigger.LoadState(s, "report"); err == trigger.ErrStateNotFound {
+			return
+		}
+	}
+	t.Errorf("Expected trigger state of the deleted job to be removed")
+}
+
+func TestSchedulerResumesFromSavedState(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	job.Create(s, newRepeatingJob("report", 30*time.Millisecond, 5))
+
+	// first leader goes away after a few fires
+	stop := startScheduler(t, s)
+	waitForOffers(t, s, "report", 2)
+	stop()
+
+	// the next one carries on with the remaining ones
+	stop = startScheduler(t, s)
+	offers := waitForOffers(t, s, "report", 6)
+	stop()
+
+	if len(offers) != 6 {
+		t.Errorf("Expected [%d] offers. Observed [%d] offers", 6, len(offers))
+	}
+}
+
+func TestPublishOfferOnce(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	fireTime := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := scheduler.PublishOffer(s, scheduler.NewOffer(run.New("report", fireTime, "agent_1"))); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := scheduler.PublishOffer(s, scheduler.NewOffer(run.New("report", fireTime, "agent_1"))); !store.IsNodeExist(err) {
+		t.Errorf("Expected the same fire not to be offered twice. Observed: %v", err)
+	}
+}
+
+func TestSchedulerCreatesRuns(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	job.Create(s, newRepeatingJob("report", time.Hour, 0))
+
+	stop := startScheduler(t, s)
+	offers := waitForOffers(t, s, "report", 1)
+	stop()
+
+	if len(offers) != 1 {
+		t.Fatalf("Expected [%d] offers. Observed [%d] offers", 1, len(offers))
+	}
+	r, err := run.Get(s, offers[0].RunID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Status != run.RUN_OFFERED || r.Executor != "agent_1" || r.Attempt != 1 {
+		t.Errorf("Expected run offered to [%s]. Observed: %+v", "agent_1", r)
+	}
+}
+
+// replay goes through the changes under dir, from the first one the store kept, until
+// matches tells so or 2 seconds went by. Deletions are skipped.
+func replay(t *testing.T, s store.JobStore, dir string, matches func(n *store.Node) bool) {
+	receiver, stop, errC := make(chan *store.Response), make(chan bool), make(chan error, 1)
+	go func() {
+		errC <- s.Watch(dir, 1, true, receiver, stop)
+	}()
+	defer func() {
+		close(stop)
+		<-errC
+	}()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case resp, ok := <-receiver:
+			if !ok {
+				return
+			}
+			switch resp.Action {
+			case store.ActionDelete, store.ActionExpire, store.ActionCompareAndDelete:
+				continue
+			}
+			if resp.Node != nil && !resp.Node.Dir && matches(resp.Node) {
+				return
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// waitForRun waits until the given run matches, returning it as last read. Runs are
+// deleted once finished, so their changes are replayed.
+func waitForRun(t *testing.T, s store.JobStore, id string, matches func(r *run.Run) bool) *run.Run {
+	var r *run.Run
+	replay(t, s, run.RUNS_DIR, func(n *store.Node) bool {
+		if store.Base(n.Key) != id {
+			return false
+		}
+		var err error
+		if r, err = run.FromNode(n); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		return matches(r)
+	})
+	return r
+}
+
+func TestSchedulerReoffersLostRuns(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1", "agent_2")
+	j := newRepeatingJob("report", time.Hour, -1)
+	j.Enabled = false
+	j.Retry.MaxAttempts = 2
+	job.Create(s, j)
+
+	r := run.New("report", scheduledAt, "agent_1")
+	run.Create(s, r)
+	if _, err := run.Claim(s, r.ID, "agent_1", 1); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	// the heartbeat of agent_1 expires
+	s.Delete(scheduler.EXECUTORS_DIR+"/agent_1", false)
+	r = waitForRun(t, s, r.ID, func(r *run.Run) bool { return r.Attempt == 2 })
+	if r.Status != run.RUN_OFFERED || r.Executor != "agent_2" || r.Attempt != 2 {
+		t.Fatalf("Expected run re-offered to [%s]. Observed: %+v", "agent_2", r)
+	}
+	if offers := waitForOffers(t, s, "report", 1); len(offers) != 1 || offers[0].Executor != "agent_2" || offers[0].Attempt != 2 {
+		t.Errorf("Expected attempt [%d] offered to [%s]. Observed: %+v", 2, "agent_2", offers)
+	}
+
+	// agent_2 restarts after claiming it, with no attempts left
+	if _, err := run.Claim(s, r.ID, "agent_2", 2); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	addExecutors(s, "agent_2")
+	r = waitForRun(t, s, r.ID, func(r *run.Run) bool { return !r.Active() })
+	if r.Status != run.RUN_FAILED || r.Error == "" {
+		t.Errorf("Expected run to fail once out of attempts. Observed: %+v", r)
+	}
+}
+
+func TestSchedulerMovesOffersOfLostExecutors(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_2")
+	j := newRepeatingJob("report", time.Hour, -1)
+	j.Enabled = false
+	job.Create(s, j)
+
+	// offered to agent_1, gone while there was no leader
+	r := run.New("report", scheduledAt, "agent_1")
+	run.Create(s, r)
+	scheduler.PublishOffer(s, scheduler.NewOffer(r))
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	r = waitForRun(t, s, r.ID, func(r *run.Run) bool { return r.Executor == "agent_2" })
+	if r.Status != run.RUN_OFFERED || r.Executor != "agent_2" || r.Attempt != 1 {
+		t.Errorf("Expected run moved to [%s]. Observed: %+v", "agent_2", r)
+	}
+	if _, err := s.Get(scheduler.OfferKey("agent_1", r.ID), false); !store.IsKeyNotFound(err) {
+		t.Errorf("Expected offer to agent_1 to be withdrawn. Observed: %v", err)
+	}
+	if _, err := s.Get(scheduler.OfferKey("agent_2", r.ID), false); err != nil {
+		t.Errorf("Expected offer to agent_2. Observed: %v", err)
+	}
+}
+
+func TestSchedulerRetriesFailedRuns(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	j := newRepeatingJob("report", time.Hour, -1)
+	j.Enabled = false
+	j.Retry = job.RetryPolicy{MaxAttempts: 3, TimeBetweenAttempts: 100 * time.Millisecond}
+	job.Create(s, j)
+
+	// failed while there was no leader
+	r := run.New("report", scheduledAt, "agent_1")
+	run.Create(s, r)
+	r, _ = run.Claim(s, r.ID, "agent_1", 1)
+	r.Fail(job.ERROR_CLASS_FAILED, errors.New("exit status 1"), &j.Retry, time.Now())
+	run.Update(s, r)
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	r = waitForRun(t, s, r.ID, func(r *run.Run) bool { return r.Attempt == 2 })
+	if r.Status != run.RUN_OFFERED || len(r.Attempts) != 1 {
+		t.Fatalf("Expected attempt [%d] to be offered. Observed: %+v", 2, r)
+	}
+
+	// fails again while the leader is around
+	r, _ = run.Claim(s, r.ID, "agent_1", 2)
+	failedAt := time.Now()
+	r.Fail(job.ERROR_CLASS_FAILED, errors.New("exit status 1"), &j.Retry, failedAt)
+	run.Update(s, r)
+	r = waitForRun(t, s, r.ID, func(r *run.Run) bool { return r.Attempt == 3 })
+	if r.Status != run.RUN_OFFERED || len(r.Attempts) != 2 {
+		t.Fatalf("Expected attempt [%d] to be offered. Observed: %+v", 3, r)
+	}
+	if wait := r.OfferedAt.Sub(failedAt); wait < 100*time.Millisecond {
+		t.Errorf("Expected [%s] between attempts. Observed [%s]", 100*time.Millisecond, wait)
+	}
+}
+
+// finishRun runs the attempt offered to executor, finishing it with the given status
+func finishRun(t *testing.T, s store.JobStore, id string, executor string, status string) {
+	r, err := run.Claim(s, id, executor, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	r.Transition(run.RUN_RUNNING, time.Now())
+	if err := r.Finish(status, nil, time.Now()); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := run.Update(s, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+}
+
+// waitForFire waits until the first fire of a job is settled, returning it as last read.
+// Fires are deleted once settled, so their changes are replayed.
+func waitForFire(t *testing.T, s store.JobStore, jobID string) *run.Fire {
+	var f *run.Fire
+	replay(t, s, run.FIRES_DIR, func(n *store.Node) bool {
+		fire, err := run.FireFromNode(n)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if fire.JobID != jobID || (f != nil && fire.ID != f.ID) {
+			return false
+		}
+		f = fire
+		return !f.Active()
+	})
+	return f
+}
+
+func TestSchedulerFansOutFires(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1", "agent_2", "agent_3")
+	j := newRepeatingJob("report", time.Hour, 0)
+	j.Availability = 2
+	j.SuccessPolicy = job.SUCCESS_ANY
+	job.Create(s, j)
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	offers := waitForOffers(t, s, "report", 2)
+	if len(offers) != 2 || offers[0].Executor == offers[1].Executor {
+		t.Fatalf("Expected [%d] offers to distinct executors. Observed: %+v", 2, offers)
+	}
+	fireID := run.ID("report", offers[0].FireTime)
+	for _, o := range offers {
+		if r, _ := run.Get(s, o.RunID); r.FireID != fireID || r.Replicas != 2 {
+			t.Errorf("Expected run of fire [%s]. Observed: %+v", fireID, r)
+		}
+	}
+
+	finishRun(t, s, offers[0].RunID, offers[0].Executor, run.RUN_FAILED)
+	finishRun(t, s, offers[1].RunID, offers[1].Executor, run.RUN_SUCCEEDED)
+	if f := waitForFire(t, s, "report"); f.ID != fireID || f.Status != run.FIRE_SUCCEEDED || f.Succeeded != 1 || f.Failed != 1 {
+		t.Errorf("Expected fire to succeed with any run succeeding. Observed: %+v", f)
+	}
+}
+
+func TestSchedulerShortageOfExecutors(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	failing := newRepeatingJob("report", time.Hour, 0)
+	failing.Availability, failing.ShortagePolicy = 2, job.SHORTAGE_FAIL
+	job.Create(s, failing)
+	waiting := newRepeatingJob("backup", time.Hour, 0)
+	waiting.Availability, waiting.ShortagePolicy = 2, job.SHORTAGE_WAIT
+	job.Create(s, waiting)
+	degraded := newRepeatingJob("cleanup", time.Hour, 0)
+	degraded.Availability = 2
+	job.Create(s, degraded)
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	if offers := waitForOffers(t, s, "cleanup", 1); len(offers) != 1 || offers[0].Executor != "agent_1" {
+		t.Errorf("Expected degraded fire offered to [%s]. Observed: %+v", "agent_1", offers)
+	}
+	if f := waitForFire(t, s, "report"); f == nil || f.Status != run.FIRE_FAILED || len(f.Runs) != 0 {
+		t.Errorf("Expected fire to fail. Observed: %+v", f)
+	}
+	if offers := listOffers(t, s, "report"); len(offers) != 0 {
+		t.Errorf("Expected failed fire not to be offered. Observed: %+v", offers)
+	}
+	if offers := listOffers(t, s, "backup"); len(offers) != 0 {
+		t.Errorf("Expected fire to wait for executors. Observed: %+v", offers)
+	}
+
+	addExecutors(s, "agent_2")
+	if offers := waitForOffers(t, s, "backup", 2); len(offers) != 2 {
+		t.Errorf("Expected [%d] offers once executors joined. Observed [%d] offers", 2, len(offers))
+	}
+}
+
+// jobRun returns the run of the first fire of a job
+func jobRun(t *testing.T, s store.JobStore, jobID string) *run.Run {
+	runs, err := run.List(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	for _, r := range runs {
+		if r.JobID == jobID {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestSchedulerQueuesRunsOfSaturatedExecutors(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	value, _ := scheduler.EncodeMetadata(&scheduler.Metadata{StartedAt: time.Now().UTC(), Capacity: 1})
+	s.Set(scheduler.EXECUTORS_DIR+"/agent_1", value, 0)
+	job.Create(s, newRepeatingJob("report", time.Hour, 0))
+	huge := newRepeatingJob("backup", time.Hour, 0)
+	huge.Slots = 2
+	job.Create(s, huge)
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	report := waitForOffers(t, s, "report", 1)
+	if len(report) != 1 {
+		t.Fatalf("Expected [%d] offers. Observed [%d]", 1, len(report))
+	}
+	f := waitForFire(t, s, "backup")
+	if f == nil || f.Status != run.FIRE_FAILED || len(f.Runs) != 1 {
+		t.Fatalf("Expected fire to fail. Observed: %+v", f)
+	}
+	if records, _ := run.LastRuns(s, "backup", 1); len(records) != 1 || records[0].Status != run.RUN_UNSCHEDULABLE {
+		t.Errorf("Expected run bigger than any executor to be unschedulable. Observed: %+v", records)
+	}
+
+	low := newRepeatingJob("cleanup", time.Hour, 0)
+	job.Create(s, low)
+	high := newRepeatingJob("invoice", time.Hour, 0)
+	high.Priority = 5
+	job.Create(s, high)
+	for _, id := range []string{"cleanup", "invoice"} {
+		r := jobRun(t, s, id)
+		for deadline := time.Now().Add(2 * time.Second); r == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			r = jobRun(t, s, id)
+		}
+		if r == nil || r.Status != run.RUN_QUEUED || r.Executor != "" {
+			t.Fatalf("Expected run of job [%s] to be queued. Observed: %+v", id, r)
+		}
+	}
+
+	finishRun(t, s, report[0].RunID, "agent_1", run.RUN_SUCCEEDED)
+	invoice := waitForOffers(t, s, "invoice", 1)
+	if len(invoice) != 1 {
+		t.Fatalf("Expected run of higher priority to be offered first. Observed [%d] offers", len(invoice))
+	}
+	if r := jobRun(t, s, "cleanup"); r.Status != run.RUN_QUEUED {
+		t.Errorf("Expected run of lower priority to be queued still. Observed: %+v", r)
+	}
+
+	finishRun(t, s, invoice[0].RunID, "agent_1", run.RUN_SUCCEEDED)
+	if offers := waitForOffers(t, s, "cleanup", 1); len(offers) != 1 || offers[0].Executor != "agent_1" {
+		t.Errorf("Expected queued run offered once capacity was freed. Observed: %+v", offers)
+	}
+}
+
+func TestSchedulerRecordsHistory(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	job.Create(s, newRepeatingJob("report", time.Hour, 0))
+	// finished after the previous leader loaded, while there was none
+	s.Set(scheduler.SCHEDULER_CHECKPOINT_KEY, time.Now().UTC().Add(-time.Minute).Format(time.RFC3339Nano), 0)
+	missed := run.New("report", time.Now().UTC().Add(-time.Hour), "agent_1")
+	missed.Transition(run.RUN_CLAIMED, time.Now())
+	missed.Transition(run.RUN_RUNNING, time.Now())
+	missed.Finish(run.RUN_FAILED, nil, time.Now().UTC())
+	run.Create(s, missed)
+
+	stop := startScheduler(t, s)
+	defer stop()
+
+	offers := waitForOffers(t, s, "report", 1)
+	if len(offers) != 1 {
+		t.Fatalf("Expected [%d] offers. Observed [%d]", 1, len(offers))
+	}
+	finishRun(t, s, offers[0].RunID, "agent_1", run.RUN_SUCCEEDED)
+
+	records := []*run.Record{}
+	for deadline := time.Now().Add(2 * time.Second); len(records) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		records, _ = run.History(s, "report")
+	}
+	if len(records) != 2 || records[0].RunID != missed.ID || records[1].RunID != offers[0].RunID || records[1].Status != run.RUN_SUCCEEDED {
+		t.Errorf("Expected [%d] runs recorded. Observed: %+v", 2, records)
+	}
+	st, err := run.JobStats(s, "report")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if st.Succeeded != 1 || st.Failed != 1 || st.LastSuccessAt.IsZero() {
+		t.Errorf("Expected runs recorded to be counted. Observed: %+v", st)
+	}
+	if executor, _ := run.ExecutorStats(s, "agent_1"); executor == nil || executor.Runs() != 2 {
+		t.Errorf("Expected runs of executor [%s] to be counted. Observed: %+v", "agent_1", executor)
+	}
+}
+
+func TestSchedulerCountsRunsOnce(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	job.Create(s, newRepeatingJob("report", time.Hour, 0))
+
+	stop := startScheduler(t, s)
+	offers := waitForOffers(t, s, "report", 1)
+	if len(offers) != 1 {
+		t.Fatalf("Expected [%d] offers. Observed [%d]", 1, len(offers))
+	}
+	finishRun(t, s, offers[0].RunID, "agent_1", run.RUN_SUCCEEDED)
+	var st *run.Stats
+	for deadline := time.Now().Add(2 * time.Second); st == nil && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		st, _ = run.JobStats(s, "report")
+	}
+	stop()
+
+	// next leader, loading the runs finished since the previous one did
+	stop = startScheduler(t, s)
+	defer stop()
+	job.Create(s, newRepeatingJob("backup", time.Hour, 0))
+	if offers := waitForOffers(t, s, "backup", 1); len(offers) != 1 {
+		t.Fatalf("Expected [%d] offers once loaded. Observed [%d]", 1, len(offers))
+	}
+	if st, _ := run.JobStats(s, "report"); st == nil || st.Succeeded != 1 {
+		t.Errorf("Expected run to be counted once. Observed: %+v", st)
+	}
+}
+
+func TestSchedulerReloadsMissedChanges(t *testing.T) {
+	defer func(size int) { store.MEMORY_HISTORY_SIZE = size }(store.MEMORY_HISTORY_SIZE)
+	store.MEMORY_HISTORY_SIZE = 10
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	// loading them writes more changes than the store keeps
+	for i := 0; i < 20; i++ {
+		job.Create(s, newRepeatingJob(fmt.Sprintf("report_%d", i), time.Hour, 0))
+	}
+
+	stop := startScheduler(t, s)
+	defer stop()
+	for i := 0; i < 20; i++ {
+		jobID := fmt.Sprintf("report_%d", i)
+		if offers := waitForOffers(t, s, jobID, 1); len(offers) != 1 {
+			t.Fatalf("Expected [%d] offers of job [%s]. Observed [%d]", 1, jobID, len(offers))
+		}
+	}
+	job.Create(s, newRepeatingJob("backup", time.Hour, 0))
+	if offers := waitForOffers(t, s, "backup", 1); len(offers) != 1 {
+		t.Errorf("Expected [%d] offers once reloaded. Observed [%d]", 1, len(offers))
+	}
+}
+
+func TestSchedulerSkipsCorruptJobs(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	addExecutors(s, "agent_1")
+	s.Set(job.Key("corrupt"), "{not a job", 0)
+	job.Create(s, newRepeatingJob("report", time.Hour, 0))
+
+	stop := startScheduler(t, s)
+	defer stop()
+	if offers := waitForOffers(t, s, "report", 1); len(offers) != 1 {
+		t.Errorf("Expected [%d] offers despite the corrupt job. Observed [%d]", 1, len(offers))
+	}
+}
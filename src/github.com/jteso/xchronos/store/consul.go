@@ -0,0 +1,659 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Min TTL accepted by consul for a session
+	CONSUL_MIN_SESSION_TTL uint64 = 10
+	// Max time a blocking query will wait for changes before being re-issued
+	CONSUL_WATCH_WAIT = 5 * time.Minute
+)
+
+// ConsulStore is a JobStore backed by the consul KV store.
+//
+// Keys with a TTL are mapped onto consul sessions: the key gets locked by a session
+// with the given TTL and the `delete` behavior, so the key is removed when the
+// session is invalidated. This gives the leader election key and the executor heartbeats
+// the same semantics they have on etcd (keep in mind consul may take up to twice the TTL
+// to invalidate a session). Sessions belong to the store, not to the value written, so
+// agents must not share a store: the one holding a key would be told apart by its session
+// only, and Set takes keys over from the sessions of other stores. Changes are watched
+// via blocking queries, hence a number of changes to the same key in between two queries
+// are reported as a single one. Watching from an index the prefix has changed since fails
+// with ErrCodeIndexCleared, the changes being unknown.
+type ConsulStore struct {
+	address string
+	client  *http.Client
+
+	// sessions created by this store, by key
+	sessionsMu sync.Mutex
+	sessions   map[string]string
+}
+
+type consulEntry struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Session     string
+}
+
+// address = "http://127.0.0.1:8500"
+func NewConsulStore(address string) *ConsulStore {
+	return &ConsulStore{
+		address:  strings.TrimRight(address, "/"),
+		client:   &http.Client{},
+		sessions: make(map[string]string),
+	}
+}
+
+func (s *ConsulStore) Get(key string, recursive bool) (*Node, error) {
+	entries, _, err := s.getEntries(context.Background(), key, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	leaves := []*Node{}
+	for _, e := range entries {
+		leaves = append(leaves, fromConsulEntry(e))
+	}
+	node := buildTree(key, leaves, recursive)
+	if node == nil {
+		return nil, NewError(ErrCodeKeyNotFound, key, 0)
+	}
+	return node, nil
+}
+
+func (s *ConsulStore) Create(key string, value string, ttl uint64) (*Response, error) {
+	if ttl == 0 {
+		ok, err := s.put(key, value, url.Values{"cas": {"0"}})
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, NewError(ErrCodeNodeExist, key, 0)
+		}
+		return s.response(ActionCreate, key, nil)
+	}
+
+	// consul can not combine `cas` with `acquire`, so both go in a single transaction
+	ok, err := s.acquire(key, value, ttl, consulKVOp{Verb: "check-not-exists", Key: strings.Trim(key, "/")})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NewError(ErrCodeNodeExist, key, 0)
+	}
+	return s.response(ActionCreate, key, nil)
+}
+
+func (s *ConsulStore) Set(key string, value string, ttl uint64) (*Response, error) {
+	prev, err := s.getEntry(key)
+	if err != nil && !IsKeyNotFound(err) {
+		return nil, err
+	}
+
+	if ttl == 0 {
+		if _, err := s.put(key, value, url.Values{}); err != nil {
+			return nil, err
+		}
+		return s.response(ActionSet, key, prev)
+	}
+
+	for {
+		ok, err := s.acquire(key, value, ttl)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return s.response(ActionSet, key, prev)
+		}
+
+		// hold by a session from somebody else, which is overwritten as etcd does: the key
+		// is deleted, dropping the lock, and written again unless the lock changed hands
+		holder, err := s.getEntry(key)
+		if err != nil && !IsKeyNotFound(err) {
+			return nil, err
+		}
+		if err != nil || holder.Session == "" {
+			continue
+		}
+		ok, err = s.acquire(key, value, ttl,
+			consulKVOp{Verb: "check-session", Key: strings.Trim(key, "/"), Session: holder.Session},
+			consulKVOp{Verb: "delete", Key: strings.Trim(key, "/")})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return s.response(ActionSet, key, prev)
+		}
+	}
+}
+
+func (s *ConsulStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return nil, NewError(ErrCodeInvalidInput, "either prevValue or prevIndex must be given", 0)
+	}
+	prev, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	if (prevValue != "" && string(prev.Value) != prevValue) || (prevIndex != 0 && prev.ModifyIndex != prevIndex) {
+		return nil, NewError(ErrCodeTestFailed, fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, prev.Value, prevIndex, prev.ModifyIndex), prev.ModifyIndex)
+	}
+
+	var ok bool
+	if ttl == 0 {
+		ok, err = s.put(key, value, url.Values{"cas": {strconv.FormatUint(prev.ModifyIndex, 10)}})
+	} else {
+		ok, err = s.acquire(key, value, ttl, consulKVOp{Verb: "check-index", Key: strings.Trim(key, "/"), Index: prev.ModifyIndex})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NewError(ErrCodeTestFailed, key, prev.ModifyIndex)
+	}
+	return s.response(ActionCompareAndSwap, key, prev)
+}
+
+func (s *ConsulStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) (*Response, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return nil, NewError(ErrCodeInvalidInput, "either prevValue or prevIndex must be given", 0)
+	}
+	prev, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	if (prevValue != "" && string(prev.Value) != prevValue) || (prevIndex != 0 && prev.ModifyIndex != prevIndex) {
+		return nil, NewError(ErrCodeTestFailed, fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, prev.Value, prevIndex, prev.ModifyIndex), prev.ModifyIndex)
+	}
+
+	ok, err := s.delete(key, url.Values{"cas": {strconv.FormatUint(prev.ModifyIndex, 10)}})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, NewError(ErrCodeTestFailed, key, prev.ModifyIndex)
+	}
+	s.releaseSession(key)
+	index := s.index(key)
+	return &Response{Action: ActionCompareAndDelete, Node: &Node{Key: key, ModifiedIndex: index}, PrevNode: fromConsulEntry(prev), Index: index}, nil
+}
+
+func (s *ConsulStore) Delete(key string, recursive bool) (*Response, error) {
+	prev, err := s.Get(key, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if prev.Dir && !recursive {
+		return nil, NewError(ErrCodeNotFile, key, prev.ModifiedIndex)
+	}
+
+	params := url.Values{}
+	if recursive {
+		params.Set("recurse", "")
+	}
+	if _, err := s.delete(key, params); err != nil {
+		return nil, err
+	}
+	s.releaseSession(key)
+	index := s.index(key)
+	return &Response{Action: ActionDelete, Node: &Node{Key: prev.Key, Dir: prev.Dir, ModifiedIndex: index}, PrevNode: prev, Index: index}, nil
+}
+
+func (s *ConsulStore) List(dir string, recursive bool) ([]*Node, error) {
+	n, err := s.Get(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Dir {
+		return nil, NewError(ErrCodeNotDir, dir, n.ModifiedIndex)
+	}
+	if recursive {
+		return Flatten(n), nil
+	}
+	return n.Nodes, nil
+}
+
+func (s *ConsulStore) Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *Response, stop chan bool) error {
+	defer close(receiver)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	entries, index, err := s.getEntries(ctx, prefix, recursive, 0)
+	if ctx.Err() != nil {
+		return ErrWatchStoppedByUser
+	}
+	if err != nil && !IsKeyNotFound(err) {
+		return err
+	}
+	if waitIndex > 0 && index >= waitIndex {
+		// changed since the requested index, but consul keeps no history to tell the keys
+		// deleted meanwhile
+		return NewError(ErrCodeIndexCleared, fmt.Sprintf("%s changed at [%d] since [%d]", prefix, index, waitIndex), index)
+	}
+	known := make(map[string]*consulEntry)
+	for _, e := range entries {
+		known[e.Key] = e
+	}
+
+	for {
+		entries, newIndex, err := s.getEntries(ctx, prefix, recursive, index)
+		if ctx.Err() != nil {
+			return ErrWatchStoppedByUser
+		}
+		if err != nil && !IsKeyNotFound(err) {
+			return err
+		}
+		if newIndex < index {
+			// consul index went backwards (i.e. a snapshot restore), start over
+			newIndex = 0
+		}
+		index = newIndex
+		if index == 0 {
+			// never issue a non blocking query in a loop
+			index = 1
+		}
+
+		for _, r := range diffEntries(known, entries, index) {
+			if !s.send(ctx, receiver, r) {
+				return ErrWatchStoppedByUser
+			}
+		}
+		known = make(map[string]*consulEntry)
+		for _, e := range entries {
+			known[e.Key] = e
+		}
+	}
+}
+
+func (s *ConsulStore) send(ctx context.Context, receiver chan *Response, r *Response) bool {
+	select {
+	case receiver <- r:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close destroys all the sessions created by the store, releasing any key
+// hold by this store (i.e. the leadership) straight away
+func (s *ConsulStore) Close() {
+	s.sessionsMu.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]string)
+	s.sessionsMu.Unlock()
+
+	for _, id := range sessions {
+		s.destroySession(id)
+	}
+}
+
+// acquire locks key with a session owned by this store, creating or renewing it as needed.
+// If checks are given, they run first in the same transaction, the key being written only
+// if they succeed.
+// Returns false if a check failed or the key is hold by a session from somebody else.
+func (s *ConsulStore) acquire(key string, value string, ttl uint64, checks ...consulKVOp) (bool, error) {
+	s.sessionsMu.Lock()
+	id, found := s.sessions[key]
+	s.sessionsMu.Unlock()
+
+	if found {
+		renewed, err := s.renewSession(id)
+		if err != nil {
+			return false, err
+		}
+		if !renewed {
+			found = false
+		}
+	}
+	if !found {
+		var err error
+		if id, err = s.createSession(key, ttl); err != nil {
+			return false, err
+		}
+		s.sessionsMu.Lock()
+		s.sessions[key] = id
+		s.sessionsMu.Unlock()
+	}
+
+	if len(checks) == 0 {
+		ok, err := s.put(key, value, url.Values{"acquire": {id}})
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			// hold by a session from somebody else
+			s.releaseSession(key)
+		}
+		return ok, nil
+	}
+
+	lock := consulKVOp{Verb: "lock", Key: strings.Trim(key, "/"), Value: []byte(value), Session: id}
+	failed, err := s.txn(append(checks, lock))
+	if err != nil {
+		return false, err
+	}
+	if failed == len(checks) {
+		// hold by a session from somebody else
+		s.releaseSession(key)
+	}
+	return failed < 0, nil
+}
+
+// consulKVOp is an operation on the kv store within a transaction
+type consulKVOp struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+// txn runs kv operations in a single transaction, all of them or none. It returns the
+// index of the operation that failed, rolling back the transaction, or -1.
+func (s *ConsulStore) txn(ops []consulKVOp) (int, error) {
+	body := []map[string]consulKVOp{}
+	for _, op := range ops {
+		body = append(body, map[string]consulKVOp{"KV": op})
+	}
+	b, _ := json.Marshal(body)
+
+	resp, err := s.do(context.Background(), "PUT", "/v1/txn", nil, bytes.NewReader(b))
+	if err != nil {
+		if resp == nil || !IsTestFailed(err) {
+			return -1, err
+		}
+		// rolled back
+		defer resp.Body.Close()
+		var result struct{ Errors []struct{ OpIndex int } }
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return -1, err
+		}
+		if len(result.Errors) == 0 {
+			return 0, nil
+		}
+		return result.Errors[0].OpIndex, nil
+	}
+	resp.Body.Close()
+	return -1, nil
+}
+
+func (s *ConsulStore) releaseSession(key string) {
+	s.sessionsMu.Lock()
+	id, found := s.sessions[key]
+	delete(s.sessions, key)
+	s.sessionsMu.Unlock()
+
+	if found {
+		s.destroySession(id)
+	}
+}
+
+func (s *ConsulStore) createSession(key string, ttl uint64) (string, error) {
+	if ttl < CONSUL_MIN_SESSION_TTL {
+		ttl = CONSUL_MIN_SESSION_TTL
+	}
+	body, _ := json.Marshal(map[string]string{
+		"Name":      "xchronos:" + key,
+		"TTL":       fmt.Sprintf("%ds", ttl),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+
+	var session struct{ ID string }
+	resp, err := s.do(context.Background(), "PUT", "/v1/session/create", nil, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+// renewSession returns false if the session does not exist anymore
+func (s *ConsulStore) renewSession(id string) (bool, error) {
+	resp, err := s.do(context.Background(), "PUT", "/v1/session/renew/"+id, nil, nil)
+	if err != nil {
+		if IsKeyNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *ConsulStore) destroySession(id string) {
+	resp, err := s.do(context.Background(), "PUT", "/v1/session/destroy/"+id, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *ConsulStore) getEntry(key string) (*consulEntry, error) {
+	resp, err := s.do(context.Background(), "GET", kvPath(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	entries := []*consulEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, NewError(ErrCodeKeyNotFound, key, 0)
+	}
+	return entries[0], nil
+}
+
+// getEntries returns the entry for key plus all the entries under it (if recursive),
+// along with the consul index. If index is given, it will block until there are changes
+// after that index.
+func (s *ConsulStore) getEntries(ctx context.Context, key string, recursive bool, index uint64) ([]*consulEntry, uint64, error) {
+	params := url.Values{}
+	if recursive {
+		params.Set("recurse", "")
+	}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%ds", int(CONSUL_WATCH_WAIT.Seconds())))
+	}
+
+	resp, err := s.do(ctx, "GET", kvPath(key), params, nil)
+	var lastIndex uint64
+	if resp != nil {
+		lastIndex, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	}
+	if err != nil {
+		return nil, lastIndex, err
+	}
+	defer resp.Body.Close()
+
+	entries := []*consulEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, lastIndex, err
+	}
+
+	// `recurse` works on prefixes, so /jobs would match /jobs_old as well
+	prefix := strings.Trim(key, "/")
+	matched := entries[:0]
+	for _, e := range entries {
+		if e.Key == prefix || strings.HasPrefix(e.Key, prefix+"/") {
+			e.Key = "/" + e.Key
+			matched = append(matched, e)
+		}
+	}
+	return matched, lastIndex, nil
+}
+
+// index returns the consul index of key, which accounts for its deletion. It is 0 if
+// consul can not be reached, the key being deleted already.
+func (s *ConsulStore) index(key string) uint64 {
+	_, index, _ := s.getEntries(context.Background(), key, false, 0)
+	return index
+}
+
+func (s *ConsulStore) put(key string, value string, params url.Values) (bool, error) {
+	resp, err := s.do(context.Background(), "PUT", kvPath(key), params, strings.NewReader(value))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return readBool(resp.Body)
+}
+
+func (s *ConsulStore) delete(key string, params url.Values) (bool, error) {
+	resp, err := s.do(context.Background(), "DELETE", kvPath(key), params, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return readBool(resp.Body)
+}
+
+// do performs a request against the consul http api. A 404 is reported as
+// a `ErrCodeKeyNotFound` error, although the response is returned as well, and a 409 as
+// a `ErrCodeTestFailed` error, returning the response still to be read
+func (s *ConsulStore) do(ctx context.Context, method string, path string, params url.Values, body io.Reader) (*http.Response, error) {
+	u := s.address + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, NewError(ErrCodeUnreachable, err.Error(), 0)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return resp, NewError(ErrCodeKeyNotFound, path, 0)
+	}
+	if resp.StatusCode == http.StatusConflict {
+		// transaction rolled back, the response tells why
+		return resp, NewError(ErrCodeTestFailed, path, 0)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("consul: unexpected status [%d] for %s %s: %s", resp.StatusCode, method, path, msg)
+	}
+	return resp, nil
+}
+
+func (s *ConsulStore) response(action string, key string, prev *consulEntry) (*Response, error) {
+	e, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &Response{Action: action, Node: fromConsulEntry(e), Index: e.ModifyIndex}
+	if prev != nil {
+		r.PrevNode = fromConsulEntry(prev)
+	}
+	return r, nil
+}
+
+// kvPath maps a job store key onto the consul kv endpoint, consul keys do not start with '/'
+func kvPath(key string) string {
+	return "/v1/kv/" + strings.Trim(key, "/")
+}
+
+func readBool(r io.Reader) (bool, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) == "true", nil
+}
+
+func fromConsulEntry(e *consulEntry) *Node {
+	return &Node{
+		Key:           e.Key,
+		Value:         string(e.Value),
+		ModifiedIndex: e.ModifyIndex,
+		CreatedIndex:  e.CreateIndex,
+	}
+}
+
+// diffEntries returns the changes found between two snapshots of the same prefix,
+// sorted by the index they happened at
+func diffEntries(before map[string]*consulEntry, after []*consulEntry, index uint64) []*Response {
+	changes := []*Response{}
+	seen := make(map[string]bool)
+
+	for _, e := range after {
+		seen[e.Key] = true
+		prev, existed := before[e.Key]
+		switch {
+		case !existed:
+			changes = append(changes, &Response{Action: ActionCreate, Node: fromConsulEntry(e), Index: e.ModifyIndex})
+		case prev.ModifyIndex != e.ModifyIndex:
+			changes = append(changes, &Response{Action: ActionSet, Node: fromConsulEntry(e), PrevNode: fromConsulEntry(prev), Index: e.ModifyIndex})
+		}
+	}
+	for k, prev := range before {
+		if seen[k] {
+			continue
+		}
+		action := ActionDelete
+		if prev.Session != "" {
+			// keys locked by a session are most likely gone due to the session being invalidated
+			action = ActionExpire
+		}
+		changes = append(changes, &Response{Action: action, Node: &Node{Key: k, ModifiedIndex: index}, PrevNode: fromConsulEntry(prev), Index: index})
+	}
+
+	sort.Sort(responsesByIndex(changes))
+	return changes
+}
+
+type responsesByIndex []*Response
+
+func (rs responsesByIndex) Len() int {
+	return len(rs)
+}
+
+func (rs responsesByIndex) Less(i, j int) bool {
+	if rs[i].Index == rs[j].Index {
+		return rs[i].Node.Key < rs[j].Node.Key
+	}
+	return rs[i].Index < rs[j].Index
+}
+
+func (rs responsesByIndex) Swap(i, j int) {
+	rs[i], rs[j] = rs[j], rs[i]
+}
@@ -0,0 +1,531 @@
+package store_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/store"
+)
+
+// fakeConsul emulates the subset of the consul http api used by the ConsulStore:
+// the kv endpoints (including cas, acquire and blocking queries) and sessions.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	kv       map[string]*fakeEntry
+	sessions map[string]bool
+	changedC chan struct{}
+	nextId   int
+}
+
+type fakeEntry struct {
+	Key         string
+	Value       []byte
+	Flags       uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Session     string `json:",omitempty"`
+}
+
+func newFakeConsul() (*fakeConsul, *httptest.Server) {
+	f := &fakeConsul{
+		index:    1,
+		kv:       make(map[string]*fakeEntry),
+		sessions: make(map[string]bool),
+		changedC: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", f.handleKV)
+	mux.HandleFunc("/v1/session/create", f.handleSessionCreate)
+	mux.HandleFunc("/v1/session/renew/", f.handleSessionRenew)
+	mux.HandleFunc("/v1/session/destroy/", f.handleSessionDestroy)
+	mux.HandleFunc("/v1/txn", f.handleTxn)
+	return f, httptest.NewServer(mux)
+}
+
+// must be called holding the lock
+func (f *fakeConsul) changed() uint64 {
+	f.index++
+	close(f.changedC)
+	f.changedC = make(chan struct{})
+	return f.index
+}
+
+// invalidate emulates the TTL of a session running out
+func (f *fakeConsul) invalidate(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, id)
+	for k, e := range f.kv {
+		if e.Session == id {
+			delete(f.kv, k)
+		}
+	}
+	f.changed()
+}
+
+func (f *fakeConsul) sessionOf(key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.kv[strings.Trim(key, "/")]; ok {
+		return e.Session
+	}
+	return ""
+}
+
+func (f *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	params := r.URL.Query()
+	_, recurse := params["recurse"]
+
+	switch r.Method {
+	case "GET":
+		if index, _ := strconv.ParseUint(params.Get("index"), 10, 64); index > 0 {
+			f.waitForChanges(r, index)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		entries := []*fakeEntry{}
+		for k, e := range f.kv {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				entries = append(entries, e)
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		if len(entries) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+
+	case "PUT":
+		value, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		e, exists := f.kv[key]
+		if cas, found := params["cas"]; found {
+			index, _ := strconv.ParseUint(cas[0], 10, 64)
+			if (index == 0 && exists) || (index != 0 && (!exists || e.ModifyIndex != index)) {
+				fmt.Fprint(w, "false")
+				return
+			}
+		}
+		session := params.Get("acquire")
+		if session != "" {
+			if !f.sessions[session] || (exists && e.Session != "" && e.Session != session) {
+				fmt.Fprint(w, "false")
+				return
+			}
+		}
+		index := f.changed()
+		if !exists {
+			e = &fakeEntry{Key: key, CreateIndex: index}
+			f.kv[key] = e
+		}
+		if session != "" && e.Session != session {
+			e.Session = session
+			e.LockIndex++
+		}
+		e.Value = value
+		e.ModifyIndex = index
+		fmt.Fprint(w, "true")
+
+	case "DELETE":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if cas, found := params["cas"]; found {
+			index, _ := strconv.ParseUint(cas[0], 10, 64)
+			if e, exists := f.kv[key]; !exists || e.ModifyIndex != index {
+				fmt.Fprint(w, "false")
+				return
+			}
+		}
+		for k := range f.kv {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				delete(f.kv, k)
+			}
+		}
+		f.changed()
+		fmt.Fprint(w, "true")
+	}
+}
+
+// handleTxn runs the check-not-exists, check-index, check-session, delete and lock
+// operations of a transaction in order, all of them or none
+func (f *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops []struct {
+		KV struct {
+			Verb    string
+			Key     string
+			Value   []byte
+			Index   uint64
+			Session string
+		}
+	}
+	json.NewDecoder(r.Body).Decode(&ops)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// operations are run on a copy, dropped if any of them fails
+	kv := make(map[string]*fakeEntry, len(f.kv))
+	for k, e := range f.kv {
+		copied := *e
+		kv[k] = &copied
+	}
+	index := f.index + 1
+	for i, op := range ops {
+		e, exists := kv[op.KV.Key]
+		failed := false
+		switch op.KV.Verb {
+		case "check-not-exists":
+			failed = exists
+		case "check-index":
+			failed = !exists || e.ModifyIndex != op.KV.Index
+		case "check-session":
+			failed = !exists || e.Session != op.KV.Session
+		case "delete":
+			delete(kv, op.KV.Key)
+		case "lock":
+			failed = !f.sessions[op.KV.Session] || (exists && e.Session != "" && e.Session != op.KV.Session)
+			if failed {
+				break
+			}
+			if !exists {
+				e = &fakeEntry{Key: op.KV.Key, CreateIndex: index}
+				kv[op.KV.Key] = e
+			}
+			if e.Session != op.KV.Session {
+				e.Session = op.KV.Session
+				e.LockIndex++
+			}
+			e.Value = op.KV.Value
+			e.ModifyIndex = index
+		default:
+			http.Error(w, "unexpected verb "+op.KV.Verb, http.StatusBadRequest)
+			return
+		}
+		if failed {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"Errors":[{"OpIndex":%d,"What":"failed"}]}`, i)
+			return
+		}
+	}
+	f.kv = kv
+	f.changed()
+	fmt.Fprint(w, `{"Results":[]}`)
+}
+
+func (f *fakeConsul) waitForChanges(r *http.Request, index uint64) {
+	timeout := time.NewTimer(5 * time.Second)
+	defer timeout.Stop()
+	for {
+		f.mu.Lock()
+		current, changedC := f.index, f.changedC
+		f.mu.Unlock()
+		if current > index {
+			return
+		}
+		select {
+		case <-changedC:
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeConsul) handleSessionCreate(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	json.NewDecoder(r.Body).Decode(&req)
+	if req["Behavior"] != "delete" || req["TTL"] == "" {
+		http.Error(w, "unexpected session request", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextId++
+	id := fmt.Sprintf("session-%d", f.nextId)
+	f.sessions[id] = true
+	json.NewEncoder(w).Encode(map[string]string{"ID": id})
+}
+
+func (f *fakeConsul) handleSessionRenew(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.sessions[id] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fmt.Fprint(w, "[]")
+}
+
+func (f *fakeConsul) handleSessionDestroy(w http.ResponseWriter, r *http.Request) {
+	f.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+	fmt.Fprint(w, "true")
+}
+
+func TestConsulLeaderElection(t *testing.T) {
+	fake, server := newFakeConsul()
+	defer server.Close()
+
+	agent1 := store.NewConsulStore(server.URL)
+	agent2 := store.NewConsulStore(server.URL)
+	key := "/xchronos/var/scheduler/election"
+
+	if _, err := agent1.Create(key, "agent_1", 10); err != nil {
+		t.Fatalf("Expected agent_1 to become leader. Observed error: %s", err.Error())
+	}
+	if _, err := agent2.Create(key, "agent_2", 10); !store.IsNodeExist(err) {
+		t.Fatalf("Expected agent_2 not to become leader. Observed error: %v", err)
+	}
+
+	// renewing the leadership keeps the very same session
+	session := fake.sessionOf(key)
+	if _, err := agent1.Set(key, "agent_1", 10); err != nil {
+		t.Fatalf("Expected agent_1 to renew its leadership. Observed error: %s", err.Error())
+	}
+	if fake.sessionOf(key) != session {
+		t.Errorf("Expected session [%s] to be renewed. Observed session [%s]", session, fake.sessionOf(key))
+	}
+
+	// leader stops heartbeating
+	fake.invalidate(session)
+	r, err := agent2.Create(key, "agent_2", 10)
+	if err != nil {
+		t.Fatalf("Expected agent_2 to become leader. Observed error: %s", err.Error())
+	}
+	if r.Node.Value != "agent_2" {
+		t.Errorf("Expected leader [%s]. Observed [%s]", "agent_2", r.Node.Value)
+	}
+}
+
+func TestConsulSetTakesOverKeys(t *testing.T) {
+	fake, server := newFakeConsul()
+	defer server.Close()
+	agent1 := store.NewConsulStore(server.URL)
+	agent2 := store.NewConsulStore(server.URL)
+	key := "/xchronos/etc/executors/agent_1"
+
+	agent1.Set(key, "agent_1", 10)
+	session := fake.sessionOf(key)
+	r, err := agent2.Set(key, "agent_2", 10)
+	if err != nil {
+		t.Fatalf("Expected key to be overwritten as on etcd. Observed error: %s", err.Error())
+	}
+	if r.Node.Value != "agent_2" || r.PrevNode == nil || r.PrevNode.Value != "agent_1" || r.Index != r.Node.ModifiedIndex {
+		t.Errorf("Expected [%s] to replace [%s]. Observed: %+v", "agent_2", "agent_1", r)
+	}
+	if fake.sessionOf(key) == session {
+		t.Errorf("Expected session [%s] not to hold the key anymore", session)
+	}
+
+	// the previous holder is the one told apart now
+	if _, err := agent1.CompareAndSwap(key, "agent_1", 10, "agent_2", 0); !store.IsTestFailed(err) {
+		t.Errorf("Expected swap to fail. Observed error: %v", err)
+	}
+	if _, err := agent1.Set(key, "agent_1", 10); err != nil {
+		t.Errorf("Expected key to be taken back. Observed error: %v", err)
+	}
+}
+
+func TestConsulDeleteIndex(t *testing.T) {
+	_, server := newFakeConsul()
+	defer server.Close()
+	s := store.NewConsulStore(server.URL)
+
+	set, _ := s.Set("/xchronos/var/runs/1", "offered", 0)
+	r, err := s.Delete("/xchronos/var/runs/1", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Index <= set.Index || r.Node.ModifiedIndex != r.Index {
+		t.Errorf("Expected delete to happen after index [%d]. Observed: %+v", set.Index, r)
+	}
+
+	set, _ = s.Set("/xchronos/var/runs/2", "offered", 0)
+	r, err = s.CompareAndDelete("/xchronos/var/runs/2", "", set.Node.ModifiedIndex)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if r.Index <= set.Index || r.Node.ModifiedIndex != r.Index {
+		t.Errorf("Expected delete to happen after index [%d]. Observed: %+v", set.Index, r)
+	}
+}
+
+func TestConsulCompareAndSwap(t *testing.T) {
+	_, server := newFakeConsul()
+	defer server.Close()
+	s := store.NewConsulStore(server.URL)
+
+	r, _ := s.Set("/xchronos/var/runs/1", "offered", 0)
+	if _, err := s.CompareAndSwap("/xchronos/var/runs/1", "claimed", 0, "", r.Node.ModifiedIndex); err != nil {
+		t.Fatalf("Expected swap to succeed. Observed error: %s", err.Error())
+	}
+	if _, err := s.CompareAndSwap("/xchronos/var/runs/1", "claimed", 0, "offered", 0); !store.IsTestFailed(err) {
+		t.Errorf("Expected swap to fail. Observed error: %v", err)
+	}
+	if _, err := s.CompareAndSwap("/xchronos/var/runs/2", "claimed", 0, "offered", 0); !store.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found. Observed error: %v", err)
+	}
+}
+
+func TestConsulCompareAndSwapWithTTL(t *testing.T) {
+	fake, server := newFakeConsul()
+	defer server.Close()
+	agent1 := store.NewConsulStore(server.URL)
+	agent2 := store.NewConsulStore(server.URL)
+	key := "/xchronos/var/scheduler/election"
+
+	r, _ := agent1.Create(key, "agent_1", 10)
+	session := fake.sessionOf(key)
+	if _, err := agent1.CompareAndSwap(key, "agent_1", 10, "", r.Node.ModifiedIndex+1); !store.IsTestFailed(err) {
+		t.Errorf("Expected swap to fail. Observed error: %v", err)
+	}
+	if fake.sessionOf(key) != session {
+		t.Errorf("Expected session [%s] to hold the key still. Observed session [%s]", session, fake.sessionOf(key))
+	}
+	if _, err := agent1.CompareAndSwap(key, "agent_1", 10, "agent_1", 0); err != nil || fake.sessionOf(key) != session {
+		t.Errorf("Expected swap to keep session [%s]. Observed session [%s] %v", session, fake.sessionOf(key), err)
+	}
+	// the value matches, but the key is hold by somebody else
+	if _, err := agent2.CompareAndSwap(key, "agent_1", 10, "agent_1", 0); !store.IsTestFailed(err) {
+		t.Errorf("Expected swap to fail. Observed error: %v", err)
+	}
+	if n, _ := agent1.Get(key, false); n.Value != "agent_1" || fake.sessionOf(key) != session {
+		t.Errorf("Expected key to be hold by session [%s]. Observed session [%s]", session, fake.sessionOf(key))
+	}
+}
+
+func TestConsulList(t *testing.T) {
+	_, server := newFakeConsul()
+	defer server.Close()
+	s := store.NewConsulStore(server.URL)
+
+	s.Set("/xchronos/etc/jobs/a", "1", 0)
+	s.Set("/xchronos/etc/jobs/b", "2", 0)
+	s.Set("/xchronos/etc/jobs/c/d", "3", 0)
+	s.Set("/xchronos/etc/jobs_old/e", "4", 0)
+
+	nodes, err := s.List("/xchronos/etc/jobs", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	keys := []string{}
+	for _, n := range nodes {
+		keys = append(keys, fmt.Sprintf("%s:%v", n.Key, n.Dir))
+	}
+	expected := "/xchronos/etc/jobs/a:false /xchronos/etc/jobs/b:false /xchronos/etc/jobs/c:true"
+	if strings.Join(keys, " ") != expected {
+		t.Errorf("Expected [%s]. Observed [%s]", expected, strings.Join(keys, " "))
+	}
+
+	leaves, _ := s.List("/xchronos/etc/jobs", true)
+	if len(leaves) != 3 {
+		t.Errorf("Expected [%d] leaves. Observed [%d] leaves", 3, len(leaves))
+	}
+
+	if _, err := s.Get("/xchronos/etc/missing", false); !store.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found. Observed error: %v", err)
+	}
+}
+
+func TestConsulWatch(t *testing.T) {
+	fake, server := newFakeConsul()
+	defer server.Close()
+	s := store.NewConsulStore(server.URL)
+
+	receiver := make(chan *store.Response, 10)
+	stop := make(chan bool, 1)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Watch("/xchronos/etc/executors", 0, true, receiver, stop)
+	}()
+	// let the watcher take its initial snapshot
+	time.Sleep(100 * time.Millisecond)
+
+	steps := []struct {
+		change   func()
+		expected string
+	}{
+		{func() { s.Set("/xchronos/etc/executors/agent_1", "up", 10) }, "create /xchronos/etc/executors/agent_1"},
+		{func() { s.Set("/xchronos/etc/executors/agent_2", "up", 0) }, "create /xchronos/etc/executors/agent_2"},
+		{func() { s.Set("/xchronos/etc/executors/agent_2", "busy", 0) }, "set /xchronos/etc/executors/agent_2"},
+		{func() { s.Delete("/xchronos/etc/executors/agent_2", false) }, "delete /xchronos/etc/executors/agent_2"},
+		{func() { fake.invalidate(fake.sessionOf("/xchronos/etc/executors/agent_1")) }, "expire /xchronos/etc/executors/agent_1"},
+	}
+	// blocking queries coalesce the changes happening in between, so wait for each one
+	for _, step := range steps {
+		step.change()
+		select {
+		case r := <-receiver:
+			if observed := r.Action + " " + r.Node.Key; observed != step.expected {
+				t.Errorf("Expected event [%s]. Observed [%s]", step.expected, observed)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected event [%s]. Observed none", step.expected)
+		}
+	}
+
+	stop <- true
+	if err := <-errC; err != store.ErrWatchStoppedByUser {
+		t.Errorf("Expected watch to be stopped by the user. Observed: %v", err)
+	}
+	if _, ok := <-receiver; ok {
+		t.Errorf("Expected receiver to be closed")
+	}
+}
+
+func TestConsulWatchFromIndex(t *testing.T) {
+	_, server := newFakeConsul()
+	defer server.Close()
+	s := store.NewConsulStore(server.URL)
+
+	s.Set("/xchronos/var/offers/agent_1/1", "offered", 0)
+	r, _ := s.Set("/xchronos/var/offers/agent_1/2", "offered", 0)
+
+	// nothing changed since
+	receiver := make(chan *store.Response, 10)
+	stop := make(chan bool, 1)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Watch("/xchronos/var/offers/agent_1", r.Index+1, true, receiver, stop)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	s.Set("/xchronos/var/offers/agent_1/3", "offered", 0)
+	select {
+	case r := <-receiver:
+		if observed := r.Action + " " + r.Node.Key; observed != "create /xchronos/var/offers/agent_1/3" {
+			t.Errorf("Expected event [%s]. Observed [%s]", "create /xchronos/var/offers/agent_1/3", observed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected event [%s]. Observed none", "create /xchronos/var/offers/agent_1/3")
+	}
+	stop <- true
+	if err := <-errC; err != store.ErrWatchStoppedByUser {
+		t.Errorf("Expected watch to be stopped by the user. Observed: %v", err)
+	}
+
+	// deleted since, which consul can not tell
+	s.Delete("/xchronos/var/offers/agent_1/1", false)
+	receiver = make(chan *store.Response, 10)
+	err := s.Watch("/xchronos/var/offers/agent_1", r.Index+1, true, receiver, stop)
+	if store.ErrorCode(err) != store.ErrCodeIndexCleared {
+		t.Errorf("Expected changes since [%d] to be cleared. Observed: %v", r.Index+1, err)
+	}
+	if _, ok := <-receiver; ok {
+		t.Errorf("Expected receiver to be closed")
+	}
+}
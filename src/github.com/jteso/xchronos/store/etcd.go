@@ -0,0 +1,149 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// EtcdStore is a JobStore backed by an etcd v2 cluster
+type EtcdStore struct {
+	client *etcd.Client
+}
+
+// etcdNodes = strings.Split(os.Getenv("ETCD_NODES"), ",")
+func NewEtcdStore(etcdNodes []string) *EtcdStore {
+	return &EtcdStore{
+		client: etcd.NewClient(etcdNodes),
+	}
+}
+
+func (s *EtcdStore) Get(key string, recursive bool) (*Node, error) {
+	r, err := s.client.Get(key, true, recursive)
+	if err != nil {
+		return nil, fromEtcdError(err)
+	}
+	return fromEtcdNode(r.Node), nil
+}
+
+func (s *EtcdStore) Create(key string, value string, ttl uint64) (*Response, error) {
+	r, err := s.client.Create(key, value, ttl)
+	return fromEtcdResponse(r), fromEtcdError(err)
+}
+
+func (s *EtcdStore) Set(key string, value string, ttl uint64) (*Response, error) {
+	r, err := s.client.Set(key, value, ttl)
+	return fromEtcdResponse(r), fromEtcdError(err)
+}
+
+func (s *EtcdStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return nil, NewError(ErrCodeInvalidInput, "either prevValue or prevIndex must be given", 0)
+	}
+	r, err := s.client.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+	return fromEtcdResponse(r), fromEtcdError(err)
+}
+
+func (s *EtcdStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) (*Response, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return nil, NewError(ErrCodeInvalidInput, "either prevValue or prevIndex must be given", 0)
+	}
+	r, err := s.client.CompareAndDelete(key, prevValue, prevIndex)
+	return fromEtcdResponse(r), fromEtcdError(err)
+}
+
+func (s *EtcdStore) Delete(key string, recursive bool) (*Response, error) {
+	r, err := s.client.Delete(key, recursive)
+	return fromEtcdResponse(r), fromEtcdError(err)
+}
+
+func (s *EtcdStore) List(dir string, recursive bool) ([]*Node, error) {
+	n, err := s.Get(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Dir {
+		return nil, NewError(ErrCodeNotDir, dir, n.ModifiedIndex)
+	}
+	if recursive {
+		return Flatten(n), nil
+	}
+	sort.Sort(n.Nodes)
+	return n.Nodes, nil
+}
+
+func (s *EtcdStore) Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *Response, stop chan bool) error {
+	defer close(receiver)
+
+	etcdC := make(chan *etcd.Response, 1)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := s.client.Watch(prefix, waitIndex, recursive, etcdC, stop)
+		errC <- err
+	}()
+
+	for r := range etcdC {
+		receiver <- fromEtcdResponse(r)
+	}
+
+	err := <-errC
+	if err == etcd.ErrWatchStoppedByUser {
+		return ErrWatchStoppedByUser
+	}
+	return fromEtcdError(err)
+}
+
+func (s *EtcdStore) Close() {
+	s.client.Close()
+}
+
+func fromEtcdError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if etcdError, ok := err.(*etcd.EtcdError); ok {
+		return &Error{
+			ErrorCode: etcdError.ErrorCode,
+			Message:   etcdError.Message,
+			Cause:     etcdError.Cause,
+			Index:     etcdError.Index,
+		}
+	}
+	return err
+}
+
+func fromEtcdResponse(r *etcd.Response) *Response {
+	if r == nil {
+		return nil
+	}
+	resp := &Response{
+		Action:   r.Action,
+		Node:     fromEtcdNode(r.Node),
+		PrevNode: fromEtcdNode(r.PrevNode),
+		Index:    r.EtcdIndex,
+	}
+	// watch responses do not carry X-Etcd-Index, the node has the index of the change
+	if resp.Node != nil && resp.Node.ModifiedIndex > resp.Index {
+		resp.Index = resp.Node.ModifiedIndex
+	}
+	return resp
+}
+
+func fromEtcdNode(n *etcd.Node) *Node {
+	if n == nil {
+		return nil
+	}
+	node := &Node{
+		Key:           n.Key,
+		Value:         n.Value,
+		Dir:           n.Dir,
+		Expiration:    n.Expiration,
+		TTL:           n.TTL,
+		ModifiedIndex: n.ModifiedIndex,
+		CreatedIndex:  n.CreatedIndex,
+	}
+	for _, child := range n.Nodes {
+		node.Nodes = append(node.Nodes, fromEtcdNode(child))
+	}
+	return node
+}
@@ -0,0 +1,299 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// Number of records appended to the log before it gets compacted into a snapshot
+	FILE_SNAPSHOT_THRESHOLD = 10000
+)
+
+const (
+	fileSnapshotName = "snapshot.json"
+	fileLogName      = "changes.log"
+)
+
+// FileStore is a JobStore persisted into a local directory, meant for single node
+// setups where running an etcd cluster is not worth it. It behaves as a MemoryStore
+// whose changes are appended to a log, which gets compacted into a snapshot every
+// FILE_SNAPSHOT_THRESHOLD records. Both are replayed when the store is opened again.
+//
+// If a change can not be persisted, the store refuses any further operation.
+type FileStore struct {
+	*MemoryStore
+
+	dir        string
+	log        *os.File
+	logRecords int
+	// first error found writing to disk, guarded by the MemoryStore lock
+	err error
+}
+
+type fileRecord struct {
+	Action       string     `json:"action,omitempty"`
+	Index        uint64     `json:"index"`
+	Key          string     `json:"key"`
+	Value        string     `json:"value,omitempty"`
+	Expiration   *time.Time `json:"expiration,omitempty"`
+	TTL          int64      `json:"ttl,omitempty"`
+	CreatedIndex uint64     `json:"createdIndex"`
+}
+
+type fileSnapshot struct {
+	Index uint64        `json:"index"`
+	Nodes []*fileRecord `json:"nodes"`
+}
+
+// NewFileStore opens (or creates) the store persisted in dir
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		MemoryStore: NewMemoryStoreWithClock(time.Now),
+		dir:         dir,
+	}
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := fs.replayLog(); err != nil {
+		return nil, err
+	}
+	// watches can not go back further than the restored state
+	fs.historyStart = fs.index + 1
+
+	log, err := os.OpenFile(filepath.Join(dir, fileLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs.log = log
+	fs.journal = fs.append
+
+	go fs.expireEvery(MEMORY_EXPIRE_INTERVAL)
+	return fs, nil
+}
+
+func (fs *FileStore) Get(key string, recursive bool) (*Node, error) {
+	n, err := fs.MemoryStore.Get(key, recursive)
+	return n, fs.checkPersisted(err)
+}
+
+func (fs *FileStore) Create(key string, value string, ttl uint64) (*Response, error) {
+	if err := fs.checkPersisted(nil); err != nil {
+		return nil, err
+	}
+	r, err := fs.MemoryStore.Create(key, value, ttl)
+	return r, fs.checkPersisted(err)
+}
+
+func (fs *FileStore) Set(key string, value string, ttl uint64) (*Response, error) {
+	if err := fs.checkPersisted(nil); err != nil {
+		return nil, err
+	}
+	r, err := fs.MemoryStore.Set(key, value, ttl)
+	return r, fs.checkPersisted(err)
+}
+
+func (fs *FileStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	if err := fs.checkPersisted(nil); err != nil {
+		return nil, err
+	}
+	r, err := fs.MemoryStore.CompareAndSwap(key, value, ttl, prevValue, prevIndex)
+	return r, fs.checkPersisted(err)
+}
+
+func (fs *FileStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) (*Response, error) {
+	if err := fs.checkPersisted(nil); err != nil {
+		return nil, err
+	}
+	r, err := fs.MemoryStore.CompareAndDelete(key, prevValue, prevIndex)
+	return r, fs.checkPersisted(err)
+}
+
+func (fs *FileStore) Delete(key string, recursive bool) (*Response, error) {
+	if err := fs.checkPersisted(nil); err != nil {
+		return nil, err
+	}
+	r, err := fs.MemoryStore.Delete(key, recursive)
+	return r, fs.checkPersisted(err)
+}
+
+func (fs *FileStore) Close() {
+	fs.MemoryStore.Close()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.journal = nil
+	fs.log.Close()
+}
+
+// checkPersisted returns the error found persisting any change, if any, or err otherwise
+func (fs *FileStore) checkPersisted(err error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.err != nil {
+		return fs.err
+	}
+	return err
+}
+
+func (fs *FileStore) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(fs.dir, fileSnapshotName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	snapshot := fileSnapshot{}
+	if err := json.NewDecoder(f).Decode(&snapshot); err != nil {
+		return fmt.Errorf("file store: corrupted snapshot: %s", err.Error())
+	}
+	for _, rec := range snapshot.Nodes {
+		fs.restore(rec)
+	}
+	fs.index = snapshot.Index
+	return nil
+}
+
+func (fs *FileStore) replayLog() error {
+	path := filepath.Join(fs.dir, fileLogName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64
+	snapshotIndex := fs.index
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// the last record was not completely written, i.e. crashed while appending
+				f.Close()
+				return os.Truncate(path, offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rec := fileRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("file store: corrupted log at offset %d: %s", offset, err.Error())
+		}
+		offset += int64(len(line))
+		fs.logRecords++
+
+		// already part of the snapshot, i.e. crashed while compacting. Records at the very
+		// same index are replayed, as the snapshot may have been taken in between them
+		if rec.Index < snapshotIndex {
+			continue
+		}
+		fs.restore(&rec)
+		fs.index = rec.Index
+	}
+}
+
+// restore applies a persisted record to the in memory state
+func (fs *FileStore) restore(rec *fileRecord) {
+	switch rec.Action {
+	case ActionDelete, ActionExpire, ActionCompareAndDelete:
+		delete(fs.nodes, rec.Key)
+	default:
+		fs.nodes[rec.Key] = &Node{
+			Key:           rec.Key,
+			Value:         rec.Value,
+			Expiration:    rec.Expiration,
+			TTL:           rec.TTL,
+			ModifiedIndex: rec.Index,
+			CreatedIndex:  rec.CreatedIndex,
+		}
+	}
+}
+
+// append persists a change, it is invoked by the MemoryStore holding its lock
+func (fs *FileStore) append(r *Response) {
+	if fs.err != nil {
+		return
+	}
+	rec := &fileRecord{
+		Action:       r.Action,
+		Index:        r.Index,
+		Key:          r.Node.Key,
+		Value:        r.Node.Value,
+		Expiration:   r.Node.Expiration,
+		TTL:          r.Node.TTL,
+		CreatedIndex: r.Node.CreatedIndex,
+	}
+	line, _ := json.Marshal(rec)
+	if _, err := fs.log.Write(append(line, '\n')); err != nil {
+		fs.err = fmt.Errorf("file store: unable to persist change: %s", err.Error())
+		return
+	}
+	if err := fs.log.Sync(); err != nil {
+		fs.err = fmt.Errorf("file store: unable to persist change: %s", err.Error())
+		return
+	}
+
+	fs.logRecords++
+	if fs.logRecords >= FILE_SNAPSHOT_THRESHOLD {
+		if err := fs.compact(); err != nil {
+			fs.err = fmt.Errorf("file store: unable to compact log: %s", err.Error())
+		}
+	}
+}
+
+// compact writes a snapshot with the current state and truncates the log
+func (fs *FileStore) compact() error {
+	snapshot := fileSnapshot{Index: fs.index, Nodes: []*fileRecord{}}
+	for _, n := range fs.nodes {
+		snapshot.Nodes = append(snapshot.Nodes, &fileRecord{
+			Index:        n.ModifiedIndex,
+			Key:          n.Key,
+			Value:        n.Value,
+			Expiration:   n.Expiration,
+			TTL:          n.TTL,
+			CreatedIndex: n.CreatedIndex,
+		})
+	}
+
+	tmp := filepath.Join(fs.dir, fileSnapshotName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, filepath.Join(fs.dir, fileSnapshotName)); err != nil {
+		return err
+	}
+
+	if err := fs.log.Truncate(0); err != nil {
+		return err
+	}
+	fs.logRecords = 0
+	return nil
+}
@@ -0,0 +1,110 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jteso/xchronos/store"
+)
+
+func newTempDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "xchronos")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %s", err.Error())
+	}
+	return dir
+}
+
+func TestFileSurvivesRestart(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := store.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	s.Set("/xchronos/etc/jobs/backup", "v1", 0)
+	s.Set("/xchronos/etc/jobs/backup", "v2", 0)
+	s.Set("/xchronos/etc/jobs/report", "v1", 0)
+	s.Delete("/xchronos/etc/jobs/report", false)
+	s.Set("/xchronos/etc/executors/agent_1", "up", 3600)
+	last, _ := s.Set("/xchronos/var/history/backup/1", "done", 0)
+	s.Close()
+
+	s, err = store.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer s.Close()
+
+	if n, err := s.Get("/xchronos/etc/jobs/backup", false); err != nil || n.Value != "v2" {
+		t.Errorf("Expected value [%s]. Observed [%+v, %v]", "v2", n, err)
+	}
+	if _, err := s.Get("/xchronos/etc/jobs/report", false); !store.IsKeyNotFound(err) {
+		t.Errorf("Expected deleted key not to be restored. Observed: %v", err)
+	}
+	if n, _ := s.Get("/xchronos/etc/executors/agent_1", false); n == nil || n.Expiration == nil {
+		t.Errorf("Expected expiration to be restored. Observed: %+v", n)
+	}
+
+	// the index carries on from where it was left
+	r, _ := s.Set("/xchronos/etc/jobs/backup", "v3", 0)
+	if r.Index != last.Index+1 {
+		t.Errorf("Expected index [%d]. Observed [%d]", last.Index+1, r.Index)
+	}
+	if r.PrevNode == nil || r.PrevNode.Value != "v2" {
+		t.Errorf("Expected previous value [%s]. Observed: %+v", "v2", r.PrevNode)
+	}
+}
+
+func TestFileCompaction(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	threshold := store.FILE_SNAPSHOT_THRESHOLD
+	store.FILE_SNAPSHOT_THRESHOLD = 5
+	defer func() { store.FILE_SNAPSHOT_THRESHOLD = threshold }()
+
+	s, _ := store.NewFileStore(dir)
+	for _, job := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		s.Set("/xchronos/etc/jobs/"+job, job, 0)
+	}
+	s.Delete("/xchronos/etc/jobs", true)
+	s.Set("/xchronos/etc/jobs/h", "h", 0)
+	s.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Fatalf("Expected a snapshot to be written. Observed: %s", err.Error())
+	}
+
+	s, _ = store.NewFileStore(dir)
+	defer s.Close()
+	nodes, err := s.List("/xchronos/etc/jobs", true)
+	if err != nil || len(nodes) != 1 || nodes[0].Value != "h" {
+		t.Errorf("Expected only job [h] to be restored. Observed: %+v, %v", nodes, err)
+	}
+}
+
+func TestFileTornWrite(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _ := store.NewFileStore(dir)
+	s.Set("/xchronos/etc/jobs/a", "a", 0)
+	s.Close()
+
+	// crashed while appending a record
+	log, _ := os.OpenFile(filepath.Join(dir, "changes.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	log.WriteString(`{"action":"set","index":2,"key":"/xchro`)
+	log.Close()
+
+	s, err := store.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Expected a torn write to be discarded. Observed: %s", err.Error())
+	}
+	defer s.Close()
+	if r, err := s.Set("/xchronos/etc/jobs/b", "b", 0); err != nil || r.Index != 2 {
+		t.Errorf("Expected index [%d]. Observed: %+v, %v", 2, r, err)
+	}
+}
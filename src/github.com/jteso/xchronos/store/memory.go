@@ -0,0 +1,399 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// How often the expired keys are purged by a MemoryStore
+	MEMORY_EXPIRE_INTERVAL = 500 * time.Millisecond
+	// Number of events kept to serve watches from a past index
+	MEMORY_HISTORY_SIZE = 1000
+)
+
+// MemoryStore is an in-process JobStore, meant to be shared by a number of agents
+// running within the same process (i.e. embedded use or testing).
+type MemoryStore struct {
+	mu sync.Mutex
+	// index of the last change applied to the store
+	index uint64
+	// leaves by key, directories only exist implicitly
+	nodes map[string]*Node
+	// last events, oldest first
+	history []*Response
+	// oldest index still available in history
+	historyStart uint64
+	watchers     map[*memoryWatcher]bool
+	// invoked holding the lock for every change applied (see FileStore)
+	journal func(*Response)
+
+	now       func() time.Time
+	closeC    chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryWatcher struct {
+	prefix    string
+	recursive bool
+
+	mu      sync.Mutex
+	pending []*Response
+	signalC chan struct{}
+}
+
+// NewMemoryStore creates a store whose keys expire on their own based on the wall clock
+func NewMemoryStore() *MemoryStore {
+	s := NewMemoryStoreWithClock(time.Now)
+	go s.expireEvery(MEMORY_EXPIRE_INTERVAL)
+	return s
+}
+
+// NewMemoryStoreWithClock creates a store driven by the given clock. Expired keys are
+// purged lazily on every operation, or explicitly via `Expire()`, which makes elections
+// and failovers fully deterministic when using a fake clock.
+func NewMemoryStoreWithClock(now func() time.Time) *MemoryStore {
+	return &MemoryStore{
+		nodes:    make(map[string]*Node),
+		watchers: make(map[*memoryWatcher]bool),
+		now:      now,
+		closeC:   make(chan struct{}),
+	}
+}
+
+func (s *MemoryStore) Get(key string, recursive bool) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	leaves := []*Node{}
+	for k, n := range s.nodes {
+		if k == key || strings.HasPrefix(k, strings.TrimRight(key, "/")+"/") {
+			leaves = append(leaves, s.clone(n))
+		}
+	}
+	n := buildTree(key, leaves, recursive)
+	if n == nil {
+		return nil, NewError(ErrCodeKeyNotFound, key, s.index)
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Create(key string, value string, ttl uint64) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	if err := s.checkWritable(key); err != nil {
+		return nil, err
+	}
+	if _, found := s.nodes[key]; found {
+		return nil, NewError(ErrCodeNodeExist, key, s.index)
+	}
+	return s.write(ActionCreate, key, value, ttl), nil
+}
+
+func (s *MemoryStore) Set(key string, value string, ttl uint64) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	if err := s.checkWritable(key); err != nil {
+		return nil, err
+	}
+	return s.write(ActionSet, key, value, ttl), nil
+}
+
+func (s *MemoryStore) CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return nil, NewError(ErrCodeInvalidInput, "either prevValue or prevIndex must be given", 0)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	if err := s.compare(key, prevValue, prevIndex); err != nil {
+		return nil, err
+	}
+	return s.write(ActionCompareAndSwap, key, value, ttl), nil
+}
+
+func (s *MemoryStore) CompareAndDelete(key string, prevValue string, prevIndex uint64) (*Response, error) {
+	if prevValue == "" && prevIndex == 0 {
+		return nil, NewError(ErrCodeInvalidInput, "either prevValue or prevIndex must be given", 0)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	if err := s.compare(key, prevValue, prevIndex); err != nil {
+		return nil, err
+	}
+	s.index++
+	return s.remove(ActionCompareAndDelete, key), nil
+}
+
+func (s *MemoryStore) Delete(key string, recursive bool) (*Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+
+	if _, found := s.nodes[key]; found {
+		s.index++
+		return s.remove(ActionDelete, key), nil
+	}
+
+	children := s.keysUnder(key)
+	if len(children) == 0 {
+		return nil, NewError(ErrCodeKeyNotFound, key, s.index)
+	}
+	if !recursive {
+		return nil, NewError(ErrCodeNotFile, key, s.index)
+	}
+	s.index++
+	for _, k := range children {
+		s.remove(ActionDelete, k)
+	}
+	return &Response{Action: ActionDelete, Node: &Node{Key: key, Dir: true, ModifiedIndex: s.index}, Index: s.index}, nil
+}
+
+func (s *MemoryStore) List(dir string, recursive bool) ([]*Node, error) {
+	n, err := s.Get(dir, recursive)
+	if err != nil {
+		return nil, err
+	}
+	if !n.Dir {
+		return nil, NewError(ErrCodeNotDir, dir, n.ModifiedIndex)
+	}
+	if recursive {
+		return Flatten(n), nil
+	}
+	return n.Nodes, nil
+}
+
+func (s *MemoryStore) Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *Response, stop chan bool) error {
+	defer close(receiver)
+
+	w := &memoryWatcher{
+		prefix:    prefix,
+		recursive: recursive,
+		signalC:   make(chan struct{}, 1),
+	}
+
+	s.mu.Lock()
+	if waitIndex > 0 {
+		if waitIndex < s.historyStart {
+			err := NewError(ErrCodeIndexCleared, fmt.Sprintf("the requested history has been cleared [%d/%d]", s.historyStart, waitIndex), s.index)
+			s.mu.Unlock()
+			return err
+		}
+		for _, r := range s.history {
+			if r.Index >= waitIndex {
+				w.push(r)
+			}
+		}
+	}
+	s.watchers[w] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return ErrWatchStoppedByUser
+		case <-s.closeC:
+			return NewError(ErrCodeUnreachable, "memory store has been closed", 0)
+		case <-w.signalC:
+			for _, r := range w.take() {
+				select {
+				case receiver <- r:
+				case <-stop:
+					return ErrWatchStoppedByUser
+				case <-s.closeC:
+					return NewError(ErrCodeUnreachable, "memory store has been closed", 0)
+				}
+			}
+		}
+	}
+}
+
+// Close stops purging expired keys and ends all the running watches
+func (s *MemoryStore) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeC)
+	})
+}
+
+// Expire purges all the keys whose TTL has run out, notifying the watchers
+func (s *MemoryStore) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+}
+
+func (s *MemoryStore) expireEvery(interval time.Duration) {
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-tkr.C:
+			s.Expire()
+		case <-s.closeC:
+			return
+		}
+	}
+}
+
+// === helpers, all of them must be called holding the lock ===
+
+func (s *MemoryStore) purgeExpired() {
+	now := s.now()
+	expired := []string{}
+	for k, n := range s.nodes {
+		if n.Expiration != nil && !now.Before(*n.Expiration) {
+			expired = append(expired, k)
+		}
+	}
+	sort.Strings(expired)
+	for _, k := range expired {
+		s.index++
+		s.remove(ActionExpire, k)
+	}
+}
+
+// checkWritable makes sure key is neither a directory nor under an existing leaf
+func (s *MemoryStore) checkWritable(key string) error {
+	if !strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return NewError(ErrCodeInvalidInput, key, s.index)
+	}
+	if len(s.keysUnder(key)) > 0 {
+		return NewError(ErrCodeNotFile, key, s.index)
+	}
+	for parent := key[:strings.LastIndex(key, "/")]; parent != ""; parent = parent[:strings.LastIndex(parent, "/")] {
+		if _, found := s.nodes[parent]; found {
+			return NewError(ErrCodeNotDir, parent, s.index)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) compare(key string, prevValue string, prevIndex uint64) error {
+	n, found := s.nodes[key]
+	if !found {
+		if len(s.keysUnder(key)) > 0 {
+			return NewError(ErrCodeNotFile, key, s.index)
+		}
+		return NewError(ErrCodeKeyNotFound, key, s.index)
+	}
+	if (prevValue != "" && n.Value != prevValue) || (prevIndex != 0 && n.ModifiedIndex != prevIndex) {
+		return NewError(ErrCodeTestFailed, fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, n.Value, prevIndex, n.ModifiedIndex), s.index)
+	}
+	return nil
+}
+
+func (s *MemoryStore) keysUnder(dir string) []string {
+	prefix := strings.TrimRight(dir, "/") + "/"
+	keys := []string{}
+	for k := range s.nodes {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *MemoryStore) write(action string, key string, value string, ttl uint64) *Response {
+	s.index++
+	prev := s.nodes[key]
+	n := &Node{
+		Key:           key,
+		Value:         value,
+		ModifiedIndex: s.index,
+		CreatedIndex:  s.index,
+	}
+	if prev != nil {
+		n.CreatedIndex = prev.CreatedIndex
+	}
+	if ttl > 0 {
+		expiration := s.now().Add(time.Duration(ttl) * time.Second)
+		n.Expiration = &expiration
+		n.TTL = int64(ttl)
+	}
+	s.nodes[key] = n
+
+	r := &Response{Action: action, Node: n, PrevNode: prev, Index: s.index}
+	s.emit(r)
+	return r
+}
+
+// remove deletes a leaf at the current index
+func (s *MemoryStore) remove(action string, key string) *Response {
+	prev := s.nodes[key]
+	delete(s.nodes, key)
+
+	r := &Response{Action: action, Node: &Node{Key: key, ModifiedIndex: s.index, CreatedIndex: prev.CreatedIndex}, PrevNode: prev, Index: s.index}
+	s.emit(r)
+	return r
+}
+
+func (s *MemoryStore) emit(r *Response) {
+	if s.journal != nil {
+		s.journal(r)
+	}
+	s.history = append(s.history, r)
+	if len(s.history) > MEMORY_HISTORY_SIZE {
+		dropped := len(s.history) - MEMORY_HISTORY_SIZE
+		s.historyStart = s.history[dropped-1].Index + 1
+		s.history = s.history[dropped:]
+	}
+	for w := range s.watchers {
+		w.push(r)
+	}
+}
+
+// clone returns a copy of a leaf with its remaining TTL
+func (s *MemoryStore) clone(n *Node) *Node {
+	c := *n
+	if c.Expiration != nil {
+		c.TTL = int64(c.Expiration.Sub(s.now()).Seconds() + 0.5)
+	}
+	return &c
+}
+
+func (w *memoryWatcher) matches(key string) bool {
+	if key == w.prefix {
+		return true
+	}
+	return w.recursive && strings.HasPrefix(key, strings.TrimRight(w.prefix, "/")+"/")
+}
+
+func (w *memoryWatcher) push(r *Response) {
+	if !w.matches(r.Node.Key) {
+		return
+	}
+	w.mu.Lock()
+	w.pending = append(w.pending, r)
+	w.mu.Unlock()
+
+	select {
+	case w.signalC <- struct{}{}:
+	default:
+	}
+}
+
+func (w *memoryWatcher) take() []*Response {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
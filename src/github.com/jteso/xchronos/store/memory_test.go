@@ -0,0 +1,169 @@
+package store_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/store"
+)
+
+// fakeClock lets the tests decide when TTLs run out
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestMemoryCreateIfAbsent(t *testing.T) {
+	clock := newFakeClock()
+	s := store.NewMemoryStoreWithClock(clock.Now)
+	defer s.Close()
+	key := "/xchronos/var/scheduler/election"
+
+	if _, err := s.Create(key, "agent_1", 10); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	_, err := s.Create(key, "agent_2", 10)
+	if store.ErrorCode(err) != 105 {
+		t.Fatalf("Expected error code [%d]. Observed: %v", 105, err)
+	}
+
+	clock.Advance(9 * time.Second)
+	if n, _ := s.Get(key, false); n == nil || n.Value != "agent_1" || n.TTL != 1 {
+		t.Fatalf("Expected agent_1 to be leader for 1 more second. Observed: %+v", n)
+	}
+
+	clock.Advance(1 * time.Second)
+	if _, err := s.Create(key, "agent_2", 10); err != nil {
+		t.Fatalf("Expected key to have expired. Observed error: %s", err.Error())
+	}
+}
+
+func TestMemoryCompareAndSwap(t *testing.T) {
+	s := store.NewMemoryStoreWithClock(newFakeClock().Now)
+	defer s.Close()
+
+	r, _ := s.Set("/xchronos/var/runs/1", "offered", 0)
+	if _, err := s.CompareAndSwap("/xchronos/var/runs/1", "claimed", 0, "offered", r.Node.ModifiedIndex); err != nil {
+		t.Fatalf("Expected swap to succeed. Observed error: %s", err.Error())
+	}
+	if _, err := s.CompareAndSwap("/xchronos/var/runs/1", "claimed", 0, "", r.Node.ModifiedIndex); !store.IsTestFailed(err) {
+		t.Errorf("Expected swap to fail. Observed error: %v", err)
+	}
+	if _, err := s.CompareAndDelete("/xchronos/var/runs/1", "offered", 0); !store.IsTestFailed(err) {
+		t.Errorf("Expected delete to fail. Observed error: %v", err)
+	}
+	if _, err := s.CompareAndDelete("/xchronos/var/runs/1", "claimed", 0); err != nil {
+		t.Errorf("Expected delete to succeed. Observed error: %s", err.Error())
+	}
+	if _, err := s.CompareAndSwap("/xchronos/var/runs/1", "claimed", 0, "offered", 0); !store.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found. Observed error: %v", err)
+	}
+}
+
+func TestMemoryDirectories(t *testing.T) {
+	s := store.NewMemoryStoreWithClock(newFakeClock().Now)
+	defer s.Close()
+
+	s.Set("/xchronos/etc/jobs/a", "1", 0)
+	s.Set("/xchronos/etc/jobs/b/c", "2", 0)
+
+	if _, err := s.Set("/xchronos/etc/jobs/a/x", "3", 0); store.ErrorCode(err) != store.ErrCodeNotDir {
+		t.Errorf("Expected not a directory error. Observed: %v", err)
+	}
+	if _, err := s.Set("/xchronos/etc/jobs/b", "3", 0); store.ErrorCode(err) != store.ErrCodeNotFile {
+		t.Errorf("Expected not a file error. Observed: %v", err)
+	}
+
+	nodes, _ := s.List("/xchronos/etc/jobs", false)
+	if len(nodes) != 2 || nodes[0].Dir || !nodes[1].Dir {
+		t.Errorf("Expected a leaf and a directory. Observed: %+v", nodes)
+	}
+
+	if _, err := s.Delete("/xchronos/etc/jobs", false); store.ErrorCode(err) != store.ErrCodeNotFile {
+		t.Errorf("Expected not a file error. Observed: %v", err)
+	}
+	s.Delete("/xchronos/etc/jobs", true)
+	if _, err := s.List("/xchronos/etc/jobs", true); !store.IsKeyNotFound(err) {
+		t.Errorf("Expected key not found. Observed: %v", err)
+	}
+}
+
+func TestMemoryWatch(t *testing.T) {
+	clock := newFakeClock()
+	s := store.NewMemoryStoreWithClock(clock.Now)
+	defer s.Close()
+
+	first, _ := s.Set("/xchronos/etc/executors/agent_1", "up", 10)
+	s.Set("/xchronos/etc/jobs/a", "1", 0)
+
+	receiver := make(chan *store.Response)
+	stop := make(chan bool, 1)
+	errC := make(chan error, 1)
+	go func() {
+		// past events are replayed from the given index
+		errC <- s.Watch("/xchronos/etc/executors", first.Index, true, receiver, stop)
+	}()
+
+	s.Set("/xchronos/etc/executors/agent_2", "up", 10)
+	s.Set("/xchronos/etc/executors/agent_2", "up", 10)
+	clock.Advance(10 * time.Second)
+	s.Expire()
+
+	expected := []string{
+		"set /xchronos/etc/executors/agent_1",
+		"set /xchronos/etc/executors/agent_2",
+		"set /xchronos/etc/executors/agent_2",
+		"expire /xchronos/etc/executors/agent_1",
+		"expire /xchronos/etc/executors/agent_2",
+	}
+	lastIndex := uint64(0)
+	for _, e := range expected {
+		select {
+		case r := <-receiver:
+			if observed := r.Action + " " + r.Node.Key; observed != e {
+				t.Errorf("Expected event [%s]. Observed [%s]", e, observed)
+			}
+			if r.Index <= lastIndex {
+				t.Errorf("Expected events ordered by index. Observed [%d] after [%d]", r.Index, lastIndex)
+			}
+			lastIndex = r.Index
+		case <-time.After(time.Second):
+			t.Fatalf("Expected event [%s]. Observed none", e)
+		}
+	}
+
+	stop <- true
+	if err := <-errC; err != store.ErrWatchStoppedByUser {
+		t.Errorf("Expected watch to be stopped by the user. Observed: %v", err)
+	}
+}
+
+func TestMemoryWatchClearedIndex(t *testing.T) {
+	s := store.NewMemoryStoreWithClock(newFakeClock().Now)
+	defer s.Close()
+
+	for i := 0; i < store.MEMORY_HISTORY_SIZE+10; i++ {
+		s.Set("/xchronos/etc/jobs/a", "1", 0)
+	}
+	err := s.Watch("/xchronos/etc/jobs", 1, true, make(chan *store.Response), make(chan bool))
+	if store.ErrorCode(err) != store.ErrCodeIndexCleared {
+		t.Errorf("Expected index cleared error. Observed: %v", err)
+	}
+}
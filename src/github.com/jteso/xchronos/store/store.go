@@ -0,0 +1,252 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error codes shared by all the job stores. They mirror the etcd v2 error codes
+// so the agent can reason about failures regardless of the backend in use.
+const (
+	ErrCodeKeyNotFound  = 100
+	ErrCodeTestFailed   = 101
+	ErrCodeNotFile      = 102
+	ErrCodeNotDir       = 104
+	ErrCodeNodeExist    = 105
+	ErrCodeInvalidInput = 400
+	ErrCodeIndexCleared = 401
+	ErrCodeUnreachable  = 501
+)
+
+// Actions reported by a Response, either returned by a write or received via Watch
+const (
+	ActionGet              = "get"
+	ActionCreate           = "create"
+	ActionSet              = "set"
+	ActionUpdate           = "update"
+	ActionDelete           = "delete"
+	ActionExpire           = "expire"
+	ActionCompareAndSwap   = "compareAndSwap"
+	ActionCompareAndDelete = "compareAndDelete"
+)
+
+var (
+	ErrWatchStoppedByUser = errors.New("Watch stopped by the user via stop channel")
+)
+
+// JobStore is the coordination backend used by the agents to elect a leader,
+// advertise executors and exchange job offers. Keys are slash separated paths
+// (i.e. /xchronos/etc/jobs/<job_id>) and a ttl of 0 means the key never expires.
+type JobStore interface {
+	// Get returns the node stored under key. If the key is a directory and recursive
+	// is set, all its descendants will be returned as well.
+	Get(key string, recursive bool) (*Node, error)
+
+	// Create puts a value only if the key does not exist yet, otherwise fails with
+	// an `ErrCodeNodeExist` error.
+	Create(key string, value string, ttl uint64) (*Response, error)
+
+	// Set puts a value regardless of the key existing or not.
+	Set(key string, value string, ttl uint64) (*Response, error)
+
+	// CompareAndSwap puts a value only if the current value or index of the key matches
+	// the one given. Either prevValue or prevIndex must be provided.
+	CompareAndSwap(key string, value string, ttl uint64, prevValue string, prevIndex uint64) (*Response, error)
+
+	// CompareAndDelete deletes a key only if the current value or index of the key matches
+	// the one given. Either prevValue or prevIndex must be provided.
+	CompareAndDelete(key string, prevValue string, prevIndex uint64) (*Response, error)
+
+	// Delete removes a key, or a whole directory if recursive is set.
+	Delete(key string, recursive bool) (*Response, error)
+
+	// List returns the nodes found under dir sorted by key. If recursive is set, the
+	// returned list is flattened and only contains the leaves (non dir nodes).
+	List(dir string, recursive bool) ([]*Node, error)
+
+	// Watch blocks sending to receiver any change under prefix (or just for the key if
+	// recursive is false) since waitIndex (0 meaning from now on). It only returns when
+	// a value is sent on stop (ErrWatchStoppedByUser) or on error, closing receiver in
+	// both cases. The error is ErrCodeIndexCleared if the changes since waitIndex are not
+	// known anymore, so they are to be read again.
+	Watch(prefix string, waitIndex uint64, recursive bool, receiver chan *Response, stop chan bool) error
+
+	// Close releases any resource hold by the store
+	Close()
+}
+
+type Response struct {
+	Action   string
+	Node     *Node
+	PrevNode *Node
+	// Index of the store right after the change has been applied
+	Index uint64
+}
+
+type Node struct {
+	Key           string
+	Value         string
+	Dir           bool
+	Expiration    *time.Time
+	TTL           int64
+	Nodes         Nodes
+	ModifiedIndex uint64
+	CreatedIndex  uint64
+}
+
+type Nodes []*Node
+
+// interfaces for sorting
+func (ns Nodes) Len() int {
+	return len(ns)
+}
+
+func (ns Nodes) Less(i, j int) bool {
+	return ns[i].Key < ns[j].Key
+}
+
+func (ns Nodes) Swap(i, j int) {
+	ns[i], ns[j] = ns[j], ns[i]
+}
+
+// Flatten returns all the leaves found in a tree of nodes, sorted by key
+func Flatten(n *Node) []*Node {
+	leaves := Nodes{}
+	var walk func(*Node)
+	walk = func(n *Node) {
+		if !n.Dir {
+			leaves = append(leaves, n)
+			return
+		}
+		for _, child := range n.Nodes {
+			walk(child)
+		}
+	}
+	walk(n)
+	sort.Sort(leaves)
+	return leaves
+}
+
+// buildTree rebuilds the etcd like directory structure out of a flat list of leaves,
+// for those stores with no notion of directories. Returns nil if there is nothing under key.
+func buildTree(key string, leaves []*Node, recursive bool) *Node {
+	// the root dir is kept as "" so the parent of any key can be found by trimming its last segment
+	key = strings.TrimRight("/"+strings.Trim(key, "/"), "/")
+	root := &Node{Key: key, Dir: true}
+	if key == "" {
+		root.Key = "/"
+	}
+	dirs := map[string]*Node{key: root}
+
+	var dirFor func(string) *Node
+	dirFor = func(dirKey string) *Node {
+		if d, ok := dirs[dirKey]; ok {
+			return d
+		}
+		d := &Node{Key: dirKey, Dir: true}
+		dirs[dirKey] = d
+		parent := dirFor(dirKey[:strings.LastIndex(dirKey, "/")])
+		parent.Nodes = append(parent.Nodes, d)
+		return d
+	}
+
+	for _, e := range leaves {
+		if e.Key == key {
+			return e
+		}
+		parentKey := e.Key[:strings.LastIndex(e.Key, "/")]
+		if parentKey != key && !recursive {
+			// only the immediate children are reported, subdirs are kept empty
+			child := key + "/" + strings.SplitN(strings.TrimPrefix(e.Key, key+"/"), "/", 2)[0]
+			dirFor(child)
+			continue
+		}
+		dirFor(parentKey).Nodes = append(dirFor(parentKey).Nodes, e)
+	}
+
+	if len(root.Nodes) == 0 {
+		return nil
+	}
+	for _, d := range dirs {
+		sort.Sort(d.Nodes)
+		for _, n := range d.Nodes {
+			if n.ModifiedIndex > d.ModifiedIndex {
+				d.ModifiedIndex = n.ModifiedIndex
+			}
+		}
+	}
+	return root
+}
+
+// Error reported by any job store.
+type Error struct {
+	ErrorCode int
+	Message   string
+	Cause     string
+	Index     uint64
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%v: %v (%v) [%v]", e.ErrorCode, e.Message, e.Cause, e.Index)
+}
+
+var errorMessages = map[int]string{
+	ErrCodeKeyNotFound:  "Key not found",
+	ErrCodeTestFailed:   "Compare failed",
+	ErrCodeNotFile:      "Not a file",
+	ErrCodeNotDir:       "Not a directory",
+	ErrCodeNodeExist:    "Key already exists",
+	ErrCodeInvalidInput: "Invalid input",
+	ErrCodeIndexCleared: "The event in requested index is outdated and cleared",
+	ErrCodeUnreachable:  "All the given peers are not reachable",
+}
+
+func NewError(errorCode int, cause string, index uint64) *Error {
+	return &Error{
+		ErrorCode: errorCode,
+		Message:   errorMessages[errorCode],
+		Cause:     cause,
+		Index:     index,
+	}
+}
+
+// ErrorCode returns the code of a store error, or 0 if err was not reported by a store
+func ErrorCode(err error) int {
+	if storeErr, ok := err.(*Error); ok {
+		return storeErr.ErrorCode
+	}
+	return 0
+}
+
+func IsKeyNotFound(err error) bool {
+	return ErrorCode(err) == ErrCodeKeyNotFound
+}
+
+func IsNodeExist(err error) bool {
+	return ErrorCode(err) == ErrCodeNodeExist
+}
+
+func IsTestFailed(err error) bool {
+	return ErrorCode(err) == ErrCodeTestFailed
+}
+
+// Join builds a key out of a number of path segments, i.e. Join("/xchronos", "etc", "jobs")
+func Join(segments ...string) string {
+	parts := []string{}
+	for _, s := range segments {
+		s = strings.Trim(s, "/")
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// Base returns the last segment of a key, i.e. the <job_id> of /xchronos/etc/jobs/<job_id>
+func Base(key string) string {
+	key = strings.TrimRight(key, "/")
+	return key[strings.LastIndex(key, "/")+1:]
+}
@@ -0,0 +1,47 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/jteso/xchronos/store"
+)
+
+func TestJoinAndBase(t *testing.T) {
+	key := store.Join("/xchronos/etc/", "jobs", "/backup/")
+	if key != "/xchronos/etc/jobs/backup" {
+		t.Errorf("Expected key [%s]. Observed [%s]\n", "/xchronos/etc/jobs/backup", key)
+	}
+	if base := store.Base(key); base != "backup" {
+		t.Errorf("Expected base [%s]. Observed [%s]\n", "backup", base)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	tree := &store.Node{Key: "/a", Dir: true, Nodes: store.Nodes{
+		{Key: "/a/z", Value: "1"},
+		{Key: "/a/b", Dir: true, Nodes: store.Nodes{
+			{Key: "/a/b/c", Value: "2"},
+		}},
+	}}
+
+	leaves := store.Flatten(tree)
+	if len(leaves) != 2 {
+		t.Fatalf("Expected [%d] leaves. Observed [%d] leaves\n", 2, len(leaves))
+	}
+	if leaves[0].Key != "/a/b/c" || leaves[1].Key != "/a/z" {
+		t.Errorf("Expected leaves sorted by key. Observed [%s, %s]\n", leaves[0].Key, leaves[1].Key)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	err := error(store.NewError(store.ErrCodeNodeExist, "/xchronos/var/scheduler/election", 7))
+	if !store.IsNodeExist(err) {
+		t.Errorf("Expected a node exist error. Observed [%s]\n", err.Error())
+	}
+	if store.IsKeyNotFound(err) {
+		t.Errorf("Expected not to be a key not found error")
+	}
+	if store.ErrorCode(nil) != 0 {
+		t.Errorf("Expected no error code for a nil error")
+	}
+}
@@ -0,0 +1,554 @@
+package trigger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+var (
+	// How far in the future a cron expression is evaluated before giving up (i.e. 30th of February)
+	CRON_MAX_YEARS = 30
+)
+
+var (
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 0 1 1 *",
+		"@annually": "0 0 0 1 1 *",
+		"@monthly":  "0 0 0 1 * *",
+		"@weekly":   "0 0 0 * * 0",
+		"@daily":    "0 0 0 * * *",
+		"@midnight": "0 0 0 * * *",
+		"@hourly":   "0 0 * * * *",
+	}
+
+	monthNames = map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}
+	weekdayNames = map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}
+)
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondField  = cronField{"second", 0, 59, nil}
+	minuteField  = cronField{"minute", 0, 59, nil}
+	hourField    = cronField{"hour", 0, 23, nil}
+	domField     = cronField{"day-of-month", 1, 31, nil}
+	monthField   = cronField{"month", 1, 12, monthNames}
+	weekdayField = cronField{"day-of-week", 0, 7, weekdayNames}
+)
+
+// CronParseError reports an invalid cron expression, pointing at the offending column
+type CronParseError struct {
+	Expression string
+	// 1-based position of the offending token within the expression
+	Column  int
+	Field   string
+	Message string
+}
+
+func (e *CronParseError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Invalid cron expression [%s] at column %d: %s", e.Expression, e.Column, e.Message)
+	}
+	return fmt.Sprintf("Invalid cron expression [%s] at column %d (%s): %s", e.Expression, e.Column, e.Field, e.Message)
+}
+
+// CronSchedule is a parsed cron expression. It supports both the standard 5 fields
+// (minute hour day-of-month month day-of-week) and the 6 fields flavour with seconds
+// first, as well as:
+//
+//   - lists (1,5), ranges (1-5), steps (*/15, 10-40/10), '?' as an alias of '*'
+//   - month and day-of-week names (JAN, MON), day-of-week goes from 0 (SUN) to 7 (SUN)
+//   - day-of-month: L (last day), L-3 (3 days before the last one), LW (last weekday),
+//     15W (weekday nearest to the 15th, within the same month)
+//   - day-of-week: 5L (last friday of the month), 5#3 (third friday of the month)
+//   - macros: @yearly, @annually, @monthly, @weekly, @daily, @midnight and @hourly
+//
+// As in vixie cron, if both day-of-month and day-of-week are restricted, a day matches
+// when any of them does.
+type CronSchedule struct {
+	expression string
+
+	seconds, minutes, hours, months uint64
+
+	daysOfMonth uint64
+	// L, L-n
+	lastDayOfMonth bool
+	lastDayOffset  int
+	// LW
+	lastWeekday bool
+	// nW
+	nearestWeekdays []int
+
+	daysOfWeek uint64
+	// nL
+	lastWeekdaysOfMonth []int
+	// n#m
+	nthWeekdays [][2]int
+
+	domRestricted, dowRestricted bool
+}
+
+// ParseCron parses a cron expression
+func ParseCron(expression string) (*CronSchedule, error) {
+	spec := strings.TrimSpace(expression)
+	offset := strings.Index(expression, spec)
+	if spec == "" {
+		return nil, &CronParseError{Expression: expression, Column: 1, Message: "empty expression"}
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		macro, found := cronMacros[strings.ToLower(spec)]
+		if !found {
+			return nil, &CronParseError{Expression: expression, Column: offset + 1, Message: fmt.Sprintf("unknown macro [%s]", spec)}
+		}
+		s, err := ParseCron(macro)
+		if err != nil {
+			return nil, err
+		}
+		s.expression = expression
+		return s, nil
+	}
+
+	tokens, columns := splitFields(expression)
+	switch len(tokens) {
+	case 5:
+		// no seconds field
+		tokens = append([]string{"0"}, tokens...)
+		columns = append([]int{0}, columns...)
+	case 6:
+	default:
+		return nil, &CronParseError{Expression: expression, Column: offset + 1, Message: fmt.Sprintf("expected 5 or 6 fields, got %d", len(tokens))}
+	}
+
+	p := &cronParser{expression: expression}
+	s := &CronSchedule{expression: expression}
+	s.seconds = p.parseField(tokens[0], columns[0], secondField)
+	s.minutes = p.parseField(tokens[1], columns[1], minuteField)
+	s.hours = p.parseField(tokens[2], columns[2], hourField)
+	p.parseDaysOfMonth(s, tokens[3], columns[3])
+	s.months = p.parseField(tokens[4], columns[4], monthField)
+	p.parseDaysOfWeek(s, tokens[5], columns[5])
+	if p.err != nil {
+		return nil, p.err
+	}
+	return s, nil
+}
+
+// splitFields splits an expression by whitespaces, returning the fields along with their
+// 1-based columns
+func splitFields(expression string) ([]string, []int) {
+	tokens := []string{}
+	columns := []int{}
+	start := -1
+	for i, c := range expression + " " {
+		if c == ' ' || c == '\t' {
+			if start >= 0 {
+				tokens = append(tokens, expression[start:i])
+				columns = append(columns, start+1)
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	return tokens, columns
+}
+
+func (s *CronSchedule) String() string {
+	return s.expression
+}
+
+// Next returns the first time matching the schedule strictly after `after`, evaluated
+// on the wall clock of loc. Returns the zero time if there is none within CRON_MAX_YEARS.
+func (s *CronSchedule) Next(after time.Time, loc *time.Location) time.Time {
+	t := after.In(loc)
+	year, month, day := t.Date()
+	w := wallClock{year, int(month), day, t.Hour(), t.Minute(), t.Second() + 1}
+	w.normalize()
+	maxYear := year + CRON_MAX_YEARS
+
+	for w.year <= maxYear {
+		if !hasBit(s.months, w.month) {
+			m, found := nextBit(s.months, w.month, 12)
+			if !found {
+				w = wallClock{w.year + 1, 1, 1, 0, 0, 0}
+				continue
+			}
+			w = wallClock{w.year, m, 1, 0, 0, 0}
+		}
+		if w.day > daysIn(w.year, w.month) {
+			w = wallClock{w.year, w.month + 1, 1, 0, 0, 0}
+			w.normalize()
+			continue
+		}
+		if !s.matchDay(w.year, w.month, w.day) {
+			w = wallClock{w.year, w.month, w.day + 1, 0, 0, 0}
+			w.normalize()
+			continue
+		}
+		if !hasBit(s.hours, w.hour) {
+			h, found := nextBit(s.hours, w.hour, 23)
+			if !found {
+				w = wallClock{w.year, w.month, w.day + 1, 0, 0, 0}
+				w.normalize()
+				continue
+			}
+			w.hour, w.minute, w.second = h, 0, 0
+		}
+		if !hasBit(s.minutes, w.minute) {
+			m, found := nextBit(s.minutes, w.minute, 59)
+			if !found {
+				w.hour, w.minute, w.second = w.hour+1, 0, 0
+				w.normalize()
+				continue
+			}
+			w.minute, w.second = m, 0
+		}
+		if !hasBit(s.seconds, w.second) {
+			sec, found := nextBit(s.seconds, w.second, 59)
+			if !found {
+				w.minute, w.second = w.minute+1, 0
+				w.normalize()
+				continue
+			}
+			w.second = sec
+		}
+
+		if candidate := w.resolve(loc); candidate.After(after) {
+			return candidate
+		}
+		// wall clock already gone by
+		w.second++
+		w.normalize()
+	}
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchDay(year int, month int, day int) bool {
+	dom := s.matchDayOfMonth(year, month, day)
+	dow := s.matchDayOfWeek(year, month, day)
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (s *CronSchedule) matchDayOfMonth(year int, month int, day int) bool {
+	if hasBit(s.daysOfMonth, day) {
+		return true
+	}
+	last := daysIn(year, month)
+	if s.lastDayOfMonth && day == last-s.lastDayOffset {
+		return true
+	}
+	if s.lastWeekday && day == nearestWeekday(year, month, last) {
+		return true
+	}
+	for _, n := range s.nearestWeekdays {
+		if n <= last && day == nearestWeekday(year, month, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *CronSchedule) matchDayOfWeek(year int, month int, day int) bool {
+	weekday := int(time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Weekday())
+	if hasBit(s.daysOfWeek, weekday) {
+		return true
+	}
+	for _, wd := range s.lastWeekdaysOfMonth {
+		if weekday == wd && day+7 > daysIn(year, month) {
+			return true
+		}
+	}
+	for _, nth := range s.nthWeekdays {
+		if weekday == nth[0] && (day-1)/7+1 == nth[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// CronTrigger fires whenever its cron schedule matches the wall clock of Location, from
+// StartTime on. See `resolve` for how DST transitions are dealt with.
+type CronTrigger struct {
+	Schedule  *CronSchedule
+	StartTime time.Time
+	Location  *time.Location
+}
+
+func NewCronTrigger(spec job.TriggerSpec, state *State) (*CronTrigger, error) {
+	schedule, err := ParseCron(spec.CronExpression)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := loadLocation(spec.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return &CronTrigger{
+		Schedule:  schedule,
+		StartTime: state.StartTime,
+		Location:  loc,
+	}, nil
+}
+
+func (t *CronTrigger) NextFireTime(after time.Time) time.Time {
+	if after.Before(t.StartTime) {
+		// StartTime itself may be a fire time
+		after = t.StartTime.Add(-time.Nanosecond)
+	}
+	return t.Schedule.Next(after, t.Location)
+}
+
+// === parsing ===
+
+type cronParser struct {
+	expression string
+	// first error found
+	err error
+}
+
+func (p *cronParser) fail(column int, field cronField, format string, v ...interface{}) {
+	if p.err == nil {
+		p.err = &CronParseError{Expression: p.expression, Column: column, Field: field.name, Message: fmt.Sprintf(format, v...)}
+	}
+}
+
+// parseField parses a list of values, ranges and steps. Column is where the token starts
+func (p *cronParser) parseField(token string, column int, field cronField) uint64 {
+	var bits uint64
+	for _, part := range splitList(token, column) {
+		bits |= p.parseRange(part.token, part.column, field)
+	}
+	return bits
+}
+
+type listPart struct {
+	token  string
+	column int
+}
+
+func splitList(token string, column int) []listPart {
+	parts := []listPart{}
+	for _, part := range strings.Split(token, ",") {
+		parts = append(parts, listPart{part, column})
+		column += len(part) + 1
+	}
+	return parts
+}
+
+// parseRange parses *, ?, n, a-b, */step, n/step and a-b/step
+func (p *cronParser) parseRange(token string, column int, field cronField) uint64 {
+	if token == "" {
+		p.fail(column, field, "empty value")
+		return 0
+	}
+
+	rangeToken, step := token, 1
+	if i := strings.Index(token, "/"); i >= 0 {
+		rangeToken = token[:i]
+		stepToken := token[i+1:]
+		n, err := strconv.Atoi(stepToken)
+		if err != nil || n <= 0 {
+			p.fail(column+i+1, field, "invalid step [%s]", stepToken)
+			return 0
+		}
+		step = n
+	}
+
+	var start, end int
+	switch {
+	case rangeToken == "*" || rangeToken == "?":
+		start, end = field.min, field.max
+	case strings.Contains(rangeToken, "-"):
+		i := strings.Index(rangeToken, "-")
+		var ok bool
+		if start, ok = p.parseValue(rangeToken[:i], column, field); !ok {
+			return 0
+		}
+		if end, ok = p.parseValue(rangeToken[i+1:], column+i+1, field); !ok {
+			return 0
+		}
+		if end < start {
+			p.fail(column, field, "range [%s] ends before it starts", rangeToken)
+			return 0
+		}
+	default:
+		var ok bool
+		if start, ok = p.parseValue(rangeToken, column, field); !ok {
+			return 0
+		}
+		end = start
+		if step > 1 {
+			// n/step means from n to the max
+			end = field.max
+		}
+	}
+
+	var bits uint64
+	for v := start; v <= end; v += step {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func (p *cronParser) parseValue(token string, column int, field cronField) (int, bool) {
+	if v, found := field.names[strings.ToUpper(token)]; found {
+		return v, true
+	}
+	v, err := strconv.Atoi(token)
+	if err != nil {
+		p.fail(column, field, "invalid value [%s]", token)
+		return 0, false
+	}
+	if v < field.min || v > field.max {
+		p.fail(column, field, "value [%d] out of range [%d-%d]", v, field.min, field.max)
+		return 0, false
+	}
+	return v, true
+}
+
+func (p *cronParser) parseDaysOfMonth(s *CronSchedule, token string, column int) {
+	s.domRestricted = token != "*" && token != "?"
+	for _, part := range splitList(token, column) {
+		t := strings.ToUpper(part.token)
+		switch {
+		case t == "L":
+			s.lastDayOfMonth = true
+		case t == "LW":
+			s.lastWeekday = true
+		case strings.HasPrefix(t, "L-"):
+			n, err := strconv.Atoi(t[2:])
+			if err != nil || n < 0 || n > 30 {
+				p.fail(part.column+2, domField, "invalid offset from the last day [%s]", part.token[2:])
+				continue
+			}
+			s.lastDayOfMonth = true
+			s.lastDayOffset = n
+		case strings.HasSuffix(t, "W"):
+			if n, ok := p.parseValue(t[:len(t)-1], part.column, domField); ok {
+				s.nearestWeekdays = append(s.nearestWeekdays, n)
+			}
+		default:
+			s.daysOfMonth |= p.parseRange(part.token, part.column, domField)
+		}
+	}
+}
+
+func (p *cronParser) parseDaysOfWeek(s *CronSchedule, token string, column int) {
+	s.dowRestricted = token != "*" && token != "?"
+	for _, part := range splitList(token, column) {
+		t := strings.ToUpper(part.token)
+		switch {
+		case t == "L":
+			// as in quartz, the last day of the week
+			s.daysOfWeek |= 1 << 6
+		case strings.HasSuffix(t, "L"):
+			if wd, ok := p.parseValue(t[:len(t)-1], part.column, weekdayField); ok {
+				s.lastWeekdaysOfMonth = append(s.lastWeekdaysOfMonth, wd%7)
+			}
+		case strings.Contains(t, "#"):
+			i := strings.Index(t, "#")
+			wd, ok := p.parseValue(t[:i], part.column, weekdayField)
+			if !ok {
+				continue
+			}
+			nth, err := strconv.Atoi(t[i+1:])
+			if err != nil || nth < 1 || nth > 5 {
+				p.fail(part.column+i+1, weekdayField, "invalid week of the month [%s], expected 1-5", t[i+1:])
+				continue
+			}
+			s.nthWeekdays = append(s.nthWeekdays, [2]int{wd % 7, nth})
+		default:
+			bits := p.parseRange(part.token, part.column, weekdayField)
+			// 7 is sunday as well
+			if hasBit(bits, 7) {
+				bits = bits&^(1<<7) | 1
+			}
+			s.daysOfWeek |= bits
+		}
+	}
+}
+
+// === calendar helpers ===
+
+// wallClock is a date and time as seen on the wall clock of a location, fields may
+// temporarily overflow until normalized
+type wallClock struct {
+	year, month, day, hour, minute, second int
+}
+
+// normalize carries any overflowed field onto the next one
+func (w *wallClock) normalize() {
+	if w.second > 59 {
+		w.minute += w.second / 60
+		w.second %= 60
+	}
+	if w.minute > 59 {
+		w.hour += w.minute / 60
+		w.minute %= 60
+	}
+	if w.hour > 23 {
+		w.day += w.hour / 24
+		w.hour %= 24
+	}
+	for w.month > 12 || w.day > daysIn(w.year, w.month) {
+		if w.month > 12 {
+			w.year++
+			w.month -= 12
+			continue
+		}
+		w.day -= daysIn(w.year, w.month)
+		w.month++
+	}
+}
+
+func daysIn(year int, month int) int {
+	return time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// nearestWeekday returns the weekday closest to the given day, without leaving the month
+func nearestWeekday(year int, month int, day int) int {
+	switch time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).Weekday() {
+	case time.Saturday:
+		if day == 1 {
+			return day + 2
+		}
+		return day - 1
+	case time.Sunday:
+		if day == daysIn(year, month) {
+			return day - 2
+		}
+		return day + 1
+	}
+	return day
+}
+
+func hasBit(bits uint64, n int) bool {
+	return bits&(1<<uint(n)) != 0
+}
+
+// nextBit returns the first bit set from `from` to `max`, both included
+func nextBit(bits uint64, from int, max int) (int, bool) {
+	for n := from; n <= max; n++ {
+		if hasBit(bits, n) {
+			return n, true
+		}
+	}
+	return 0, false
+}
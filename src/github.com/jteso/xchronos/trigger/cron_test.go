@@ -0,0 +1,126 @@
+package trigger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/trigger"
+)
+
+func parseTime(t *testing.T, value string) time.Time {
+	tm, err := time.Parse("2006-01-02 15:04:05", value)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return tm
+}
+
+func TestCronNext(t *testing.T) {
+	cases := []struct {
+		expression string
+		after      string
+		expected   string
+	}{
+		// 5 fields
+		{"*/15 * * * *", "2016-01-01 00:00:00", "2016-01-01 00:15:00"},
+		{"0 9-17/4 * * MON-FRI", "2016-01-01 18:00:00", "2016-01-04 09:00:00"},
+		{"30 2 1,15 JAN,jul *", "2016-01-15 02:30:00", "2016-07-01 02:30:00"},
+		// 6 fields, seconds first
+		{"* * 1 * * *", "2016-01-01 00:00:00", "2016-01-01 01:00:00"},
+		{"10/20 * * * * ?", "2016-01-01 00:00:31", "2016-01-01 00:00:50"},
+		// macros
+		{"@hourly", "2016-01-01 00:00:00", "2016-01-01 01:00:00"},
+		{"@weekly", "2016-01-01 00:00:00", "2016-01-03 00:00:00"},
+		{"@yearly", "2016-01-01 00:00:00", "2017-01-01 00:00:00"},
+		// last day of the month, leap year
+		{"0 0 0 L * ?", "2016-02-01 00:00:00", "2016-02-29 00:00:00"},
+		{"0 0 0 L-2 * ?", "2016-04-01 00:00:00", "2016-04-28 00:00:00"},
+		// last weekday: 2016-04-30 is a saturday
+		{"0 0 0 LW * ?", "2016-04-01 00:00:00", "2016-04-29 00:00:00"},
+		// nearest weekday: 2016-05-01 is a sunday, 2016-10-15 a saturday
+		{"0 0 0 1W * ?", "2016-04-30 00:00:00", "2016-05-02 00:00:00"},
+		{"0 0 0 15W * ?", "2016-10-01 00:00:00", "2016-10-14 00:00:00"},
+		// last friday, third monday
+		{"0 0 0 ? * 5L", "2016-01-01 00:00:00", "2016-01-29 00:00:00"},
+		{"0 0 0 ? * MON#3", "2016-01-01 00:00:00", "2016-01-18 00:00:00"},
+		// 7 is sunday too
+		{"0 0 * * 7", "2016-01-01 00:00:00", "2016-01-03 00:00:00"},
+		// day-of-month OR day-of-week when both are restricted
+		{"0 0 13 * FRI", "2016-01-02 00:00:00", "2016-01-08 00:00:00"},
+		// leap day, years ahead
+		{"0 0 29 2 *", "2016-03-01 00:00:00", "2020-02-29 00:00:00"},
+	}
+
+	for _, c := range cases {
+		schedule, err := trigger.ParseCron(c.expression)
+		if err != nil {
+			t.Errorf("Unexpected error parsing [%s]: %s", c.expression, err.Error())
+			continue
+		}
+		expected := parseTime(t, c.expected)
+		if next := schedule.Next(parseTime(t, c.after), time.UTC); !next.Equal(expected) {
+			t.Errorf("Expected [%s] after [%s] to fire at [%s]. Observed [%s]", c.expression, c.after, expected, next)
+		}
+	}
+}
+
+func TestCronNeverFires(t *testing.T) {
+	schedule, err := trigger.ParseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if next := schedule.Next(scheduledAt, time.UTC); !next.IsZero() {
+		t.Errorf("Expected no fire on the 30th of february. Observed [%s]", next)
+	}
+}
+
+func TestCronParseErrors(t *testing.T) {
+	cases := []struct {
+		expression string
+		column     int
+	}{
+		{"", 1},
+		{"* * * *", 1},
+		{"@fortnightly", 1},
+		{"61 * * * *", 1},
+		{"0 25 * * *", 3},
+		{"0 0 * FOO *", 7},
+		{"0 0 1-x * *", 7},
+		{"*/0 * * * *", 3},
+		{"0 0 * * MON#6", 13},
+		{"0 0 10-5 * *", 5},
+		{"0 0 1,,2 * *", 7},
+		{"0 0 0 L-40 * ?", 9},
+	}
+
+	for _, c := range cases {
+		_, err := trigger.ParseCron(c.expression)
+		perr, ok := err.(*trigger.CronParseError)
+		if !ok {
+			t.Errorf("Expected [%s] to be rejected. Observed: %v", c.expression, err)
+			continue
+		}
+		if perr.Column != c.column {
+			t.Errorf("Expected [%s] to fail at column [%d]. Observed [%d]: %s", c.expression, c.column, perr.Column, perr.Error())
+		}
+	}
+}
+
+func TestCronTriggerStartDelay(t *testing.T) {
+	j := job.New("report")
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_CRON, CronExpression: "0 * * * *", StartDelay: time.Hour}
+
+	fires := fireAll(t, j, trigger.NewState(j, scheduledAt), scheduledAt, 3)
+	for i, fire := range fires {
+		expected := scheduledAt.Add(time.Duration(i+1) * time.Hour)
+		if !fire.Equal(expected) {
+			t.Errorf("Expected fire #%d at [%s]. Observed [%s]", i, expected, fire)
+		}
+	}
+
+	j.Trigger.CronExpression = "0 * * *"
+	if _, err := trigger.New(j.Trigger, trigger.NewState(j, scheduledAt)); err == nil {
+		t.Errorf("Expected invalid expression to be rejected")
+	}
+}
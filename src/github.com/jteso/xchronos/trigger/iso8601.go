@@ -0,0 +1,286 @@
+package trigger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+const (
+	// Layouts accepted for the start of an ISO 8601 repeating interval. The ones without an
+	// offset are read in the time zone of the schedule.
+	iso8601Layout      = time.RFC3339Nano
+	iso8601LocalLayout = "2006-01-02T15:04:05.999999999"
+	iso8601BasicLayout = "20060102T150405Z07:00"
+)
+
+// Period is an ISO 8601 duration, i.e. P1Y2M3W4DT5H6M7.5S. Years, months, weeks and days
+// are calendar units, so P1D lasts 23 hours on a spring forward day
+type Period struct {
+	Years, Months, Weeks, Days int
+	Hours, Minutes             int
+	Seconds                    float64
+}
+
+// ParsePeriod parses an ISO 8601 duration
+func ParsePeriod(value string) (Period, error) {
+	p := Period{}
+	if !strings.HasPrefix(value, "P") || value == "P" || strings.HasSuffix(value, "T") {
+		return p, fmt.Errorf("Invalid ISO 8601 period [%s]", value)
+	}
+
+	// designators allowed, in order, before and after T
+	designators := "YMWD"
+	inTime := false
+	number := ""
+	for _, c := range value[1:] {
+		switch {
+		case c >= '0' && c <= '9' || c == '.' || c == ',':
+			number += string(c)
+			continue
+		case c == 'T':
+			if number != "" || inTime {
+				return p, fmt.Errorf("Invalid ISO 8601 period [%s]: misplaced T", value)
+			}
+			designators = "HMS"
+			inTime = true
+			continue
+		}
+
+		i := strings.IndexRune(designators, c)
+		if i < 0 || number == "" {
+			return p, fmt.Errorf("Invalid ISO 8601 period [%s]: unexpected %q", value, c)
+		}
+		designators = designators[i+1:]
+
+		if c == 'S' {
+			seconds, err := strconv.ParseFloat(strings.Replace(number, ",", ".", 1), 64)
+			if err != nil {
+				return p, fmt.Errorf("Invalid ISO 8601 period [%s]: %s", value, number)
+			}
+			p.Seconds = seconds
+			number = ""
+			continue
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return p, fmt.Errorf("Invalid ISO 8601 period [%s]: only seconds can be fractional", value)
+		}
+		number = ""
+		switch {
+		case c == 'Y':
+			p.Years = n
+		case c == 'W':
+			p.Weeks = n
+		case c == 'D':
+			p.Days = n
+		case c == 'H':
+			p.Hours = n
+		case c == 'M' && inTime:
+			p.Minutes = n
+		case c == 'M':
+			p.Months = n
+		}
+	}
+	if number != "" {
+		return p, fmt.Errorf("Invalid ISO 8601 period [%s]: missing designator", value)
+	}
+	return p, nil
+}
+
+// IsZero tells whether the period does not last at all
+func (p Period) IsZero() bool {
+	return p == Period{}
+}
+
+func (p Period) String() string {
+	s := "P"
+	for _, part := range []struct {
+		n          int
+		designator string
+	}{{p.Years, "Y"}, {p.Months, "M"}, {p.Weeks, "W"}, {p.Days, "D"}} {
+		if part.n != 0 {
+			s += strconv.Itoa(part.n) + part.designator
+		}
+	}
+	clock := ""
+	if p.Hours != 0 {
+		clock += strconv.Itoa(p.Hours) + "H"
+	}
+	if p.Minutes != 0 {
+		clock += strconv.Itoa(p.Minutes) + "M"
+	}
+	if p.Seconds != 0 {
+		clock += strconv.FormatFloat(p.Seconds, 'f', -1, 64) + "S"
+	}
+	if clock != "" || s == "P" {
+		if clock == "" {
+			clock = "0S"
+		}
+		s += "T" + clock
+	}
+	return s
+}
+
+// AddTo returns t plus n times the period. Calendar units are added on the wall clock
+// of t's location (see `resolve` for DST transitions), while hours, minutes and seconds
+// are elapsed time.
+func (p Period) AddTo(t time.Time, n int) time.Time {
+	if p.Years != 0 || p.Months != 0 || p.Weeks != 0 || p.Days != 0 {
+		year, month, day := t.Date()
+		w := wallClock{year + n*p.Years, int(month) + n*p.Months, day + n*(7*p.Weeks+p.Days), t.Hour(), t.Minute(), t.Second()}
+		w.normalize()
+		t = w.resolve(t.Location()).Add(time.Duration(t.Nanosecond()))
+	}
+	return t.Add(time.Duration(n) * p.clock())
+}
+
+func (p Period) clock() time.Duration {
+	return time.Duration(p.Hours)*time.Hour + time.Duration(p.Minutes)*time.Minute +
+		time.Duration(p.Seconds*float64(time.Second))
+}
+
+// approximate returns the average length of the period
+func (p Period) approximate() time.Duration {
+	day := 24 * time.Hour
+	return time.Duration(p.Years)*time.Duration(365.2425*float64(day)) +
+		time.Duration(p.Months)*time.Duration(30.436875*float64(day)) +
+		time.Duration(7*p.Weeks+p.Days)*day + p.clock()
+}
+
+// ISO8601Schedule is an ISO 8601 repeating interval such as R5/2016-01-01T00:00:00Z/PT1H30M:
+// fires at Start and then every Period, Repetitions times in total (-1, written as R/,
+// meaning forever)
+type ISO8601Schedule struct {
+	Repetitions int
+	Start       time.Time
+	Period      Period
+	// Time zone calendar units of the period are added in
+	Location *time.Location
+
+	// Start was written without an offset
+	noOffset bool
+}
+
+// ParseISO8601 parses an ISO 8601 repeating interval in UTC
+func ParseISO8601(value string) (*ISO8601Schedule, error) {
+	return ParseISO8601InLocation(value, time.UTC)
+}
+
+// ParseISO8601InLocation parses an ISO 8601 repeating interval evaluated in the given
+// time zone
+func ParseISO8601InLocation(value string, loc *time.Location) (*ISO8601Schedule, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "R") {
+		return nil, fmt.Errorf("Invalid ISO 8601 schedule [%s]: expected R[n]/start/period", value)
+	}
+
+	s := &ISO8601Schedule{Repetitions: -1, Location: loc}
+	if parts[0] != "R" {
+		n, err := strconv.Atoi(parts[0][1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid ISO 8601 schedule [%s]: invalid repetitions [%s]", value, parts[0])
+		}
+		s.Repetitions = n
+	}
+
+	var err error
+	if s.Start, s.noOffset, err = parseISO8601Time(parts[1], loc); err != nil {
+		return nil, fmt.Errorf("Invalid ISO 8601 schedule [%s]: invalid start [%s]", value, parts[1])
+	}
+
+	if s.Period, err = ParsePeriod(parts[2]); err != nil {
+		return nil, err
+	}
+	if s.Period.IsZero() && s.Repetitions != 0 && s.Repetitions != 1 {
+		return nil, fmt.Errorf("Invalid ISO 8601 schedule [%s]: repeating an empty period", value)
+	}
+	if !s.Period.IsZero() && s.Period.approximate() <= 0 {
+		return nil, fmt.Errorf("Invalid ISO 8601 schedule [%s]: period out of range", value)
+	}
+	return s, nil
+}
+
+func parseISO8601Time(value string, loc *time.Location) (time.Time, bool, error) {
+	for _, layout := range []string{iso8601Layout, iso8601BasicLayout} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, false, nil
+		}
+	}
+	t, err := time.ParseInLocation(iso8601LocalLayout, value, loc)
+	return t, true, err
+}
+
+// String returns the canonical form of the schedule
+func (s *ISO8601Schedule) String() string {
+	repetitions := "R"
+	if s.Repetitions >= 0 {
+		repetitions += strconv.Itoa(s.Repetitions)
+	}
+	start := s.Start.Format(iso8601Layout)
+	if s.noOffset {
+		start = s.Start.Format(iso8601LocalLayout)
+	}
+	return repetitions + "/" + start + "/" + s.Period.String()
+}
+
+// Next returns the first fire time strictly after `after`, or the zero time if the
+// repetitions are exhausted
+func (s *ISO8601Schedule) Next(after time.Time) time.Time {
+	if s.Repetitions == 0 {
+		return time.Time{}
+	}
+	if after.Before(s.Start) {
+		return s.Start
+	}
+	if s.Period.IsZero() {
+		return time.Time{}
+	}
+
+	// jump close to the answer, then walk to it
+	start := s.Start.In(s.Location)
+	n := int(after.Sub(start) / s.Period.approximate())
+	for n > 0 && s.Period.AddTo(start, n).After(after) {
+		n--
+	}
+	for !s.Period.AddTo(start, n).After(after) {
+		n++
+	}
+	if s.Repetitions > 0 && n >= s.Repetitions {
+		return time.Time{}
+	}
+	return s.Period.AddTo(start, n)
+}
+
+// ISO8601Trigger fires as told by its ISO 8601 schedule, skipping fire times before
+// StartTime (i.e. the job was scheduled after the start of the interval)
+type ISO8601Trigger struct {
+	Schedule  *ISO8601Schedule
+	StartTime time.Time
+}
+
+func NewISO8601Trigger(spec job.TriggerSpec, state *State) (*ISO8601Trigger, error) {
+	loc, err := loadLocation(spec.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := ParseISO8601InLocation(spec.Schedule, loc)
+	if err != nil {
+		return nil, err
+	}
+	return &ISO8601Trigger{
+		Schedule:  schedule,
+		StartTime: state.StartTime,
+	}, nil
+}
+
+func (t *ISO8601Trigger) NextFireTime(after time.Time) time.Time {
+	if after.Before(t.StartTime) {
+		// StartTime itself may be a fire time
+		after = t.StartTime.Add(-time.Nanosecond)
+	}
+	return t.Schedule.Next(after)
+}
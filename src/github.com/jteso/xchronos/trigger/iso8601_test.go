@@ -0,0 +1,102 @@
+package trigger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/trigger"
+)
+
+func TestISO8601RoundTrip(t *testing.T) {
+	cases := map[string]string{
+		"R5/2026-01-01T00:00:00Z/PT1H30M":                "R5/2026-01-01T00:00:00Z/PT1H30M",
+		"R/2026-01-01T00:00:00+02:00/P1Y2M3W4DT5H6M7.5S": "R/2026-01-01T00:00:00+02:00/P1Y2M3W4DT5H6M7.5S",
+		"R0/2026-01-01T00:00:00.5Z/P1D":                  "R0/2026-01-01T00:00:00.5Z/P1D",
+		"R1/2026-01-01T08:00:00/PT0S":                    "R1/2026-01-01T08:00:00/PT0S",
+		// basic format and decimal comma
+		"R2/20260101T000000Z/PT0,5S": "R2/2026-01-01T00:00:00Z/PT0.5S",
+	}
+
+	for value, canonical := range cases {
+		s, err := trigger.ParseISO8601(value)
+		if err != nil {
+			t.Errorf("Unexpected error parsing [%s]: %s", value, err.Error())
+			continue
+		}
+		if s.String() != canonical {
+			t.Errorf("Expected [%s]. Observed [%s]", canonical, s.String())
+		}
+	}
+}
+
+func TestISO8601Invalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"R5/2026-01-01T00:00:00Z",
+		"X5/2026-01-01T00:00:00Z/PT1H",
+		"R-1/2026-01-01T00:00:00Z/PT1H",
+		"R5/yesterday/PT1H",
+		"R5/2026-01-01T00:00:00Z/1H",
+		"R5/2026-01-01T00:00:00Z/PT",
+		"R5/2026-01-01T00:00:00Z/P1H",
+		"R5/2026-01-01T00:00:00Z/PT1M1H",
+		"R5/2026-01-01T00:00:00Z/P1.5D",
+		"R/2026-01-01T00:00:00Z/PT0S",
+		"R/2020-01-01T00:00:00Z/PT0.0000000001S",
+		"R1/2020-01-01T00:00:00Z/PT0.0000000001S",
+	} {
+		if _, err := trigger.ParseISO8601(value); err == nil {
+			t.Errorf("Expected [%s] to be rejected", value)
+		}
+	}
+}
+
+func TestISO8601Next(t *testing.T) {
+	start := time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		schedule string
+		after    time.Time
+		expected time.Time
+	}{
+		{"R5/2026-01-31T00:00:00Z/PT1H30M", start.Add(-time.Hour), start},
+		{"R5/2026-01-31T00:00:00Z/PT1H30M", start, start.Add(90 * time.Minute)},
+		{"R5/2026-01-31T00:00:00Z/PT1H30M", start.Add(5 * time.Hour), start.Add(6 * time.Hour)},
+		// 5 fires in total
+		{"R5/2026-01-31T00:00:00Z/PT1H30M", start.Add(6 * time.Hour), time.Time{}},
+		{"R0/2026-01-31T00:00:00Z/PT1H30M", start.Add(-time.Hour), time.Time{}},
+		// months are always added to the start
+		{"R/2026-01-31T00:00:00Z/P1M", start.AddDate(0, 2, 0), start.AddDate(0, 3, 0)},
+		{"R/2026-01-31T00:00:00Z/P1Y", start.AddDate(9, 0, 1), start.AddDate(10, 0, 0)},
+		{"R/2026-01-31T00:00:00Z/P2W", start.AddDate(0, 0, 15), start.AddDate(0, 0, 28)},
+		// offsets
+		{"R/2026-01-31T00:00:00+02:00/P1D", start, start.Add(22 * time.Hour)},
+	}
+
+	for _, c := range cases {
+		s, err := trigger.ParseISO8601(c.schedule)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if next := s.Next(c.after); !next.Equal(c.expected) {
+			t.Errorf("Expected [%s] after [%s] to fire at [%s]. Observed [%s]", c.schedule, c.after, c.expected, next)
+		}
+	}
+}
+
+func TestISO8601Trigger(t *testing.T) {
+	j := job.New("report")
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_ISO8601, Schedule: "R4/2015-12-31T23:00:00Z/PT30M"}
+
+	// the first fires were due before the job got scheduled
+	fires := fireAll(t, j, trigger.NewState(j, scheduledAt), scheduledAt.Add(-time.Hour), 10)
+	expected := []time.Time{scheduledAt, scheduledAt.Add(30 * time.Minute)}
+	if len(fires) != len(expected) {
+		t.Fatalf("Expected [%d] fires. Observed [%d] fires", len(expected), len(fires))
+	}
+	for i := range fires {
+		if !fires[i].Equal(expected[i]) {
+			t.Errorf("Expected fire #%d at [%s]. Observed [%s]", i, expected[i], fires[i])
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package trigger
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jteso/xchronos/job"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Factory builds a custom trigger out of the params stored along with the job definition
+// (see `EncodeParams`), carrying on from the given state
+type Factory func(params []byte, state *State) (Trigger, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+func init() {
+	job.CheckTrigger = Validate
+}
+
+// Register makes a custom trigger available to jobs under the given name. It is meant
+// to be called from the init function of the application embedding the agent, and
+// panics if the name is already taken.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("trigger: Register factory is nil")
+	}
+	if _, found := factories[name]; found {
+		panic("trigger: Register called twice for " + name)
+	}
+	factories[name] = factory
+}
+
+// Registered returns the names of the registered custom triggers, sorted
+func Registered() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := []string{}
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newCustomTrigger(spec job.TriggerSpec, state *State) (Trigger, error) {
+	factoriesMu.RLock()
+	factory, found := factories[spec.Name]
+	factoriesMu.RUnlock()
+	if !found {
+		return nil, &job.ValidationError{Field: "trigger.name", Message: fmt.Sprintf("unknown custom trigger [%s], registered: %v", spec.Name, Registered())}
+	}
+	t, err := factory(spec.Params, state)
+	if err != nil {
+		return nil, &job.ValidationError{Field: "trigger.params", Message: err.Error()}
+	}
+	return t, nil
+}
+
+// Validate checks a trigger can be built out of spec, i.e. its cron expression parses
+// or its custom trigger is registered
+func Validate(spec job.TriggerSpec) error {
+	_, err := New(spec, &State{})
+	switch err.(type) {
+	case nil, *job.ValidationError:
+		return err
+	case *CronParseError:
+		return &job.ValidationError{Field: "trigger.cronExpression", Message: err.Error()}
+	}
+	if spec.Type == job.TRIGGER_ISO8601 {
+		return &job.ValidationError{Field: "trigger.schedule", Message: err.Error()}
+	}
+	return &job.ValidationError{Field: "trigger.type", Message: err.Error()}
+}
+
+// EncodeParams encodes the params of a custom trigger, to be stored as TriggerSpec.Params
+func EncodeParams(v interface{}) ([]byte, error) {
+	var params []byte
+	err := codec.NewEncoderBytes(&params, jsonHandle).Encode(v)
+	return params, err
+}
+
+// DecodeParams decodes the params of a custom trigger encoded with EncodeParams
+func DecodeParams(params []byte, v interface{}) error {
+	return codec.NewDecoderBytes(params, jsonHandle).Decode(v)
+}
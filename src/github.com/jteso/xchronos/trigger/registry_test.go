@@ -0,0 +1,100 @@
+package trigger_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+	"github.com/jteso/xchronos/trigger"
+)
+
+// fires every given hours, on the hour
+type hourlyParams struct {
+	Hours int `codec:"hours"`
+}
+
+type hourlyTrigger struct {
+	hours int
+}
+
+func (t *hourlyTrigger) NextFireTime(after time.Time) time.Time {
+	next := after.Truncate(time.Hour).Add(time.Hour)
+	for next.Hour()%t.hours != 0 {
+		next = next.Add(time.Hour)
+	}
+	return next
+}
+
+func init() {
+	trigger.Register("hourly", func(params []byte, state *trigger.State) (trigger.Trigger, error) {
+		p := hourlyParams{}
+		if err := trigger.DecodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Hours <= 0 {
+			return nil, errors.New("hours must be positive")
+		}
+		return &hourlyTrigger{p.Hours}, nil
+	})
+}
+
+func newCustomJob(t *testing.T, name string, hours int) *job.Job {
+	params, err := trigger.EncodeParams(hourlyParams{hours})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	j := job.New("report")
+	j.Executor = job.ExecutorSpec{Type: job.EXECUTOR_COMMAND, Command: "/usr/bin/report.sh"}
+	j.Trigger = job.TriggerSpec{Type: job.TRIGGER_CUSTOM, Name: name, Params: params}
+	return j
+}
+
+func TestCustomTrigger(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	if err := job.Create(s, newCustomJob(t, "hourly", 6)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	j, err := job.Get(s, "report")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	fires := fireAll(t, j, trigger.NewState(j, scheduledAt), scheduledAt, 2)
+	expected := []time.Time{scheduledAt.Add(6 * time.Hour), scheduledAt.Add(12 * time.Hour)}
+	for i := range expected {
+		if i >= len(fires) || !fires[i].Equal(expected[i]) {
+			t.Errorf("Expected fires %v. Observed %v", expected, fires)
+			break
+		}
+	}
+}
+
+func TestCustomTriggerValidation(t *testing.T) {
+	cases := map[string]*job.Job{
+		"trigger.name":   newCustomJob(t, "weekly", 6),
+		"trigger.params": newCustomJob(t, "hourly", 0),
+	}
+	cron := newCustomJob(t, "", 0)
+	cron.Trigger = job.TriggerSpec{Type: job.TRIGGER_CRON, CronExpression: "0 0 32 * *"}
+	cases["trigger.cronExpression"] = cron
+	iso := newCustomJob(t, "", 0)
+	iso.Trigger = job.TriggerSpec{Type: job.TRIGGER_ISO8601, Schedule: "R/2020-01-01T00:00:00Z/PT0.0000000001S"}
+	cases["trigger.schedule"] = iso
+
+	for field, j := range cases {
+		err := j.Validate()
+		if verr, ok := err.(*job.ValidationError); !ok || verr.Field != field {
+			t.Errorf("Expected invalid [%s]. Observed: %v", field, err)
+		}
+	}
+
+	err := newCustomJob(t, "weekly", 6).Validate()
+	if err == nil || !strings.Contains(err.Error(), "weekly") || !strings.Contains(err.Error(), "hourly") {
+		t.Errorf("Expected error to name the unknown and the registered triggers. Observed: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package trigger
+
+import (
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+// SimpleTrigger fires at StartTime and then every RepeatInterval, RepeatCount more
+// times (-1 meaning forever, 0 a one-shot trigger)
+type SimpleTrigger struct {
+	StartTime      time.Time
+	RepeatInterval time.Duration
+	RepeatCount    int
+	// Number of fires so far, so the count is honored across leader failovers
+	FiredCount int
+}
+
+func NewSimpleTrigger(spec job.TriggerSpec, state *State) *SimpleTrigger {
+	return &SimpleTrigger{
+		StartTime:      state.StartTime,
+		RepeatInterval: spec.RepeatInterval,
+		RepeatCount:    spec.RepeatCount,
+		FiredCount:     state.FiredCount,
+	}
+}
+
+func (t *SimpleTrigger) NextFireTime(after time.Time) time.Time {
+	if t.RepeatCount >= 0 && t.FiredCount > t.RepeatCount {
+		// 1 + RepeatCount fires already
+		return time.Time{}
+	}
+	if after.Before(t.StartTime) {
+		return t.StartTime
+	}
+	if t.RepeatCount == 0 || t.RepeatInterval <= 0 {
+		return time.Time{}
+	}
+
+	repeat := int64(after.Sub(t.StartTime)/t.RepeatInterval) + 1
+	if t.RepeatCount > 0 && repeat > int64(t.RepeatCount) {
+		return time.Time{}
+	}
+	return t.StartTime.Add(time.Duration(repeat) * t.RepeatInterval)
+}
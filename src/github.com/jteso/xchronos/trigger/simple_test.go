@@ -0,0 +1,127 @@
+package trigger_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+	"github.com/jteso/xchronos/trigger"
+)
+
+var scheduledAt = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newSimpleJob(startDelay time.Duration, repeatInterval time.Duration, repeatCount int) *job.Job {
+	j := job.New("report")
+	j.Trigger = job.TriggerSpec{
+		Type:           job.TRIGGER_SIMPLE,
+		StartDelay:     startDelay,
+		RepeatInterval: repeatInterval,
+		RepeatCount:    repeatCount,
+	}
+	return j
+}
+
+// fireAll fires the trigger up to max times, recording every fire in the state
+func fireAll(t *testing.T, j *job.Job, st *trigger.State, from time.Time, max int) []time.Time {
+	fires := []time.Time{}
+	after := from
+	for i := 0; i < max; i++ {
+		tr, err := trigger.New(j.Trigger, st)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		next := tr.NextFireTime(after)
+		if next.IsZero() {
+			break
+		}
+		fires = append(fires, next)
+		st.Fired(next, time.Time{})
+		after = next
+	}
+	return fires
+}
+
+func TestSimpleOneShot(t *testing.T) {
+	j := newSimpleJob(10*time.Second, 0, 0)
+	fires := fireAll(t, j, trigger.NewState(j, scheduledAt), scheduledAt, 10)
+
+	if len(fires) != 1 || !fires[0].Equal(scheduledAt.Add(10*time.Second)) {
+		t.Errorf("Expected a single fire at [%s]. Observed %v", scheduledAt.Add(10*time.Second), fires)
+	}
+}
+
+func TestSimpleRepeatCount(t *testing.T) {
+	j := newSimpleJob(10*time.Second, 2*time.Second, 3)
+	fires := fireAll(t, j, trigger.NewState(j, scheduledAt), scheduledAt, 10)
+
+	if len(fires) != 4 {
+		t.Fatalf("Expected [%d] fires. Observed [%d] fires", 4, len(fires))
+	}
+	for i, fire := range fires {
+		expected := scheduledAt.Add(10*time.Second + time.Duration(i)*2*time.Second)
+		if !fire.Equal(expected) {
+			t.Errorf("Expected fire #%d at [%s]. Observed [%s]", i, expected, fire)
+		}
+	}
+}
+
+func TestSimpleRepeatForever(t *testing.T) {
+	j := newSimpleJob(0, time.Minute, -1)
+	fires := fireAll(t, j, trigger.NewState(j, scheduledAt), scheduledAt.Add(-time.Second), 1000)
+
+	if len(fires) != 1000 {
+		t.Errorf("Expected [%d] fires. Observed [%d] fires", 1000, len(fires))
+	}
+	// not aligned with the fire times
+	tr, _ := trigger.New(j.Trigger, trigger.NewState(j, scheduledAt))
+	if next := tr.NextFireTime(scheduledAt.Add(90 * time.Second)); !next.Equal(scheduledAt.Add(2 * time.Minute)) {
+		t.Errorf("Expected next fire at [%s]. Observed [%s]", scheduledAt.Add(2*time.Minute), next)
+	}
+}
+
+func TestSimpleFiredCountSurvivesFailover(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	j := newSimpleJob(0, time.Second, 4)
+
+	// first leader fires the job twice
+	st := trigger.NewState(j, scheduledAt)
+	fireAll(t, j, st, scheduledAt.Add(-time.Second), 2)
+	if err := trigger.SaveState(s, st); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// new leader takes over much later, the repeat count is not restarted
+	st, err := trigger.LoadState(s, j.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if st.FiredCount != 2 || !st.StartTime.Equal(scheduledAt) {
+		t.Fatalf("Expected state to be restored. Observed: %+v", st)
+	}
+	fires := fireAll(t, j, st, scheduledAt.Add(time.Second), 10)
+	if len(fires) != 3 {
+		t.Errorf("Expected [%d] remaining fires. Observed [%d] fires", 3, len(fires))
+	}
+}
+
+func TestSaveStateConflict(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+	j := newSimpleJob(0, time.Second, -1)
+
+	trigger.SaveState(s, trigger.NewState(j, scheduledAt))
+	if err := trigger.SaveState(s, trigger.NewState(j, scheduledAt)); err != trigger.ErrStateModified {
+		t.Errorf("Expected [%v]. Observed [%v]", trigger.ErrStateModified, err)
+	}
+
+	st1, _ := trigger.LoadState(s, j.ID)
+	st2, _ := trigger.LoadState(s, j.ID)
+	st1.Fired(scheduledAt, scheduledAt.Add(time.Second))
+	st2.Fired(scheduledAt, scheduledAt.Add(time.Second))
+	trigger.SaveState(s, st1)
+	if err := trigger.SaveState(s, st2); err != trigger.ErrStateModified {
+		t.Errorf("Expected [%v]. Observed [%v]", trigger.ErrStateModified, err)
+	}
+}
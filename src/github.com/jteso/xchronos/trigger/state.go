@@ -0,0 +1,116 @@
+package trigger
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/store"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	TRIGGERS_DIR = "/xchronos/var/triggers"
+)
+
+var (
+	ErrStateNotFound = errors.New("Trigger state not found")
+	ErrStateModified = errors.New("Trigger state has been modified since it was read")
+
+	jsonHandle = new(codec.JsonHandle)
+)
+
+// State of the trigger of a job, stored under TRIGGERS_DIR/<job_id> so a new leader
+// carries on from where the previous one left it
+type State struct {
+	JobID string `codec:"jobId"`
+	// Time the job got scheduled for the first time, plus its start delay
+	StartTime time.Time `codec:"startTime"`
+	// Number of times the job has been fired
+	FiredCount   int       `codec:"firedCount"`
+	LastFireTime time.Time `codec:"lastFireTime"`
+	// Zero if the trigger will not fire anymore
+	NextFireTime time.Time `codec:"nextFireTime"`
+
+	// store index the state was read at, used to detect concurrent updates
+	index uint64
+}
+
+// NewState returns the initial state of the trigger of a job being scheduled at scheduledAt
+func NewState(j *job.Job, scheduledAt time.Time) *State {
+	return &State{
+		JobID:     j.ID,
+		StartTime: scheduledAt.Add(j.Trigger.StartDelay),
+	}
+}
+
+// Reset starts the trigger over as if the job was being scheduled at scheduledAt,
+// i.e. its trigger has been changed
+func (st *State) Reset(j *job.Job, scheduledAt time.Time) {
+	st.StartTime = scheduledAt.Add(j.Trigger.StartDelay)
+	st.FiredCount = 0
+	st.LastFireTime = time.Time{}
+	st.NextFireTime = time.Time{}
+}
+
+// Fired records the job has been fired at `at`, and when it should be fired next
+func (st *State) Fired(at time.Time, next time.Time) {
+	st.FiredCount++
+	st.LastFireTime = at
+	st.NextFireTime = next
+}
+
+func StateKey(jobID string) string {
+	return TRIGGERS_DIR + "/" + jobID
+}
+
+func LoadState(s store.JobStore, jobID string) (*State, error) {
+	n, err := s.Get(StateKey(jobID), false)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, ErrStateNotFound
+		}
+		return nil, err
+	}
+
+	st := &State{}
+	if err := codec.NewDecoderBytes([]byte(n.Value), jsonHandle).Decode(st); err != nil {
+		return nil, err
+	}
+	st.index = n.ModifiedIndex
+	return st, nil
+}
+
+// SaveState stores the state of a trigger. It fails with ErrStateModified if the state has
+// been changed since it was loaded (or created, if it is a new one), i.e. by another leader.
+func SaveState(s store.JobStore, st *State) error {
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, jsonHandle).Encode(st); err != nil {
+		return err
+	}
+
+	var r *store.Response
+	var err error
+	if st.index == 0 {
+		r, err = s.Create(StateKey(st.JobID), string(b), 0)
+	} else {
+		r, err = s.CompareAndSwap(StateKey(st.JobID), string(b), 0, "", st.index)
+	}
+	if err != nil {
+		if store.IsNodeExist(err) || store.IsTestFailed(err) || store.IsKeyNotFound(err) {
+			return ErrStateModified
+		}
+		return err
+	}
+	st.index = r.Node.ModifiedIndex
+	return nil
+}
+
+func DeleteState(s store.JobStore, jobID string) error {
+	_, err := s.Delete(StateKey(jobID), false)
+	if store.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
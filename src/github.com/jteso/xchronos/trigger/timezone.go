@@ -0,0 +1,53 @@
+package trigger
+
+import (
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+// loadLocation returns the IANA time zone a trigger is evaluated in, UTC by default
+func loadLocation(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, &job.ValidationError{Field: "trigger.timeZone", Message: err.Error()}
+	}
+	return loc, nil
+}
+
+// resolve returns the instant the wall clock of loc shows the given time. Around DST
+// transitions:
+//
+//   - skipped times (spring forward, i.e. 02:30 in New York) resolve to the instant the
+//     clocks jump, so the job still fires that day, right after the gap
+//   - repeated times (fall back, i.e. 01:30 in New York) resolve to their first occurrence,
+//     so the job fires once
+func (w wallClock) resolve(loc *time.Location) time.Time {
+	// the wall clock as if it was UTC, to be shifted by the offset in effect
+	wall := time.Date(w.year, time.Month(w.month), w.day, w.hour, w.minute, w.second, 0, time.UTC)
+
+	// offsets in effect around it, transitions are never that close to each other
+	var earliest, latest time.Time
+	for _, around := range []time.Time{wall.Add(-24 * time.Hour), wall, wall.Add(24 * time.Hour)} {
+		_, offset := around.In(loc).Zone()
+		candidate := wall.Add(-time.Duration(offset) * time.Second)
+		if latest.IsZero() || candidate.After(latest) {
+			latest = candidate
+		}
+		if _, actual := candidate.In(loc).Zone(); actual != offset {
+			// the wall clock does not show it with this offset
+			continue
+		}
+		if earliest.IsZero() || candidate.Before(earliest) {
+			earliest = candidate
+		}
+	}
+	if !earliest.IsZero() {
+		return earliest.In(loc)
+	}
+
+	// in a gap: the latest candidate was shifted with the offset before the transition,
+	// so it lands past the transition, within the new zone period
+	start, _ := latest.In(loc).ZoneBounds()
+	return start
+}
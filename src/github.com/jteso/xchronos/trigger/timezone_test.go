@@ -0,0 +1,136 @@
+package trigger_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+	"github.com/jteso/xchronos/trigger"
+)
+
+// TestMain loads the time zones from the IANA 2026c database in testdata, so the
+// transitions expected do not depend on the one of the host
+func TestMain(m *testing.M) {
+	if _, err := os.Stat("testdata/zoneinfo.zip"); err != nil {
+		panic(err)
+	}
+	os.Setenv("ZONEINFO", "testdata/zoneinfo.zip")
+	os.Exit(m.Run())
+}
+
+func utc(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339, value)
+	return t
+}
+
+func newZonedTrigger(t *testing.T, spec job.TriggerSpec) trigger.Trigger {
+	j := job.New("report")
+	j.Trigger = spec
+	tr, err := trigger.New(j.Trigger, trigger.NewState(j, time.Time{}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return tr
+}
+
+func TestCronDSTTransitions(t *testing.T) {
+	cases := []struct {
+		zone       string
+		expression string
+		after      string
+		expected   []string
+	}{
+		// spring forward: 02:30 does not exist, fires when clocks jump to 03:00 EDT
+		{"America/New_York", "30 2 * * *", "2026-03-07T12:00:00Z", []string{"2026-03-08T07:00:00Z", "2026-03-09T06:30:00Z"}},
+		// fall back: 01:30 happens twice, fires at the first one (EDT) only
+		{"America/New_York", "30 1 * * *", "2026-10-31T12:00:00Z", []string{"2026-11-01T05:30:00Z", "2026-11-02T06:30:00Z"}},
+		{"America/New_York", "*/30 * * * *", "2026-11-01T05:00:00Z", []string{"2026-11-01T05:30:00Z", "2026-11-01T07:00:00Z"}},
+		{"Europe/London", "30 1 * * *", "2026-03-28T12:00:00Z", []string{"2026-03-29T01:00:00Z", "2026-03-30T00:30:00Z"}},
+		{"Europe/London", "30 1 * * *", "2026-10-24T12:00:00Z", []string{"2026-10-25T00:30:00Z", "2026-10-26T01:30:00Z"}},
+		// southern hemisphere: DST ends in april and starts in october
+		{"Australia/Sydney", "30 2 * * *", "2026-04-04T00:00:00Z", []string{"2026-04-04T15:30:00Z", "2026-04-05T16:30:00Z"}},
+		{"Australia/Sydney", "30 2 * * *", "2026-10-03T00:00:00Z", []string{"2026-10-03T16:00:00Z", "2026-10-04T15:30:00Z"}},
+		// half an hour DST shift: 02:00 to 02:30
+		{"Australia/Lord_Howe", "15 2 * * *", "2026-10-03T00:00:00Z", []string{"2026-10-03T15:30:00Z", "2026-10-04T15:15:00Z"}},
+		// no DST at all
+		{"Asia/Kolkata", "0 9 * * *", "2026-03-08T00:00:00Z", []string{"2026-03-08T03:30:00Z", "2026-03-09T03:30:00Z"}},
+	}
+
+	for _, c := range cases {
+		tr := newZonedTrigger(t, job.TriggerSpec{Type: job.TRIGGER_CRON, CronExpression: c.expression, TimeZone: c.zone})
+		after := utc(c.after)
+		for _, expected := range c.expected {
+			next := tr.NextFireTime(after)
+			if !next.Equal(utc(expected)) {
+				t.Errorf("Expected [%s] in %s after [%s] to fire at [%s]. Observed [%s]", c.expression, c.zone, after, expected, next.UTC())
+				break
+			}
+			after = next
+		}
+	}
+}
+
+func TestCronDSTFireCounts(t *testing.T) {
+	cases := []struct {
+		zone     string
+		day      string
+		expected int
+	}{
+		// 23 hours long, 02:00 and 03:00 both fire at 03:00
+		{"America/New_York", "2026-03-08", 23},
+		// 25 hours long, the repeated 01:00 fires once
+		{"America/New_York", "2026-11-01", 24},
+		{"Europe/Berlin", "2026-03-29", 23},
+		{"Europe/Berlin", "2026-10-25", 24},
+		{"UTC", "2026-03-08", 24},
+	}
+
+	for _, c := range cases {
+		loc, _ := time.LoadLocation(c.zone)
+		from, _ := time.ParseInLocation("2006-01-02", c.day, loc)
+		to := from.AddDate(0, 0, 1)
+		tr := newZonedTrigger(t, job.TriggerSpec{Type: job.TRIGGER_CRON, CronExpression: "0 * * * *", TimeZone: c.zone})
+
+		fires := 0
+		for next := tr.NextFireTime(from.Add(-time.Second)); next.Before(to); next = tr.NextFireTime(next) {
+			fires++
+		}
+		if fires != c.expected {
+			t.Errorf("Expected [%d] hourly fires on %s in %s. Observed [%d] fires", c.expected, c.day, c.zone, fires)
+		}
+	}
+}
+
+func TestISO8601DSTTransitions(t *testing.T) {
+	// days are calendar days, the clock part is elapsed time
+	daily := newZonedTrigger(t, job.TriggerSpec{Type: job.TRIGGER_ISO8601, Schedule: "R/2026-03-07T02:30:00/P1D", TimeZone: "America/New_York"})
+	elapsed := newZonedTrigger(t, job.TriggerSpec{Type: job.TRIGGER_ISO8601, Schedule: "R/2026-03-07T02:30:00/PT24H", TimeZone: "America/New_York"})
+
+	cases := []struct {
+		tr       trigger.Trigger
+		expected []string
+	}{
+		{daily, []string{"2026-03-07T07:30:00Z", "2026-03-08T07:00:00Z", "2026-03-09T06:30:00Z"}},
+		{elapsed, []string{"2026-03-07T07:30:00Z", "2026-03-08T07:30:00Z", "2026-03-09T07:30:00Z"}},
+	}
+	for i, c := range cases {
+		after := utc("2026-03-07T00:00:00Z")
+		for _, expected := range c.expected {
+			next := c.tr.NextFireTime(after)
+			if !next.Equal(utc(expected)) {
+				t.Errorf("Expected schedule #%d after [%s] to fire at [%s]. Observed [%s]", i, after, expected, next.UTC())
+				break
+			}
+			after = next
+		}
+	}
+}
+
+func TestUnknownTimeZone(t *testing.T) {
+	spec := job.TriggerSpec{Type: job.TRIGGER_CRON, CronExpression: "0 * * * *", TimeZone: "Mars/Olympus_Mons"}
+	err := trigger.Validate(spec)
+	if verr, ok := err.(*job.ValidationError); !ok || verr.Field != "trigger.timeZone" {
+		t.Errorf("Expected invalid [trigger.timeZone]. Observed: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package trigger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jteso/xchronos/job"
+)
+
+// Trigger decides when a job has to be fired
+type Trigger interface {
+	// NextFireTime returns the first fire time strictly after `after`, or the zero
+	// time if the trigger will not fire anymore
+	NextFireTime(after time.Time) time.Time
+}
+
+// New builds the trigger described by spec, carrying on from the given state (see `NewState`)
+func New(spec job.TriggerSpec, state *State) (Trigger, error) {
+	switch spec.Type {
+	case job.TRIGGER_SIMPLE:
+		return NewSimpleTrigger(spec, state), nil
+	case job.TRIGGER_CRON:
+		return NewCronTrigger(spec, state)
+	case job.TRIGGER_ISO8601:
+		return NewISO8601Trigger(spec, state)
+	case job.TRIGGER_CUSTOM:
+		return newCustomTrigger(spec, state)
+	}
+	return nil, fmt.Errorf("Unknown trigger type: %s", spec.Type)
+}